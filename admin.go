@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"github.com/alexaandru/elastic_guardian/store"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+The admin API is served on its own address (see -admin) and is only available to
+users authenticated by the -auth-chain chain which were assigned the -admin-role role
+(and whose client IP is allowed, see -ip-rules).
+
+It exposes the following endpoints (all request and response bodies are JSON):
+
+	GET    /users         lists all users
+	GET    /users/{name}  shows one user
+	PUT    /users/{name}  creates or updates a user (see adminUser)
+	DELETE /users/{name}  deletes a user
+	POST   /check         tests an access decision (see adminCheck)
+	POST   /reload        reloads all the data from the configured store
+	GET    /metrics       exposes the expvar counters
+
+Changes are made transactionally against the configured store (see the store
+package) and applied to the running proxy immediately. With the default (files)
+store, each of the credentials, roles and authorizations which were loaded from a
+file is persisted back to that file atomically; the inline variables are only
+changed in memory.
+*/
+
+// adminUser is the representation of a user in the admin API.
+//
+// On PUT, Password (hashed by the API) or Hash must be given when creating a user;
+// when updating, omitted fields are left unchanged.
+type adminUser struct {
+	Name     string      `json:"name"`
+	Hash     string      `json:"hash,omitempty"`
+	Password string      `json:"password,omitempty"`
+	Roles    []string    `json:"roles"`
+	Rules    *adminRules `json:"rules,omitempty"`
+}
+
+// adminRules is the representation of az.AuthorizationRules in the admin API.
+type adminRules struct {
+	Default string   `json:"default"`
+	Rules   []string `json:"rules"`
+}
+
+// adminCheck is both the request and the response of the /check endpoint.
+type adminCheck struct {
+	User    string `json:"user"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Allowed bool   `json:"allowed"`
+	// Explanation holds the time constraints weighing on the decision (see az.Explain).
+	Explanation []string `json:"explanation,omitempty"`
+}
+
+// adminMu serializes the admin API changes.
+var adminMu sync.Mutex
+
+func initAdmin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", adminListUsers)
+	mux.HandleFunc("/users/", adminUserHandler)
+	mux.HandleFunc("/check", adminCheckHandler)
+	mux.HandleFunc("/reload", adminReload)
+	mux.Handle("/metrics", expvar.Handler())
+
+	return wrapAdminAuthentication(mux)
+}
+
+func wrapAdminAuthentication(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, id := authChain.Authenticate(r)
+		if status == aa.Passed && az.HasCapability(id, AdminRole) && az.IPAllowed(clientIP(r), id.User, id.Groups...) {
+			r = r.WithContext(aa.NewContext(r.Context(), id))
+			r.Header.Set("X-Authenticated-User", id.User)
+			go logPrint(r, "202 Accepted (admin)")
+			h.ServeHTTP(w, r)
+		} else if status == aa.NotAttempted {
+			go logPrint(r, "401 Unauthorized (admin)")
+			w.Header().Set("WWW-Authenticate", "Basic realm=\""+Realm+" admin\"")
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		} else {
+			go logPrint(r, "403 Forbidden (admin)")
+			http.Error(w, "403 Forbidden (admin)", http.StatusForbidden)
+		}
+	})
+}
+
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	cs, rs, as := aa.Credentials(), aa.AllRoles(), az.Authorizations()
+	users := []adminUser{}
+	for _, name := range adminUserNames(cs, rs, as) {
+		users = append(users, newAdminUser(name, cs, rs, as))
+	}
+
+	adminRespond(w, http.StatusOK, users)
+}
+
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/users/")
+	if name == "" || strings.ContainsAny(name, ":/\n") {
+		adminError(w, http.StatusBadRequest, errors.New("invalid user name"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		cs, rs, as := aa.Credentials(), aa.AllRoles(), az.Authorizations()
+		if !adminUserExists(name, cs, rs, as) {
+			adminError(w, http.StatusNotFound, errors.New("no such user"))
+			return
+		}
+
+		adminRespond(w, http.StatusOK, newAdminUser(name, cs, rs, as))
+	case "PUT":
+		var u adminUser
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		u.Name = name
+		if status, err := adminUpdate(func(cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) (int, error) {
+			return applyAdminUser(u, cs, rs, as)
+		}); err != nil {
+			adminError(w, status, err)
+			return
+		}
+
+		adminRespond(w, http.StatusOK, newAdminUser(name, aa.Credentials(), aa.AllRoles(), az.Authorizations()))
+	case "DELETE":
+		if status, err := adminUpdate(func(cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) (int, error) {
+			if !adminUserExists(name, cs, rs, as) {
+				return http.StatusNotFound, errors.New("no such user")
+			}
+
+			delete(cs, name)
+			delete(rs, name)
+			delete(as, name)
+
+			return http.StatusOK, nil
+		}); err != nil {
+			adminError(w, status, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func adminCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var c adminCheck
+	if r.Method != "POST" {
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	u, err := url.Parse(c.Path)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The decision is made as the proxy would make it, for the roles the user was assigned.
+	roles := aa.AllRoles()[c.User]
+	req := &az.Request{User: c.User, Groups: roles, Method: c.Method, Path: u.Path, Query: query, Indices: es.Indices(u.Path)}
+	c.Allowed, _ = authorizer.Authorize(req)
+	c.Explanation = az.Explain(c.User, c.Method, c.Path, roles...)
+	adminRespond(w, http.StatusOK, c)
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	adminMu.Lock()
+	err := loadAuthData()
+	adminMu.Unlock()
+
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyAdminUser creates or updates u into the given stores.
+func applyAdminUser(u adminUser, cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) (int, error) {
+	if u.Password != "" {
+		u.Hash = aa.Hash(u.Password)
+	}
+
+	if strings.ContainsAny(u.Hash, ":\n") {
+		return http.StatusBadRequest, errors.New("invalid hash")
+	} else if u.Hash != "" {
+		cs[u.Name] = u.Hash
+	} else if _, ok := cs[u.Name]; !ok {
+		return http.StatusBadRequest, errors.New("password or hash is required for new users")
+	}
+
+	if u.Roles != nil {
+		for _, role := range u.Roles {
+			if role == "" || strings.ContainsAny(role, ":,\n") {
+				return http.StatusBadRequest, errors.New("invalid role: " + role)
+			}
+		}
+
+		rs[u.Name] = u.Roles
+	}
+
+	if u.Rules != nil {
+		ar := az.AuthorizationRules{DefaultRule: az.Deny, Rules: u.Rules.Rules}
+		if u.Rules.Default == "allow" {
+			ar.DefaultRule = az.Allow
+		} else if u.Rules.Default != "deny" {
+			return http.StatusBadRequest, errors.New("Unknown default rule " + u.Rules.Default)
+		}
+
+		if err := az.ValidateRules(ar); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		as[u.Name] = ar
+	}
+
+	return http.StatusOK, nil
+}
+
+// adminUpdate applies fn to the data in authStore, in one transaction, then (if that
+// succeeded) loads the updated data into the running proxy.
+func adminUpdate(fn func(aa.CredentialsStore, aa.RolesStore, az.AuthorizationStore) (int, error)) (status int, err error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	status = http.StatusInternalServerError
+	err = authStore.Update(func(d *store.Data) (e error) {
+		status, e = fn(d.Credentials, d.Roles, d.Authorizations)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	d, err := authStore.Load()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	d.Apply()
+	purgeCache()
+
+	return http.StatusOK, nil
+}
+
+// adminUserNames lists (sorted) all the users known to any of the stores.
+func adminUserNames(cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) (names []string) {
+	seen := map[string]bool{}
+	for name := range cs {
+		seen[name] = true
+	}
+	for name := range rs {
+		seen[name] = true
+	}
+	for name := range as {
+		seen[name] = true
+	}
+
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+func adminUserExists(name string, cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) bool {
+	_, inCs := cs[name]
+	_, inRs := rs[name]
+	_, inAs := as[name]
+
+	return inCs || inRs || inAs
+}
+
+func newAdminUser(name string, cs aa.CredentialsStore, rs aa.RolesStore, as az.AuthorizationStore) adminUser {
+	u := adminUser{Name: name, Hash: cs[name], Roles: rs[name]}
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+
+	if ar, ok := as[name]; ok {
+		u.Rules = &adminRules{Default: "deny", Rules: ar.Rules}
+		if ar.DefaultRule {
+			u.Rules.Default = "allow"
+		}
+		if u.Rules.Rules == nil {
+			u.Rules.Rules = []string{}
+		}
+	}
+
+	return u
+}
+
+func adminRespond(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminRespond(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	"github.com/alexaandru/elastic_guardian/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadAdminTestData() {
+	loadCredentials()
+	loadAuthorizations()
+	aa.LoadRoles(aa.RolesStore{"foo": {"admin"}})
+	AdminRole = "admin"
+
+	authStore = &store.Files{Defaults: store.Data{
+		Credentials:    aa.Credentials(),
+		Roles:          aa.AllRoles(),
+		Authorizations: az.Authorizations(),
+	}}
+}
+
+func adminRequest(method, path, header, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+
+	recorder := httptest.NewRecorder()
+	initAdmin().ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestAdminRequiresAdminRole(t *testing.T) {
+	loadAdminTestData()
+
+	if code := adminRequest("GET", "/users", "", "").Code; code != http.StatusUnauthorized {
+		t.Error("Expected 401 without credentials, got", code)
+	}
+
+	if code := adminRequest("GET", "/users", "Basic "+bazboo, "").Code; code != http.StatusForbidden {
+		t.Error("Expected 403 for non admin user, got", code)
+	}
+
+	if code := adminRequest("GET", "/users", "Basic "+foobar, "").Code; code != http.StatusOK {
+		t.Error("Expected 200 for admin user, got", code)
+	}
+
+	expired, _ := aa.ParseSchedule("expires-at=2020-01-01")
+	az.LoadSchedules(az.Schedules{"foo": expired})
+	defer az.LoadSchedules(az.Schedules(nil))
+
+	if code := adminRequest("GET", "/users", "Basic "+foobar, "").Code; code != http.StatusForbidden {
+		t.Error("Expected 403 for expired admin user, got", code)
+	}
+}
+
+func TestAdminClientIPRules(t *testing.T) {
+	loadAdminTestData()
+	vpn, _ := aa.ParseCIDRs("10.8.0.0/16")
+	az.LoadIPRules(az.IPRules{"foo": {Allow: vpn}})
+	defer az.LoadIPRules(az.IPRules(nil))
+
+	for remote, expected := range map[string]int{"10.8.1.1:1234": http.StatusOK, "192.168.1.1:1234": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Authorization", "Basic "+foobar)
+
+		recorder := httptest.NewRecorder()
+		if initAdmin().ServeHTTP(recorder, req); recorder.Code != expected {
+			t.Errorf("Expected %d from %s, got %d", expected, remote, recorder.Code)
+		}
+	}
+}
+
+func TestAdminListAndShowUsers(t *testing.T) {
+	loadAdminTestData()
+
+	var users []adminUser
+	json.Unmarshal(adminRequest("GET", "/users", "Basic "+foobar, "").Body.Bytes(), &users)
+	if len(users) != 2 || users[0].Name != "baz" || users[1].Name != "foo" {
+		t.Fatal("Expected users baz and foo, got", users)
+	}
+
+	if users[1].Rules == nil || users[1].Rules.Default != "allow" || users[1].Roles[0] != "admin" {
+		t.Error("Unexpected representation of foo", users[1])
+	}
+
+	if code := adminRequest("GET", "/users/bogus", "Basic "+foobar, "").Code; code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown user, got", code)
+	}
+}
+
+func TestAdminCreateUpdateDeleteUser(t *testing.T) {
+	loadAdminTestData()
+	CredentialsPath, RolesPath, AuthorizationsPath = "", "", ""
+
+	rec := adminRequest("PUT", "/users/qux", "Basic "+foobar, `{"roles": ["ops"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Expected 400 when creating a user without password, got", rec.Code)
+	}
+
+	rec = adminRequest("PUT", "/users/qux", "Basic "+foobar, `{"password": "quux", "rules": {"default": "deny", "rules": ["GET /public"]}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200 when creating a user, got", rec.Code, rec.Body.String())
+	}
+
+	if status, _ := aa.BasicAuthPassed(basicAuthReq("qux", "quux")); status != aa.Passed {
+		t.Error("New user should be able to authenticate")
+	}
+
+	if !az.AuthorizationPassed("qux", "GET", "/public") || az.AuthorizationPassed("qux", "GET", "/private") {
+		t.Error("New user rules should be in effect")
+	}
+
+	rec = adminRequest("PUT", "/users/qux", "Basic "+foobar, `{"rules": {"default": "deny", "rules": ["GET /(public"]}}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid rules, got", rec.Code)
+	}
+
+	if rec = adminRequest("DELETE", "/users/qux", "Basic "+foobar, ""); rec.Code != http.StatusNoContent {
+		t.Error("Expected 204 when deleting a user, got", rec.Code)
+	}
+
+	if status, _ := aa.BasicAuthPassed(basicAuthReq("qux", "quux")); status == aa.Passed {
+		t.Error("Deleted user should no longer be able to authenticate")
+	}
+
+	if rec = adminRequest("DELETE", "/users/qux", "Basic "+foobar, ""); rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 when deleting an unknown user, got", rec.Code)
+	}
+}
+
+func TestAdminPersistsChangesToFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic_guardian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	CredentialsPath, RolesPath, AuthorizationsPath = filepath.Join(dir, "credentials"), filepath.Join(dir, "roles"), filepath.Join(dir, "authorizations")
+	defer func() { CredentialsPath, RolesPath, AuthorizationsPath = "", "", "" }()
+	ioutil.WriteFile(CredentialsPath, []byte("foo:"+aa.Hash("bar")+"\n"), 0600)
+	ioutil.WriteFile(RolesPath, []byte("foo:admin\n"), 0600)
+	ioutil.WriteFile(AuthorizationsPath, []byte("foo:allow\n"), 0600)
+
+	loadAdminTestData()
+	if authStore, err = initAuthStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := adminRequest("PUT", "/users/qux", "Basic "+foobar, `{"hash": "abc", "roles": ["ops"], "rules": {"default": "allow", "rules": []}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200 when creating a user, got", rec.Code, rec.Body.String())
+	}
+
+	for path, expected := range map[string]string{
+		CredentialsPath:    "qux:abc\n",
+		RolesPath:          "foo:admin\nqux:ops\n",
+		AuthorizationsPath: "qux:allow\n",
+	} {
+		if data, err := ioutil.ReadFile(path); err != nil {
+			t.Error(err)
+		} else if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s to contain %q, got %q", path, expected, data)
+		}
+	}
+
+	if rec = adminRequest("POST", "/reload", "Basic "+foobar, ""); rec.Code != http.StatusNoContent {
+		t.Error("Expected 204 on reload, got", rec.Code, rec.Body.String())
+	}
+
+	if aa.Credentials()["qux"] != "abc" {
+		t.Error("Reloading should have loaded the persisted credentials")
+	}
+}
+
+func TestAdminWithDBStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic_guardian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	StorePath = filepath.Join(dir, "guardian.db")
+	defer func() { StorePath = "" }()
+	loadAdminTestData()
+
+	// A new DB gets seeded from the inline variables (in tests, empty).
+	if authStore, err = initAuthStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := authStore.(*store.DB)
+	db.Update(func(d *store.Data) error {
+		d.Credentials["foo"], d.Roles["foo"] = aa.Hash("bar"), []string{"admin"}
+		return nil
+	})
+
+	rec := adminRequest("PUT", "/users/qux", "Basic "+foobar, `{"password": "quux", "roles": ["ops"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200 when creating a user, got", rec.Code, rec.Body.String())
+	}
+
+	if d, err := db.Load(); err != nil {
+		t.Error(err)
+	} else if d.Version != 3 || d.Credentials["qux"] != aa.Hash("quux") || d.Roles["qux"][0] != "ops" {
+		t.Error("User should have been stored in the DB, got", d)
+	}
+}
+
+func TestAdminCheck(t *testing.T) {
+	loadAdminTestData()
+
+	var c adminCheck
+	rec := adminRequest("POST", "/check", "Basic "+foobar, `{"user": "baz", "method": "GET", "path": "/_cluster/health"}`)
+	json.Unmarshal(rec.Body.Bytes(), &c)
+	if !c.Allowed {
+		t.Error("baz should be allowed to GET /_cluster/health")
+	}
+
+	rec = adminRequest("POST", "/check", "Basic "+foobar, `{"user": "baz", "method": "GET", "path": "/_cluster/stats"}`)
+	json.Unmarshal(rec.Body.Bytes(), &c)
+	if c.Allowed {
+		t.Error("baz should NOT be allowed to GET /_cluster/stats")
+	}
+
+	as := az.Authorizations()
+	as["@readers"] = az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{"GET /_cluster/health"}}
+	az.LoadAuthorizations(as)
+	aa.LoadRoles(aa.RolesStore{"foo": {"admin"}, "qux": {"readers"}})
+	defer loadAdminTestData()
+
+	c = adminCheck{}
+	rec = adminRequest("POST", "/check", "Basic "+foobar, `{"user": "qux", "method": "GET", "path": "/_cluster/health"}`)
+	json.Unmarshal(rec.Body.Bytes(), &c)
+	if !c.Allowed {
+		t.Error("qux should be allowed to GET /_cluster/health by their role, got", c)
+	}
+
+	expired, _ := aa.ParseSchedule("expires-at=2020-01-01")
+	az.LoadSchedules(az.Schedules{"baz": expired})
+	defer az.LoadSchedules(az.Schedules(nil))
+
+	c = adminCheck{}
+	rec = adminRequest("POST", "/check", "Basic "+foobar, `{"user": "baz", "method": "GET", "path": "/_cluster/health"}`)
+	json.Unmarshal(rec.Body.Bytes(), &c)
+	if c.Allowed || len(c.Explanation) != 1 || c.Explanation[0] != "user baz: expired at 2020-01-01T00:00:00Z" {
+		t.Error("baz should no longer be allowed, got", c)
+	}
+}
+
+func basicAuthReq(user, pass string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, pass)
+
+	return req
+}
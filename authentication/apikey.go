@@ -0,0 +1,122 @@
+package authentication
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// APIKey holds one API key (well, its hash) together with the identity it grants.
+type APIKey struct {
+	Hash   string
+	User   string
+	Groups []string
+	// Schedule restricts when the key can be used, if set.
+	Schedule *Schedule
+}
+
+// APIKeyAuthenticator authenticates requests carrying an Elasticsearch style API key:
+//
+// 		Authorization: ApiKey base64(id:key)
+type APIKeyAuthenticator struct {
+	keys map[string]APIKey
+}
+
+// NewAPIKeyAuthenticator creates an APIKeyAuthenticator for the given keys (by ID).
+func NewAPIKeyAuthenticator(keys map[string]APIKey) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+// LoadAPIKeys creates an APIKeyAuthenticator from the given API keys file.
+func LoadAPIKeys(path string) (a *APIKeyAuthenticator, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return ReadAPIKeys(f)
+}
+
+// ReadAPIKeys creates an APIKeyAuthenticator from the given r io.Reader, which must have
+// the format (the user defaults to the key ID, roles and schedule are optional, see
+// ParseSchedule for the latter):
+//
+// 		id:sha256_of_key:user:role1,role2,...,roleN:schedule
+func ReadAPIKeys(r io.Reader) (a *APIKeyAuthenticator, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	keys := map[string]APIKey{}
+	for _, line := range strings.Split(string(rawData), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.Split(line, ":")
+		if len(tokens) < 2 || len(tokens) > 5 || tokens[0] == "" {
+			return nil, errors.New("Invalid API key line: " + line)
+		}
+
+		key := APIKey{Hash: tokens[1], User: tokens[0]}
+		if len(tokens) > 2 && tokens[2] != "" {
+			key.User = tokens[2]
+		}
+
+		if len(tokens) > 3 {
+			for _, role := range strings.Split(tokens[3], ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					key.Groups = append(key.Groups, role)
+				}
+			}
+		}
+
+		if len(tokens) > 4 && strings.TrimSpace(tokens[4]) != "" {
+			if key.Schedule, err = ParseSchedule(tokens[4]); err != nil {
+				return nil, err
+			}
+		}
+
+		keys[tokens[0]] = key
+	}
+
+	return NewAPIKeyAuthenticator(keys), nil
+}
+
+// Authenticate implements Authenticator.
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "ApiKey ") {
+		return NotAttempted, Identity{}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[7:]))
+	if err != nil {
+		return Failed, Identity{Provider: "apikey"}
+	}
+
+	tokens := strings.SplitN(string(raw), ":", 2)
+	key, ok := a.keys[tokens[0]]
+	if !ok || len(tokens) != 2 || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(Hash(tokens[1]))) != 1 {
+		return Failed, Identity{Provider: "apikey", Attributes: map[string]string{"api_key_id": tokens[0]}}
+	}
+
+	if key.Schedule != nil && !key.Schedule.Active(time.Now()) {
+		return Failed, Identity{Provider: "apikey", Attributes: map[string]string{"api_key_id": tokens[0]}}
+	}
+
+	return Passed, Identity{
+		User:       key.User,
+		Groups:     append([]string(nil), key.Groups...),
+		Attributes: map[string]string{"api_key_id": tokens[0]},
+		Provider:   "apikey",
+	}
+}
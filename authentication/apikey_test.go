@@ -0,0 +1,72 @@
+package authentication
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func apiKeyReq(header string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", header)
+
+	return req
+}
+
+func apiKeyHeader(id, key string) string {
+	return "ApiKey " + base64.StdEncoding.EncodeToString([]byte(id+":"+key))
+}
+
+func TestReadAPIKeys(t *testing.T) {
+	for _, bogus := range []string{"foo\n", ":hash\n", "a:b:c:d:e\n", "a:b:c:d:days=mon:f\n"} {
+		if _, err := ReadAPIKeys(strings.NewReader(bogus)); err == nil {
+			t.Errorf("Line %q should be rejected", bogus)
+		}
+	}
+
+	if _, err := LoadAPIKeys("bogus.keys"); err == nil {
+		t.Error("Missing files should be reported")
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a, err := ReadAPIKeys(strings.NewReader("k1:" + Hash("secret") + ":shipper:ingest,monitoring\nk2:" + Hash("other") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, id := a.Authenticate(apiKeyReq(apiKeyHeader("k1", "secret")))
+	if status != Passed || id.User != "shipper" || !id.HasGroup("ingest") || id.Attributes["api_key_id"] != "k1" {
+		t.Error("Unexpected result", status, id)
+	}
+
+	if status, id = a.Authenticate(apiKeyReq(apiKeyHeader("k2", "other"))); status != Passed || id.User != "k2" {
+		t.Error("The user should default to the key ID, got", status, id)
+	}
+
+	expiring, err := ReadAPIKeys(strings.NewReader("k1:" + Hash("secret") + ":contractor::expires-at=2020-01-01\nk2:" + Hash("other") + ":::not-before=2020-01-01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ = expiring.Authenticate(apiKeyReq(apiKeyHeader("k1", "secret"))); status != Failed {
+		t.Error("Expired keys should fail, got", status)
+	}
+
+	if status, _ = expiring.Authenticate(apiKeyReq(apiKeyHeader("k2", "other"))); status != Passed {
+		t.Error("Keys within their validity window should pass, got", status)
+	}
+
+	for header, expected := range map[string]int{
+		apiKeyHeader("k1", "bogus"):  Failed,
+		apiKeyHeader("k3", "secret"): Failed,
+		"ApiKey !!!":                 Failed,
+		"Basic Zm9vOmJhcg==":         NotAttempted,
+		"":                           NotAttempted,
+	} {
+		if status, _ := a.Authenticate(apiKeyReq(header)); status != expected {
+			t.Errorf("Expected %d for %q got %d", expected, header, status)
+		}
+	}
+}
@@ -8,10 +8,18 @@ LoadCredentials().
 Currently supported backends:
 
 	a CredentialsStore variable directly
+	a CredentialsBackend implementation (i.e. the store package)
 	a Reader which can deliver data as specified in LoadCredentialsFromReader()
+	a file name, whose contents are as specified in LoadCredentialsFromReader()
 
 Once credentials are loaded the main functionality is available via BasicAuthPassed()
 which can report if a given Authorization header matches any of the loaded credentials.
+
+Users can optionally be assigned roles, loaded via LoadRoles() from the same kinds of
+backends, and queried via Roles() and HasRole().
+
+Alternatively, credentials can be verified against an LDAP directory, once enabled via
+LoadLDAP(), using LDAPAuthPassed(), which also maps the LDAP groups of users to roles.
 */
 package authentication
 
@@ -23,12 +31,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // CredentialsStore defines the storage type for credentials.
 type CredentialsStore map[string]string
 
+// RolesStore defines the storage type for the roles assigned to each user.
+type RolesStore map[string][]string
+
 // The possible statuses of authentication process
 const (
 	_ = iota
@@ -42,11 +55,38 @@ const (
 // before any authentication checks are attempted.
 var credentials CredentialsStore
 
+// roles holds the roles of each user, if any were loaded.
+var roles RolesStore
+
+// mu guards credentials and roles, which may be swapped at runtime.
+var mu sync.RWMutex
+
+// CredentialsBackend is implemented by pluggable credentials storage backends
+// (see the store package), which can then be passed to LoadCredentials().
+type CredentialsBackend interface {
+	ReadCredentials() (CredentialsStore, error)
+}
+
+// RolesBackend is implemented by pluggable roles storage backends, which can
+// then be passed to LoadRoles().
+type RolesBackend interface {
+	ReadRoles() (RolesStore, error)
+}
+
 // LoadCredentials loads the given credentials into the library.
 func LoadCredentials(backend interface{}) (err error) {
 	switch v := backend.(type) {
 	case CredentialsStore:
+		mu.Lock()
 		credentials = v
+		mu.Unlock()
+	case CredentialsBackend:
+		cs, e := v.ReadCredentials()
+		if e != nil {
+			return e
+		}
+
+		err = LoadCredentials(cs)
 	case io.Reader:
 		err = LoadCredentialsFromReader(v)
 	case string: // assume filename
@@ -54,8 +94,9 @@ func LoadCredentials(backend interface{}) (err error) {
 		if e != nil {
 			return e
 		}
+		defer f.Close()
 
-		LoadCredentials(f)
+		err = LoadCredentials(f)
 	default:
 		err = errors.New("don't know how to handle backend")
 	}
@@ -68,21 +109,200 @@ func LoadCredentials(backend interface{}) (err error) {
 //
 // 		username:sha256_of_password
 func LoadCredentialsFromReader(r io.Reader) (err error) {
+	cs, err := ReadCredentials(r)
+	if err == nil {
+		return LoadCredentials(cs)
+	}
+
+	return
+}
+
+// ReadCredentials reads the credentials from the given r io.Reader, without loading them.
+// See LoadCredentialsFromReader() for the format.
+func ReadCredentials(r io.Reader) (cs CredentialsStore, err error) {
 	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	lines, cs := strings.Split(strings.Trim(string(rawData), "\n"), "\n"), CredentialsStore{}
+	for _, line := range lines {
+		if line = strings.Trim(line, " "); line == "" {
+			continue
+		}
+
+		tokens := strings.Split(line, ":")
+		if len(tokens) < 2 {
+			return nil, errors.New("Invalid credentials line: " + line)
+		}
+
+		cs[tokens[0]] = tokens[1]
+	}
+
+	return
+}
+
+// Credentials returns a copy of the currently loaded credentials.
+func Credentials() CredentialsStore {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cs := CredentialsStore{}
+	for user, hash := range credentials {
+		cs[user] = hash
+	}
+
+	return cs
+}
+
+// WriteCredentials writes cs to w, in the format expected by LoadCredentialsFromReader().
+func WriteCredentials(w io.Writer, cs CredentialsStore) (err error) {
+	for _, user := range sortedKeys(cs) {
+		if _, err = fmt.Fprintf(w, "%s:%s\n", user, cs[user]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// LoadRoles loads the given roles into the library. It accepts the same kinds of
+// backends as LoadCredentials(), with a RolesStore in place of a CredentialsStore.
+func LoadRoles(backend interface{}) (err error) {
+	switch v := backend.(type) {
+	case RolesStore:
+		mu.Lock()
+		roles = v
+		mu.Unlock()
+	case RolesBackend:
+		rs, e := v.ReadRoles()
+		if e != nil {
+			return e
+		}
+
+		err = LoadRoles(rs)
+	case io.Reader:
+		err = LoadRolesFromReader(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		err = LoadRoles(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	return
+}
+
+// LoadRolesFromReader loads the roles from the given r io.Reader into the library.
+// The file must have the format:
+//
+// 		username:role1,role2,...,roleN
+func LoadRolesFromReader(r io.Reader) (err error) {
+	rs, err := ReadRoles(r)
 	if err == nil {
-		lines, cs := strings.Split(strings.Trim(string(rawData), "\n"), "\n"), CredentialsStore{}
-		for _, line := range lines {
-			tokens := strings.Split(strings.Trim(line, " "), ":")
-			user, pass := tokens[0], tokens[1]
-			cs[user] = pass
+		return LoadRoles(rs)
+	}
+
+	return
+}
+
+// ReadRoles reads the roles from the given r io.Reader, without loading them.
+// See LoadRolesFromReader() for the format.
+func ReadRoles(r io.Reader) (rs RolesStore, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	rs = RolesStore{}
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.Trim(line, " "); line == "" {
+			continue
 		}
 
-		return LoadCredentials(cs)
+		tokens := strings.Split(line, ":")
+		if len(tokens) != 2 {
+			return nil, errors.New("Invalid roles line: " + line)
+		}
+
+		for _, role := range strings.Split(tokens[1], ",") {
+			if role = strings.Trim(role, " "); role != "" {
+				rs[tokens[0]] = append(rs[tokens[0]], role)
+			}
+		}
+	}
+
+	return
+}
+
+// AllRoles returns a copy of the currently loaded roles.
+func AllRoles() RolesStore {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	rs := RolesStore{}
+	for user, userRoles := range roles {
+		rs[user] = append([]string(nil), userRoles...)
+	}
+
+	return rs
+}
+
+// WriteRoles writes rs to w, in the format expected by LoadRolesFromReader().
+func WriteRoles(w io.Writer, rs RolesStore) (err error) {
+	users := make([]string, 0, len(rs))
+	for user := range rs {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+		if len(rs[user]) == 0 {
+			continue
+		}
+
+		if _, err = fmt.Fprintf(w, "%s:%s\n", user, strings.Join(rs[user], ",")); err != nil {
+			return
+		}
 	}
 
 	return
 }
 
+// Roles returns the roles assigned to user.
+func Roles(user string) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return append([]string(nil), roles[user]...)
+}
+
+// HasRole determines if user was assigned role.
+func HasRole(user, role string) bool {
+	for _, r := range Roles(user) {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortedKeys returns the keys of cs in alphabetical order.
+func sortedKeys(cs CredentialsStore) (keys []string) {
+	for key := range cs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return
+}
+
 // Hash generates a hash of the given string. Used for hashing passwords.
 func Hash(str string) (hash string) {
 	h := sha256.New()
@@ -93,19 +313,39 @@ func Hash(str string) (hash string) {
 
 // BasicAuthPassed verifies an authHeader to see if it passed HTTP Basic Auth.
 func BasicAuthPassed(r *http.Request) (status int, user string) {
-	usr, pass, _ := r.BasicAuth()
-	if usr == "" && r.URL != nil && r.URL.User != nil {
-		usr = r.URL.User.Username()
-		pass, _ = r.URL.User.Password()
-	}
-
+	usr, pass := requestCredentials(r)
 	if usr == "" {
 		return NotAttempted, ""
 	}
 
-	if credentials[usr] == Hash(pass) {
+	mu.RLock()
+	hash, ok := credentials[usr]
+	mu.RUnlock()
+
+	if ok && hash == Hash(pass) {
 		return Passed, usr
 	}
 
 	return Failed, usr
 }
+
+// hasCredentials determines if user is found in the loaded credentials.
+func hasCredentials(user string) bool {
+	mu.RLock()
+	_, ok := credentials[user]
+	mu.RUnlock()
+
+	return ok
+}
+
+// requestCredentials extracts the Basic Auth credentials from r's Authorization header
+// or, failing that, from its URL.
+func requestCredentials(r *http.Request) (user, pass string) {
+	user, pass, _ = r.BasicAuth()
+	if user == "" && r.URL != nil && r.URL.User != nil {
+		user = r.URL.User.Username()
+		pass, _ = r.URL.User.Password()
+	}
+
+	return
+}
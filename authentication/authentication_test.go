@@ -198,3 +198,72 @@ func mockReq(hdr, uri string, t *testing.T) *http.Request {
 
 	return &req
 }
+
+// Test credentials accessors
+func TestCredentialsReturnsACopy(t *testing.T) {
+	loadCredentials()
+	cs := Credentials()
+	cs["foo"] = "changed"
+
+	if credentials["foo"] == "changed" {
+		t.Error("Credentials() should return a copy")
+	}
+}
+
+func TestWriteCredentials(t *testing.T) {
+	var buf strings.Builder
+	if err := WriteCredentials(&buf, CredentialsStore{"foo": "h1", "baz": "h2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "baz:h2\nfoo:h1\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+}
+
+// Test roles
+func TestLoadRolesFromString(t *testing.T) {
+	roles = RolesStore{}
+	if err := LoadRoles("roles_test.txt"); err != nil {
+		t.Error("Loading roles failed", err)
+	}
+
+	if !HasRole("foo", "admin") || !HasRole("baz", "readers") {
+		t.Error("roles should have been loaded")
+	}
+
+	if HasRole("baz", "admin") || HasRole("bogus", "admin") {
+		t.Error("Unassigned roles should not be reported")
+	}
+}
+
+func TestLoadRolesFromBadSources(t *testing.T) {
+	if err := LoadRoles("roles_test.xxx"); err == nil {
+		t.Error("Loading roles from invalid filename should error out")
+	}
+
+	if err := LoadRoles(42); err == nil {
+		t.Error("Loading roles from int should've errored out")
+	}
+
+	if err := LoadRolesFromReader(strings.NewReader("foo\n")); err == nil || err.Error() != "Invalid roles line: foo" {
+		t.Error("Should've errored out on foo line, got", err)
+	}
+
+	if err := LoadRolesFromReader(NastyReader{}); err == nil {
+		t.Error("Loading roles from a reader that errors out should error out")
+	}
+}
+
+func TestWriteRoles(t *testing.T) {
+	LoadRoles(RolesStore{"foo": {"admin"}, "baz": {"ops", "readers"}, "nobody": {}})
+
+	var buf strings.Builder
+	if err := WriteRoles(&buf, AllRoles()); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "baz:ops,readers\nfoo:admin\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+}
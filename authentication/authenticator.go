@@ -0,0 +1,111 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+)
+
+// Identity describes an authenticated user.
+type Identity struct {
+	User string
+	// Groups holds the roles of the user, as established by the authentication provider.
+	Groups []string
+	// Attributes holds any additional (provider specific) information about the user,
+	// i.e. the claims of a JWT or the DN of a client certificate.
+	Attributes map[string]string
+	// Provider is the name of the provider which authenticated the user.
+	Provider string
+}
+
+// Authenticator is implemented by all the authentication providers.
+//
+// Authenticate returns NotAttempted when r carries no credentials the provider understands,
+// Failed when it does but they are invalid (with as much of the identity as is known) and
+// Passed, together with the identity of the user, otherwise.
+type Authenticator interface {
+	Authenticate(r *http.Request) (status int, id Identity)
+}
+
+// Chain is an Authenticator which tries several providers in order. The first provider
+// which passes the request wins. Otherwise the request fails if any of them failed it,
+// or is NotAttempted if none of them found any credentials.
+type Chain []Authenticator
+
+// StaticAuthenticator authenticates Basic Auth credentials against the loaded credentials
+// (see LoadCredentials()), with the roles loaded via LoadRoles().
+type StaticAuthenticator struct{}
+
+// LDAPAuthenticator authenticates Basic Auth credentials against the LDAP directory
+// (see LoadLDAP()), for the users not found in the loaded credentials. Their roles are the
+// ones mapped from their LDAP groups. It does not attempt anything while LDAP is disabled.
+type LDAPAuthenticator struct{}
+
+// identityKey is the context key for Identity values.
+type identityKey struct{}
+
+// Authenticate implements Authenticator.
+func (c Chain) Authenticate(r *http.Request) (status int, id Identity) {
+	status = NotAttempted
+	for _, a := range c {
+		s, i := a.Authenticate(r)
+		if s == Passed {
+			return s, i
+		} else if s != NotAttempted && status == NotAttempted {
+			status, id = s, i
+		}
+	}
+
+	return
+}
+
+// Authenticate implements Authenticator.
+func (StaticAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	status, user := BasicAuthPassed(r)
+	id = Identity{User: user, Provider: "static"}
+	if status == Passed {
+		id.Groups = Roles(user)
+	}
+
+	return
+}
+
+// Authenticate implements Authenticator.
+func (LDAPAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	if !LDAPEnabled() {
+		return NotAttempted, Identity{}
+	}
+
+	if user, _ := requestCredentials(r); hasCredentials(user) {
+		return NotAttempted, Identity{}
+	}
+
+	status, user, roles := LDAPAuthPassed(r)
+	id = Identity{User: user, Provider: "ldap"}
+	if status == Passed {
+		id.Groups = roles
+	}
+
+	return
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the Identity carried by ctx, if any.
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(identityKey{}).(Identity)
+	return
+}
+
+// HasGroup determines if id has group.
+func (id Identity) HasGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type fixedAuthenticator struct {
+	status int
+	user   string
+}
+
+func (f fixedAuthenticator) Authenticate(r *http.Request) (int, Identity) {
+	return f.status, Identity{User: f.user}
+}
+
+func TestChain(t *testing.T) {
+	req := ldapReq("", "")
+	cases := []struct {
+		chain  Chain
+		status int
+		user   string
+	}{
+		{Chain{}, NotAttempted, ""},
+		{Chain{fixedAuthenticator{NotAttempted, ""}}, NotAttempted, ""},
+		{Chain{fixedAuthenticator{Failed, "a"}, fixedAuthenticator{Passed, "b"}}, Passed, "b"},
+		{Chain{fixedAuthenticator{Failed, "a"}, fixedAuthenticator{Failed, "b"}}, Failed, "a"},
+		{Chain{fixedAuthenticator{NotAttempted, ""}, fixedAuthenticator{Failed, "b"}}, Failed, "b"},
+		{Chain{fixedAuthenticator{Passed, "a"}, fixedAuthenticator{Passed, "b"}}, Passed, "a"},
+	}
+
+	for i, c := range cases {
+		if status, id := c.chain.Authenticate(req); status != c.status || id.User != c.user {
+			t.Errorf("Case %d: expected %d %q got %d %q", i, c.status, c.user, status, id.User)
+		}
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	loadCredentials()
+	LoadRoles(RolesStore{"foo": {"admin"}})
+	defer LoadRoles(RolesStore{})
+
+	status, id := StaticAuthenticator{}.Authenticate(ldapReq("foo", "bar"))
+	if status != Passed || id.User != "foo" || !id.HasGroup("admin") || id.Provider != "static" {
+		t.Error("Unexpected result", status, id)
+	}
+
+	if status, _ = (StaticAuthenticator{}).Authenticate(ldapReq("foo", "bogus")); status != Failed {
+		t.Error("Expected", Failed, "got", status)
+	}
+}
+
+func TestLDAPAuthenticatorWhenDisabled(t *testing.T) {
+	LoadLDAP(nil)
+	if status, _ := (LDAPAuthenticator{}).Authenticate(ldapReq("foo", "bar")); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	srv, clientTLS := newFakeLDAP(t, true)
+	defer srv.ln.Close()
+
+	LoadLDAP(ldapTestConfig(srv.url("ldaps"), clientTLS))
+	defer LoadLDAP(nil)
+	LoadCredentials(CredentialsStore{"baz": Hash("other")})
+	LoadRoles(RolesStore{"foo": {"admin"}})
+	defer LoadRoles(RolesStore{})
+
+	status, id := LDAPAuthenticator{}.Authenticate(ldapReq("foo", "bar"))
+	if status != Passed || id.Provider != "ldap" || !id.HasGroup("ops") || id.HasGroup("admin") {
+		t.Error("Expected the roles mapped from LDAP only, got", status, id)
+	}
+
+	// The users found in the credentials are never looked up in LDAP.
+	if status, _ = (LDAPAuthenticator{}).Authenticate(ldapReq("baz", "boo")); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+
+	if status, _ = (Chain{StaticAuthenticator{}, LDAPAuthenticator{}}).Authenticate(ldapReq("baz", "boo")); status != Failed {
+		t.Error("Expected", Failed, "got", status)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("No identity expected")
+	}
+
+	ctx := NewContext(context.Background(), Identity{User: "foo"})
+	if id, ok := FromContext(ctx); !ok || id.User != "foo" {
+		t.Error("Identity should have been found", id)
+	}
+}
@@ -0,0 +1,155 @@
+package authentication
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// This file implements the (tiny) subset of BER (ITU-T X.690) needed for talking LDAP.
+
+// BER tag classes and the constructed flag.
+const (
+	berUniversal   = 0x00
+	berApplication = 0x40
+	berContext     = 0x80
+	berConstructed = 0x20
+)
+
+// BER universal tags.
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+)
+
+// berMaxLength caps the size of the elements we are willing to read.
+const berMaxLength = 16 << 20
+
+// berElement holds one decoded BER TLV.
+type berElement struct {
+	Tag     byte
+	Content []byte
+}
+
+// berEncode encodes a TLV with the given tag, and the concatenation of contents as value.
+func berEncode(tag byte, contents ...[]byte) []byte {
+	var value []byte
+	for _, c := range contents {
+		value = append(value, c...)
+	}
+
+	return append(append([]byte{tag}, berLength(len(value))...), value...)
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n != 0 && n != -1; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	// Keep the sign bit right.
+	if n == 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	} else if n == -1 && b[0]&0x80 == 0 {
+		b = append([]byte{0xff}, b...)
+	}
+
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+
+	return berEncode(berTagBoolean, []byte{0})
+}
+
+// berRead reads one TLV from r.
+func berRead(r io.Reader) (e berElement, err error) {
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return
+	}
+
+	e.Tag = head[0]
+	length := int(head[1])
+	if head[1]&0x80 != 0 {
+		n := int(head[1] & 0x7f)
+		if n == 0 || n > 4 {
+			return e, errors.New("ber: unsupported length encoding")
+		}
+
+		b := make([]byte, n)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+
+		length = 0
+		for _, c := range b {
+			length = length<<8 | int(c)
+		}
+	}
+
+	if length > berMaxLength {
+		return e, errors.New("ber: element too large")
+	}
+
+	e.Content = make([]byte, length)
+	_, err = io.ReadFull(r, e.Content)
+
+	return
+}
+
+// children decodes the elements contained by a constructed element.
+func (e berElement) children() (children []berElement, err error) {
+	r := strings.NewReader(string(e.Content))
+	for r.Len() > 0 {
+		child, err := berRead(r)
+		if err != nil {
+			return nil, err
+		}
+
+		children = append(children, child)
+	}
+
+	return
+}
+
+// int decodes an INTEGER or ENUMERATED element.
+func (e berElement) int() (n int, err error) {
+	if len(e.Content) == 0 || len(e.Content) > 4 {
+		return 0, errors.New("ber: invalid integer")
+	}
+
+	if e.Content[0]&0x80 != 0 {
+		n = -1
+	}
+
+	for _, c := range e.Content {
+		n = n<<8 | int(c)
+	}
+
+	return
+}
@@ -0,0 +1,51 @@
+package authentication
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBerIntRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, -1, -128, -129, 1 << 20} {
+		e, err := berRead(bytes.NewReader(berInt(berTagInteger, n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual, err := e.int(); err != nil || actual != n {
+			t.Errorf("Expected %d got %d (%v)", n, actual, err)
+		}
+	}
+}
+
+func TestBerLongLengths(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	enc := berString(berTagOctetString, long)
+	if enc[1] != 0x82 || enc[2] != 0x01 || enc[3] != 0x2c {
+		t.Errorf("Unexpected length encoding %x", enc[:4])
+	}
+
+	e, err := berRead(bytes.NewReader(enc))
+	if err != nil || string(e.Content) != long {
+		t.Error("Failed to read back long element", err)
+	}
+}
+
+func TestBerChildren(t *testing.T) {
+	seq := berEncode(berTagSequence, berBool(true), berString(berTagOctetString, "foo"))
+	e, _ := berRead(bytes.NewReader(seq))
+
+	children, err := e.children()
+	if err != nil || len(children) != 2 || children[0].Content[0] != 0xff || string(children[1].Content) != "foo" {
+		t.Error("Unexpected children", children, err)
+	}
+}
+
+func TestBerReadRejectsBogusInput(t *testing.T) {
+	for _, bogus := range [][]byte{{0x04}, {0x04, 0x80}, {0x04, 0x85, 1, 2, 3, 4, 5}, {0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}, {0x04, 0x03, 'a'}} {
+		if _, err := berRead(bytes.NewReader(bogus)); err == nil {
+			t.Errorf("Expected error reading %x", bogus)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package authentication
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// HtpasswdAuthenticator authenticates Basic Auth credentials against the entries of an
+// Apache htpasswd file, with the roles loaded via LoadRoles().
+//
+// Only the SHA1 ({SHA}) and Apache MD5 ($apr1$) hash formats are supported.
+type HtpasswdAuthenticator struct {
+	entries map[string]string
+}
+
+// LoadHtpasswd creates an HtpasswdAuthenticator from the given htpasswd file.
+func LoadHtpasswd(path string) (h *HtpasswdAuthenticator, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return ReadHtpasswd(f)
+}
+
+// ReadHtpasswd creates an HtpasswdAuthenticator from the given r io.Reader, which must
+// have the format of an htpasswd file:
+//
+// 		username:hash
+func ReadHtpasswd(r io.Reader) (h *HtpasswdAuthenticator, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	h = &HtpasswdAuthenticator{entries: map[string]string{}}
+	for _, line := range strings.Split(string(rawData), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) != 2 {
+			return nil, errors.New("Invalid htpasswd line: " + line)
+		}
+
+		if !strings.HasPrefix(tokens[1], "{SHA}") && !strings.HasPrefix(tokens[1], "$apr1$") {
+			return nil, errors.New("Unsupported htpasswd hash for user " + tokens[0])
+		}
+
+		h.entries[tokens[0]] = tokens[1]
+	}
+
+	return
+}
+
+// Authenticate implements Authenticator.
+func (h *HtpasswdAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	user, pass := requestCredentials(r)
+	if user == "" {
+		return NotAttempted, Identity{}
+	}
+
+	id = Identity{User: user, Provider: "htpasswd"}
+	hash, ok := h.entries[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(htpasswdHash(pass, hash))) != 1 {
+		return Failed, id
+	}
+
+	id.Groups = Roles(user)
+
+	return Passed, id
+}
+
+// htpasswdHash hashes pass the same way (incl. the salt) as hash was hashed.
+func htpasswdHash(pass, hash string) string {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	salt := strings.TrimPrefix(hash, "$apr1$")
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+
+	return apr1(pass, salt)
+}
+
+// apr1 implements the Apache variant of the MD5 based crypt(3) algorithm.
+func apr1(pass, salt string) string {
+	const magic, itoa64 = "$apr1$", "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(pass + salt + pass))
+	ctx := md5.New()
+	io.WriteString(ctx, pass+magic+salt)
+	for i := len(pass); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{pass[0]})
+		}
+	}
+
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			io.WriteString(round, pass)
+		} else {
+			round.Write(final)
+		}
+
+		if i%3 != 0 {
+			io.WriteString(round, salt)
+		}
+
+		if i%7 != 0 {
+			io.WriteString(round, pass)
+		}
+
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			io.WriteString(round, pass)
+		}
+
+		final = round.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[i[0]])<<16|uint32(final[i[1]])<<8|uint32(final[i[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return string(out)
+}
@@ -0,0 +1,52 @@
+package authentication
+
+import (
+	"strings"
+	"testing"
+)
+
+const htpasswdTestData = `# comment
+foo:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/
+baz:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+
+func TestApr1(t *testing.T) {
+	if actual := apr1("password", "saltsalt"); actual != "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/" {
+		t.Error("Unexpected hash", actual)
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	if _, err := ReadHtpasswd(strings.NewReader("foo\n")); err == nil {
+		t.Error("Invalid lines should be rejected")
+	}
+
+	if _, err := ReadHtpasswd(strings.NewReader("foo:$2y$05$abc\n")); err == nil {
+		t.Error("Unsupported hashes should be rejected")
+	}
+
+	if _, err := LoadHtpasswd("bogus.htpasswd"); err == nil {
+		t.Error("Missing files should be reported")
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	h, err := ReadHtpasswd(strings.NewReader(htpasswdTestData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, expected := range map[[2]string]int{
+		{"foo", "password"}: Passed,
+		{"baz", "password"}: Passed,
+		{"foo", "bogus"}:    Failed,
+		{"qux", "password"}: Failed,
+		{"", ""}:            NotAttempted,
+	} {
+		if status, id := h.Authenticate(ldapReq(user[0], user[1])); status != expected {
+			t.Errorf("Expected %d for %v got %d", expected, user, status)
+		} else if status == Passed && (id.User != user[0] || id.Provider != "htpasswd") {
+			t.Error("Unexpected identity", id)
+		}
+	}
+}
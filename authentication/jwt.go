@@ -0,0 +1,242 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTAuthenticator authenticates requests carrying a JSON Web Token:
+//
+// 		Authorization: Bearer <token>
+//
+// Tokens are verified either with Secret (HS256, HS384, HS512) or with PublicKey (RS256,
+// RS384, RS512 for RSA keys, ES256, ES384, ES512 for ECDSA keys); the algorithm must match
+// the kind of key configured. The exp (mandatory) and nbf claims are enforced (with
+// Leeway) and, when set, so are Issuer and Audience.
+//
+// The user is taken from the UserClaim claim (sub by default) and their groups from the
+// GroupsClaim claim (groups by default). All other string claims become attributes.
+type JWTAuthenticator struct {
+	Secret      []byte
+	PublicKey   crypto.PublicKey
+	Issuer      string
+	Audience    string
+	UserClaim   string
+	GroupsClaim string
+	Leeway      time.Duration
+}
+
+// jwtHashes maps the JWT algorithm suffixes to hash functions.
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+// LoadJWTPublicKey loads a PEM encoded (PKIX) RSA or ECDSA public key, or the public key
+// of a PEM encoded certificate, from path.
+func LoadJWTPublicKey(path string) (key crypto.PublicKey, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM data found in " + path)
+	}
+
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return cert.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Authenticate implements Authenticator.
+func (j *JWTAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return NotAttempted, Identity{}
+	}
+
+	claims, err := j.verify(strings.TrimSpace(header[7:]))
+	if err != nil {
+		return Failed, Identity{Provider: "jwt"}
+	}
+
+	userClaim, groupsClaim := j.UserClaim, j.GroupsClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	id = Identity{Attributes: map[string]string{}, Provider: "jwt"}
+	for name, value := range claims {
+		switch v := value.(type) {
+		case string:
+			if name == groupsClaim {
+				id.Groups = append(id.Groups, v)
+			} else {
+				id.Attributes[name] = v
+			}
+		case []interface{}:
+			if name == groupsClaim {
+				for _, g := range v {
+					if s, ok := g.(string); ok {
+						id.Groups = append(id.Groups, s)
+					}
+				}
+			}
+		}
+	}
+
+	if id.User = id.Attributes[userClaim]; id.User == "" {
+		return Failed, id
+	}
+
+	return Passed, id
+}
+
+// verify checks the signature and the registered claims of token and returns its claims.
+func (j *JWTAuthenticator) verify(token string) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+
+	var head struct {
+		Alg string `json:"alg"`
+	}
+	if err = jwtDecode(parts[0], &head); err != nil {
+		return
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+
+	if err = j.verifySignature(head.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return
+	}
+
+	if err = jwtDecode(parts[1], &claims); err != nil {
+		return
+	}
+
+	return claims, j.verifyClaims(claims)
+}
+
+func (j *JWTAuthenticator) verifySignature(alg, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return errors.New("jwt: unsupported algorithm " + alg)
+	}
+
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return errors.New("jwt: unsupported algorithm " + alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := j.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			break
+		}
+
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("jwt: invalid signature")
+		}
+
+		return nil
+	case nil:
+		if alg[:2] != "HS" || len(j.Secret) == 0 {
+			break
+		}
+
+		mac := hmac.New(hash.New, j.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("jwt: invalid signature")
+		}
+
+		return nil
+	}
+
+	return errors.New("jwt: algorithm " + alg + " does not match the configured key")
+}
+
+func (j *JWTAuthenticator) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok {
+		return errors.New("jwt: missing exp claim")
+	} else if now.After(time.Unix(int64(exp), 0).Add(j.Leeway)) {
+		return errors.New("jwt: token expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("jwt: token not valid yet")
+	}
+
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return fmt.Errorf("jwt: unexpected issuer %v", claims["iss"])
+	}
+
+	if j.Audience != "" && !jwtHasAudience(claims["aud"], j.Audience) {
+		return fmt.Errorf("jwt: unexpected audience %v", claims["aud"])
+	}
+
+	return nil
+}
+
+func jwtHasAudience(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if a == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func jwtDecode(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,161 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func jwtToken(t *testing.T, alg string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	head, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":    "foo",
+		"groups": []string{"dev", "ops"},
+		"tenant": "acme",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	j := &JWTAuthenticator{Secret: []byte("s3cr3t"), Issuer: "idp", Audience: "guardian"}
+	claims := validClaims()
+	claims["iss"], claims["aud"] = "idp", []string{"other", "guardian"}
+
+	status, id := j.Authenticate(apiKeyReq("Bearer " + jwtToken(t, "HS256", claims, hs256(j.Secret))))
+	if status != Passed || id.User != "foo" || !id.HasGroup("ops") || id.Attributes["tenant"] != "acme" || id.Provider != "jwt" {
+		t.Error("Unexpected result", status, id)
+	}
+
+	if status, _ = j.Authenticate(apiKeyReq("Basic Zm9vOmJhcg==")); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+
+	bogus := map[string]func(map[string]interface{}) string{
+		"wrong secret": func(c map[string]interface{}) string { return jwtToken(t, "HS256", c, hs256([]byte("bogus"))) },
+		"alg none": func(c map[string]interface{}) string {
+			return jwtToken(t, "none", c, func([]byte) []byte { return nil })
+		},
+		"expired": func(c map[string]interface{}) string {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"no exp": func(c map[string]interface{}) string {
+			delete(c, "exp")
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"not yet valid": func(c map[string]interface{}) string {
+			c["nbf"] = time.Now().Add(time.Hour).Unix()
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"wrong issuer": func(c map[string]interface{}) string {
+			c["iss"] = "bogus"
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"wrong audience": func(c map[string]interface{}) string {
+			c["aud"] = "bogus"
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"no subject": func(c map[string]interface{}) string {
+			delete(c, "sub")
+			return jwtToken(t, "HS256", c, hs256(j.Secret))
+		},
+		"malformed": func(c map[string]interface{}) string { return "a.b" },
+	}
+
+	for name, token := range bogus {
+		c := validClaims()
+		c["iss"], c["aud"] = "idp", "guardian"
+		if status, _ := j.Authenticate(apiKeyReq("Bearer " + token(c))); status != Failed {
+			t.Errorf("Token with %s should fail, got %d", name, status)
+		}
+	}
+}
+
+func TestJWTAuthenticatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &JWTAuthenticator{PublicKey: &key.PublicKey, Secret: []byte("s3cr3t")}
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return sig
+	}
+
+	if status, _ := j.Authenticate(apiKeyReq("Bearer " + jwtToken(t, "RS256", validClaims(), rs256))); status != Passed {
+		t.Error("Expected", Passed, "got", status)
+	}
+
+	// HS256 tokens must not be accepted when a public key is configured (algorithm confusion).
+	if status, _ := j.Authenticate(apiKeyReq("Bearer " + jwtToken(t, "HS256", validClaims(), hs256(j.Secret)))); status != Failed {
+		t.Error("Expected", Failed, "got", status)
+	}
+}
+
+func TestJWTAuthenticatorES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	f, _ := ioutil.TempFile("", "jwt")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	f.Close()
+
+	pub, err := LoadJWTPublicKey(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &JWTAuthenticator{PublicKey: pub, GroupsClaim: "roles", UserClaim: "email"}
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	claims := validClaims()
+	claims["email"], claims["roles"] = "foo@example.com", "admin"
+	status, id := j.Authenticate(apiKeyReq("Bearer " + jwtToken(t, "ES256", claims, es256)))
+	if status != Passed || id.User != "foo@example.com" || !id.HasGroup("admin") || id.HasGroup("dev") {
+		t.Error("Unexpected result", status, id)
+	}
+}
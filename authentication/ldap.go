@@ -0,0 +1,575 @@
+package authentication
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAPConfig holds the settings of the LDAP authentication backend.
+//
+// Users are authenticated by a simple bind, as BindDN (with %s replaced by the escaped
+// user name), using the password from their Basic Auth credentials. Only LDAPS (ldaps://
+// URLs) or StartTLS (ldap:// URLs with StartTLS set) connections are used, so that
+// passwords never travel in clear text.
+//
+// If GroupBaseDN is set, the groups of the user are then looked up (as the user) under it,
+// via GroupFilter (with %s replaced by the escaped user DN), and the values of their
+// GroupAttribute are mapped to roles via GroupRoles. Without GroupRoles, the group names
+// are used as roles directly.
+type LDAPConfig struct {
+	URL            string
+	StartTLS       bool
+	TLSConfig      *tls.Config
+	BindDN         string
+	GroupBaseDN    string
+	GroupFilter    string
+	GroupAttribute string
+	GroupRoles     RolesStore
+	CacheTTL       time.Duration
+	Timeout        time.Duration
+}
+
+// ldapEntry is a cached positive LDAP authentication result.
+type ldapEntry struct {
+	hash    string
+	roles   []string
+	expires time.Time
+}
+
+// LDAP result codes we care about.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// LDAP protocol operations (application tags).
+const (
+	ldapBindRequest      = berApplication | berConstructed | 0
+	ldapBindResponse     = berApplication | berConstructed | 1
+	ldapUnbindRequest    = berApplication | 2
+	ldapSearchRequest    = berApplication | berConstructed | 3
+	ldapSearchResEntry   = berApplication | berConstructed | 4
+	ldapSearchResDone    = berApplication | berConstructed | 5
+	ldapSearchResRef     = berApplication | berConstructed | 19
+	ldapExtendedRequest  = berApplication | berConstructed | 23
+	ldapExtendedResponse = berApplication | berConstructed | 24
+)
+
+// ldapStartTLSOID identifies the StartTLS extended operation.
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// errLDAPInvalidCredentials is returned by ldapConn.bind() on wrong credentials.
+var errLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+var ldapConfig *LDAPConfig
+
+// ldapCache holds the positive authentication results, by user name.
+var ldapCache = map[string]ldapEntry{}
+
+// ldapMu guards ldapConfig and ldapCache.
+var ldapMu sync.Mutex
+
+// LoadLDAP enables the LDAP authentication backend with the given config (or disables
+// it when cfg is nil). It also clears the cache of authentication results.
+func LoadLDAP(cfg *LDAPConfig) (err error) {
+	if cfg != nil {
+		u, e := url.Parse(cfg.URL)
+		if e != nil {
+			return e
+		}
+
+		if u.Scheme != "ldaps" && !(u.Scheme == "ldap" && cfg.StartTLS) {
+			return errors.New("ldap: either an ldaps:// URL or StartTLS is required")
+		}
+
+		if !strings.Contains(cfg.BindDN, "%s") {
+			return errors.New("ldap: the bind DN must contain a %s placeholder for the user name")
+		}
+
+		if cfg.GroupBaseDN != "" {
+			if _, err = ldapFilter(fmt.Sprintf(cfg.GroupFilter, "x")); err != nil {
+				return
+			}
+		}
+	}
+
+	ldapMu.Lock()
+	ldapConfig, ldapCache = cfg, map[string]ldapEntry{}
+	ldapMu.Unlock()
+
+	return
+}
+
+// LDAPEnabled reports whether the LDAP authentication backend is enabled.
+func LDAPEnabled() bool {
+	ldapMu.Lock()
+	defer ldapMu.Unlock()
+
+	return ldapConfig != nil
+}
+
+// LDAPAuthPassed verifies the Basic Auth credentials of r against the LDAP directory.
+// Besides the statuses returned by BasicAuthPassed() it also returns the roles of the user.
+func LDAPAuthPassed(r *http.Request) (status int, user string, roles []string) {
+	user, pass := requestCredentials(r)
+	if user == "" {
+		return NotAttempted, "", nil
+	} else if pass == "" {
+		return Failed, user, nil // an empty password would make it an unauthenticated bind
+	}
+
+	ldapMu.Lock()
+	cfg := ldapConfig
+	entry, ok := ldapCache[user]
+	ldapMu.Unlock()
+
+	if cfg == nil {
+		return Failed, user, nil
+	}
+
+	hash := Hash(pass)
+	if ok && entry.hash == hash && time.Now().Before(entry.expires) {
+		return Passed, user, entry.roles
+	}
+
+	groups, err := cfg.authenticate(user, pass)
+	if err != nil {
+		if err != errLDAPInvalidCredentials {
+			log.Println("LDAP authentication of", user, "failed:", err)
+		}
+
+		return Failed, user, nil
+	}
+
+	roles = cfg.roles(groups)
+	if cfg.CacheTTL > 0 {
+		ldapMu.Lock()
+		if ldapConfig == cfg {
+			ldapCache[user] = ldapEntry{hash, roles, time.Now().Add(cfg.CacheTTL)}
+		}
+		ldapMu.Unlock()
+	}
+
+	return Passed, user, roles
+}
+
+// roles maps groups to roles.
+func (cfg *LDAPConfig) roles(groups []string) (roles []string) {
+	if cfg.GroupRoles == nil {
+		return groups
+	}
+
+	seen := map[string]bool{}
+	for _, group := range groups {
+		for _, role := range cfg.GroupRoles[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return
+}
+
+// authenticate binds to the directory as user and returns the user's groups.
+func (cfg *LDAPConfig) authenticate(user, pass string) (groups []string, err error) {
+	c, err := dialLDAP(cfg)
+	if err != nil {
+		return
+	}
+	defer c.close()
+
+	dn := fmt.Sprintf(cfg.BindDN, ldapEscapeDN(user))
+	if err = c.bind(dn, pass); err != nil || cfg.GroupBaseDN == "" {
+		return
+	}
+
+	attr := cfg.GroupAttribute
+	if attr == "" {
+		attr = "cn"
+	}
+
+	filter, err := ldapFilter(fmt.Sprintf(cfg.GroupFilter, ldapEscapeFilter(dn)))
+	if err != nil {
+		return
+	}
+
+	return c.search(cfg.GroupBaseDN, filter, attr)
+}
+
+// ldapConn is a minimal, synchronous, LDAPv3 client connection.
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+func dialLDAP(cfg *LDAPConfig) (c *ldapConn, err error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	host, dialer := u.Host, &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	} else {
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	c = &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" {
+		if err = c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func (c *ldapConn) startTLS(cfg *tls.Config) (err error) {
+	resp, err := c.roundTrip(berEncode(ldapExtendedRequest, berString(berContext|0, ldapStartTLSOID)), ldapExtendedResponse)
+	if err != nil {
+		return
+	}
+
+	if err = ldapResult(resp); err != nil {
+		return
+	}
+
+	tlsConn := tls.Client(c.conn, cfg)
+	if err = tlsConn.Handshake(); err != nil {
+		return
+	}
+
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+
+	return
+}
+
+func (c *ldapConn) bind(dn, pass string) (err error) {
+	req := berEncode(ldapBindRequest,
+		berInt(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(berContext|0, pass),
+	)
+
+	resp, err := c.roundTrip(req, ldapBindResponse)
+	if err != nil {
+		return
+	}
+
+	return ldapResult(resp)
+}
+
+// search performs a subtree search and collects the values of attr of all entries found.
+func (c *ldapConn) search(base string, filter []byte, attr string) (values []string, err error) {
+	req := berEncode(ldapSearchRequest,
+		berString(berTagOctetString, base),
+		berInt(berTagEnumerated, 2), // wholeSubtree
+		berInt(berTagEnumerated, 0), // neverDerefAliases
+		berInt(berTagInteger, 0),
+		berInt(berTagInteger, 0),
+		berBool(false),
+		filter,
+		berEncode(berTagSequence, berString(berTagOctetString, attr)),
+	)
+
+	if err = c.send(req); err != nil {
+		return
+	}
+
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.Tag {
+		case ldapSearchResEntry:
+			vals, err := ldapAttributeValues(op, attr)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, vals...)
+		case ldapSearchResRef: // referrals are not followed
+		case ldapSearchResDone:
+			return values, ldapResult(op)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response 0x%x", op.Tag)
+		}
+	}
+}
+
+func (c *ldapConn) close() {
+	c.send(berEncode(ldapUnbindRequest))
+	c.conn.Close()
+}
+
+func (c *ldapConn) roundTrip(op []byte, expected byte) (resp berElement, err error) {
+	if err = c.send(op); err != nil {
+		return
+	}
+
+	if resp, err = c.receive(); err == nil && resp.Tag != expected {
+		err = fmt.Errorf("ldap: unexpected response 0x%x", resp.Tag)
+	}
+
+	return
+}
+
+func (c *ldapConn) send(op []byte) (err error) {
+	c.msgID++
+	_, err = c.conn.Write(berEncode(berTagSequence, berInt(berTagInteger, c.msgID), op))
+
+	return
+}
+
+// receive reads the next message for the current request and returns its protocol op.
+func (c *ldapConn) receive() (op berElement, err error) {
+	msg, err := berRead(c.r)
+	if err != nil {
+		return
+	}
+
+	parts, err := msg.children()
+	if err != nil {
+		return
+	}
+
+	if msg.Tag != berTagSequence || len(parts) < 2 {
+		return op, errors.New("ldap: malformed message")
+	}
+
+	if id, e := parts[0].int(); e != nil || id != c.msgID {
+		return op, errors.New("ldap: unexpected message ID")
+	}
+
+	return parts[1], nil
+}
+
+// ldapResult decodes the LDAPResult at the start of op, turning non success codes to errors.
+func ldapResult(op berElement) error {
+	parts, err := op.children()
+	if err != nil {
+		return err
+	}
+
+	if len(parts) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+
+	code, err := parts[0].int()
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("ldap: result code %d: %s", code, parts[2].Content)
+	}
+}
+
+// ldapAttributeValues extracts the values of attr from a SearchResultEntry.
+func ldapAttributeValues(entry berElement, attr string) (values []string, err error) {
+	parts, err := entry.children()
+	if err != nil || len(parts) < 2 {
+		return nil, errors.New("ldap: malformed search result entry")
+	}
+
+	attrs, err := parts[1].children()
+	if err != nil {
+		return
+	}
+
+	for _, a := range attrs {
+		typeAndVals, err := a.children()
+		if err != nil || len(typeAndVals) < 2 {
+			return nil, errors.New("ldap: malformed attribute")
+		}
+
+		if !strings.EqualFold(string(typeAndVals[0].Content), attr) {
+			continue
+		}
+
+		vals, err := typeAndVals[1].children()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range vals {
+			values = append(values, string(v.Content))
+		}
+	}
+
+	return
+}
+
+// ldapFilter encodes a string search filter (RFC 4515), supporting the &, |, ! operators,
+// as well as equality and presence matches.
+func ldapFilter(s string) ([]byte, error) {
+	f, rest, err := ldapParseFilter(strings.TrimSpace(s))
+	if err == nil && rest != "" {
+		err = errors.New("ldap: trailing data in filter: " + rest)
+	}
+
+	return f, err
+}
+
+func ldapParseFilter(s string) (f []byte, rest string, err error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("ldap: filter must start with (")
+	}
+
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|', '!':
+		tag, sub := byte(berContext|berConstructed|0), [][]byte{}
+		if s[0] == '|' {
+			tag |= 1
+		} else if s[0] == '!' {
+			tag |= 2
+		}
+
+		for rest = s[1:]; strings.HasPrefix(rest, "("); {
+			if f, rest, err = ldapParseFilter(rest); err != nil {
+				return
+			}
+			sub = append(sub, f)
+		}
+
+		if !strings.HasPrefix(rest, ")") || len(sub) == 0 || (s[0] == '!' && len(sub) != 1) {
+			return nil, "", errors.New("ldap: malformed filter")
+		}
+
+		return berEncode(tag, sub...), rest[1:], nil
+	}
+
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+
+	item, rest := s[:end], s[end+1:]
+	eq := strings.Index(item, "=")
+	if eq <= 0 || strings.ContainsAny(item[:eq], "~<>:") {
+		return nil, "", errors.New("ldap: unsupported filter item: " + item)
+	}
+
+	attr, value := item[:eq], item[eq+1:]
+	if value == "*" {
+		return berString(berContext|7, attr), rest, nil
+	}
+
+	if strings.Contains(value, "*") {
+		return nil, "", errors.New("ldap: substring filters are not supported: " + item)
+	}
+
+	if value, err = ldapUnescapeFilter(value); err != nil {
+		return
+	}
+
+	return berEncode(berContext|berConstructed|3, berString(berTagOctetString, attr), berString(berTagOctetString, value)), rest, nil
+}
+
+func ldapUnescapeFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		var c byte
+		if i+2 >= len(s) {
+			return "", errors.New("ldap: invalid escape in filter value")
+		} else if _, err := fmt.Sscanf(s[i+1:i+3], "%02x", &c); err != nil {
+			return "", errors.New("ldap: invalid escape in filter value")
+		}
+
+		b.WriteByte(c)
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// ldapEscapeFilter escapes s for safe use as a filter value (RFC 4515).
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// ldapEscapeDN escapes s for safe use as an attribute value in a DN (RFC 4514).
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
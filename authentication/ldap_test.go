@@ -0,0 +1,376 @@
+package authentication
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLDAP is an in-process LDAP server, good enough for testing the LDAP backend.
+type fakeLDAP struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	users     map[string]string   // DN => password
+	groups    map[string][]string // group name => member DNs
+
+	mu    sync.Mutex
+	binds int
+}
+
+func newFakeLDAP(t *testing.T, ldaps bool) (srv *fakeLDAP, clientTLS *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	srv = &fakeLDAP{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		users: map[string]string{
+			"uid=foo,ou=people,dc=example,dc=com": "bar",
+			"uid=baz,ou=people,dc=example,dc=com": "boo",
+		},
+		groups: map[string][]string{
+			"developers": {"uid=foo,ou=people,dc=example,dc=com"},
+			"ops":        {"uid=foo,ou=people,dc=example,dc=com", "uid=baz,ou=people,dc=example,dc=com"},
+		},
+	}
+
+	if ldaps {
+		srv.ln, err = tls.Listen("tcp", "127.0.0.1:0", srv.tlsConfig)
+	} else {
+		srv.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.serve()
+
+	return srv, &tls.Config{RootCAs: pool}
+}
+
+func (srv *fakeLDAP) url(scheme string) string {
+	return scheme + "://" + srv.ln.Addr().String()
+}
+
+func (srv *fakeLDAP) bindCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.binds
+}
+
+func (srv *fakeLDAP) serve() {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go srv.handle(conn)
+	}
+}
+
+func (srv *fakeLDAP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := berRead(r)
+		if err != nil {
+			return
+		}
+
+		parts, _ := msg.children()
+		id, _ := parts[0].int()
+		op := parts[1]
+		respond := func(ops ...[]byte) {
+			for _, op := range ops {
+				conn.Write(berEncode(berTagSequence, berInt(berTagInteger, id), op))
+			}
+		}
+
+		switch op.Tag {
+		case ldapBindRequest:
+			fields, _ := op.children()
+			dn, pass := string(fields[1].Content), string(fields[2].Content)
+
+			srv.mu.Lock()
+			srv.binds++
+			srv.mu.Unlock()
+
+			if expected, ok := srv.users[dn]; ok && expected == pass {
+				respond(fakeLDAPResult(ldapBindResponse, ldapSuccess))
+			} else {
+				respond(fakeLDAPResult(ldapBindResponse, ldapInvalidCredentials))
+			}
+		case ldapExtendedRequest:
+			respond(fakeLDAPResult(ldapExtendedResponse, ldapSuccess))
+			tlsConn := tls.Server(conn, srv.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+
+			conn, r = tlsConn, bufio.NewReader(tlsConn)
+		case ldapSearchRequest:
+			fields, _ := op.children()
+			member := fakeLDAPMember(fields[6])
+
+			for group, members := range srv.groups {
+				for _, m := range members {
+					if m == member {
+						respond(berEncode(ldapSearchResEntry,
+							berString(berTagOctetString, "cn="+group+",ou=groups,dc=example,dc=com"),
+							berEncode(berTagSequence, berEncode(berTagSequence,
+								berString(berTagOctetString, "cn"),
+								berEncode(berTagSet, berString(berTagOctetString, group)),
+							)),
+						))
+					}
+				}
+			}
+
+			respond(fakeLDAPResult(ldapSearchResDone, ldapSuccess))
+		default:
+			return
+		}
+	}
+}
+
+// fakeLDAPMember finds the value of the (member=...) equality match in filter.
+func fakeLDAPMember(filter berElement) string {
+	children, _ := filter.children()
+	if filter.Tag == 0xa3 && string(children[0].Content) == "member" {
+		return string(children[1].Content)
+	}
+
+	if filter.Tag == 0xa0 || filter.Tag == 0xa1 {
+		for _, child := range children {
+			if member := fakeLDAPMember(child); member != "" {
+				return member
+			}
+		}
+	}
+
+	return ""
+}
+
+func fakeLDAPResult(tag byte, code int) []byte {
+	return berEncode(tag, berInt(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, ""))
+}
+
+func ldapTestConfig(url string, clientTLS *tls.Config) *LDAPConfig {
+	return &LDAPConfig{
+		URL:         url,
+		TLSConfig:   clientTLS,
+		BindDN:      "uid=%s,ou=people,dc=example,dc=com",
+		GroupBaseDN: "ou=groups,dc=example,dc=com",
+		GroupFilter: "(&(objectClass=groupOfNames)(member=%s))",
+		GroupRoles:  RolesStore{"developers": {"dev"}, "ops": {"ops", "dev"}},
+		CacheTTL:    time.Minute,
+		Timeout:     time.Second,
+	}
+}
+
+func ldapReq(user, pass string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+
+	return req
+}
+
+// Test LoadLDAP
+func TestLoadLDAPValidatesConfig(t *testing.T) {
+	defer LoadLDAP(nil)
+
+	if err := LoadLDAP(&LDAPConfig{URL: "ldap://localhost", BindDN: "uid=%s"}); err == nil {
+		t.Error("Plain LDAP without StartTLS should be rejected")
+	}
+
+	if err := LoadLDAP(&LDAPConfig{URL: "ldaps://localhost", BindDN: "uid=foo"}); err == nil {
+		t.Error("Bind DN without placeholder should be rejected")
+	}
+
+	if err := LoadLDAP(&LDAPConfig{URL: "ldaps://localhost", BindDN: "uid=%s", GroupBaseDN: "dc=x", GroupFilter: "member=%s"}); err == nil {
+		t.Error("Invalid group filter should be rejected")
+	}
+
+	if err := LoadLDAP(&LDAPConfig{URL: "ldap://localhost", StartTLS: true, BindDN: "uid=%s"}); err != nil || !LDAPEnabled() {
+		t.Error("Valid config should be accepted, got", err)
+	}
+
+	if LoadLDAP(nil); LDAPEnabled() {
+		t.Error("LDAP should have been disabled")
+	}
+}
+
+// Test LDAPAuthPassed
+func TestLDAPAuthPassedOverLDAPS(t *testing.T) {
+	srv, clientTLS := newFakeLDAP(t, true)
+	defer srv.ln.Close()
+
+	LoadLDAP(ldapTestConfig(srv.url("ldaps"), clientTLS))
+	defer LoadLDAP(nil)
+
+	if status, _, _ := LDAPAuthPassed(ldapReq("", "")); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+
+	if status, user, _ := LDAPAuthPassed(ldapReq("foo", "bogus")); status != Failed || user != "foo" {
+		t.Error("Expected", Failed, "got", status)
+	}
+
+	if status, _, _ := LDAPAuthPassed(ldapReq("foo", "")); status != Failed {
+		t.Error("Empty passwords should fail, got", status)
+	}
+
+	status, user, roles := LDAPAuthPassed(ldapReq("foo", "bar"))
+	if status != Passed || user != "foo" {
+		t.Fatal("Expected", Passed, "got", status)
+	}
+
+	if len(roles) != 2 || !hasString(roles, "dev") || !hasString(roles, "ops") {
+		t.Error("Expected roles dev and ops, got", roles)
+	}
+
+	if _, _, roles = LDAPAuthPassed(ldapReq("baz", "boo")); len(roles) != 2 {
+		t.Error("Expected roles dev and ops, got", roles)
+	}
+}
+
+func TestLDAPAuthPassedWithStartTLS(t *testing.T) {
+	srv, clientTLS := newFakeLDAP(t, false)
+	defer srv.ln.Close()
+
+	cfg := ldapTestConfig(srv.url("ldap"), clientTLS)
+	cfg.StartTLS, cfg.GroupRoles = true, nil
+	LoadLDAP(cfg)
+	defer LoadLDAP(nil)
+
+	status, _, roles := LDAPAuthPassed(ldapReq("baz", "boo"))
+	if status != Passed {
+		t.Fatal("Expected", Passed, "got", status)
+	}
+
+	if len(roles) != 1 || roles[0] != "ops" {
+		t.Error("Without mapping, groups should be used as roles, got", roles)
+	}
+}
+
+func TestLDAPAuthPassedRejectsUntrustedServer(t *testing.T) {
+	srv, _ := newFakeLDAP(t, true)
+	defer srv.ln.Close()
+
+	LoadLDAP(ldapTestConfig(srv.url("ldaps"), nil))
+	defer LoadLDAP(nil)
+
+	if status, _, _ := LDAPAuthPassed(ldapReq("foo", "bar")); status != Failed {
+		t.Error("Servers with untrusted certificates should not be used, got", status)
+	}
+}
+
+func TestLDAPAuthPassedCaches(t *testing.T) {
+	srv, clientTLS := newFakeLDAP(t, true)
+	defer srv.ln.Close()
+
+	cfg := ldapTestConfig(srv.url("ldaps"), clientTLS)
+	LoadLDAP(cfg)
+	defer LoadLDAP(nil)
+
+	LDAPAuthPassed(ldapReq("foo", "bar"))
+	binds := srv.bindCount()
+
+	if status, _, roles := LDAPAuthPassed(ldapReq("foo", "bar")); status != Passed || len(roles) != 2 || srv.bindCount() != binds {
+		t.Error("Positive results should be served from cache")
+	}
+
+	if status, _, _ := LDAPAuthPassed(ldapReq("foo", "bogus")); status != Failed || srv.bindCount() != binds+1 {
+		t.Error("A different password should not be served from cache")
+	}
+
+	ldapMu.Lock()
+	entry := ldapCache["foo"]
+	entry.expires = time.Now().Add(-time.Second)
+	ldapCache["foo"] = entry
+	ldapMu.Unlock()
+
+	if status, _, _ := LDAPAuthPassed(ldapReq("foo", "bar")); status != Passed || srv.bindCount() != binds+2 {
+		t.Error("Expired results should not be served from cache")
+	}
+}
+
+// Test filters and escaping
+func TestLDAPFilter(t *testing.T) {
+	f, err := ldapFilter("(&(objectClass=*)(!(cn=a\\2ab)))")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := berEncode(0xa0,
+		berString(0x87, "objectClass"),
+		berEncode(0xa2, berEncode(0xa3, berString(berTagOctetString, "cn"), berString(berTagOctetString, "a*b"))),
+	)
+	if string(f) != string(expected) {
+		t.Errorf("Expected %x got %x", expected, f)
+	}
+
+	for _, bogus := range []string{"", "cn=a", "(cn=a", "(cn=a)x", "(&)", "(cn=a*)", "(cn>=a)", "(cn=\\zz)", "(!(a=b)(c=d))"} {
+		if _, err := ldapFilter(bogus); err == nil {
+			t.Error("Filter should have been rejected:", bogus)
+		}
+	}
+}
+
+func TestLDAPEscaping(t *testing.T) {
+	if actual := ldapEscapeFilter("a*(b)\\"); actual != "a\\2a\\28b\\29\\5c" {
+		t.Error("Unexpected filter escaping", actual)
+	}
+
+	if actual := ldapEscapeDN(" a,b=c+d "); actual != "\\ a\\,b\\=c\\+d\\ " {
+		t.Error("Unexpected DN escaping", actual)
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,169 @@
+package authentication
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientCertAuthenticator authenticates requests made over TLS with a client certificate
+// which was verified by the server (see tls.Config.ClientCAs). The user is the common
+// name of the certificate and their groups its organizational units, plus the roles
+// loaded via LoadRoles().
+type ClientCertAuthenticator struct{}
+
+// TrustedHeaderAuthenticator authenticates requests on behalf of an authenticating proxy
+// in front of the guardian, which passes the user (and, optionally, their comma separated
+// groups) in headers. The headers are only trusted on requests coming from one of Proxies.
+type TrustedHeaderAuthenticator struct {
+	UserHeader   string
+	GroupsHeader string
+	Proxies      []*net.IPNet
+}
+
+// Authenticate implements Authenticator.
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return NotAttempted, Identity{}
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	id = Identity{
+		User:       cert.Subject.CommonName,
+		Attributes: map[string]string{"dn": cert.Subject.String()},
+		Provider:   "cert",
+	}
+	if id.User == "" {
+		return Failed, id
+	}
+
+	id.Groups = append(append([]string(nil), cert.Subject.OrganizationalUnit...), Roles(id.User)...)
+
+	return Passed, id
+}
+
+// Authenticate implements Authenticator.
+func (t *TrustedHeaderAuthenticator) Authenticate(r *http.Request) (status int, id Identity) {
+	user := r.Header.Get(t.UserHeader)
+	if user == "" || !IPInNets(RemoteIP(r), t.Proxies) {
+		return NotAttempted, Identity{}
+	}
+
+	id = Identity{User: user, Provider: "header"}
+	if t.GroupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(t.GroupsHeader), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				id.Groups = append(id.Groups, group)
+			}
+		}
+	}
+
+	return Passed, id
+}
+
+// RemoteIP returns the IP address r came from (from its RemoteAddr).
+func RemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// ClientIP returns the IP address of the client r originates from: its RemoteIP, unless that
+// is one of the (trusted) proxies, in which case the address the proxies forwarded the
+// request for, in their header (X-Forwarded-For or Forwarded), is used. Only that header
+// is looked at, as the proxies pass the other one on as the client sent it. The forwarded
+// addresses are walked from the nearest one, skipping the proxies, so that clients can not
+// spoof them.
+func ClientIP(r *http.Request, proxies []*net.IPNet, header string) net.IP {
+	ip := RemoteIP(r)
+	if !IPInNets(ip, proxies) {
+		return ip
+	}
+
+	forwarded := forwardedFor(r, header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next := net.ParseIP(forwarded[i])
+		if next == nil {
+			return ip
+		} else if ip = next; !IPInNets(ip, proxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the addresses r was forwarded for, from its header (Forwarded or
+// X-Forwarded-For), in order.
+func forwardedFor(r *http.Request, header string) (addrs []string) {
+	for _, value := range r.Header.Values(header) {
+		for _, elem := range strings.Split(value, ",") {
+			if !strings.EqualFold(header, "Forwarded") {
+				addrs = append(addrs, forwardedAddr(strings.TrimSpace(elem)))
+				continue
+			}
+
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addrs = append(addrs, forwardedAddr(strings.Trim(kv[1], `"`)))
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// forwardedAddr strips the port (and the IPv6 brackets) from addr.
+func forwardedAddr(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// IPInNets determines if ip belongs to any of nets.
+func IPInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs (single IPs are also accepted).
+func ParseCIDRs(list string) (nets []*net.IPNet, err error) {
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return
+}
@@ -0,0 +1,99 @@
+package authentication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+)
+
+func TestClientCertAuthenticator(t *testing.T) {
+	req := ldapReq("", "")
+	if status, _ := (ClientCertAuthenticator{}).Authenticate(req); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "foo", OrganizationalUnit: []string{"ops"}}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	status, id := ClientCertAuthenticator{}.Authenticate(req)
+	if status != Passed || id.User != "foo" || !id.HasGroup("ops") || id.Attributes["dn"] != "CN=foo,OU=ops" {
+		t.Error("Unexpected result", status, id)
+	}
+
+	// Unverified certificates are not even looked at.
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if status, _ := (ClientCertAuthenticator{}).Authenticate(req); status != NotAttempted {
+		t.Error("Expected", NotAttempted, "got", status)
+	}
+}
+
+func TestTrustedHeaderAuthenticator(t *testing.T) {
+	proxies, err := ParseCIDRs("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &TrustedHeaderAuthenticator{UserHeader: "X-Remote-User", GroupsHeader: "X-Remote-Groups", Proxies: proxies}
+	req := ldapReq("", "")
+	req.Header.Set("X-Remote-User", "foo")
+	req.Header.Set("X-Remote-Groups", "dev, ops")
+
+	for addr, expected := range map[string]int{"10.1.2.3:1234": Passed, "[::1]:1234": Passed, "192.168.1.1:1234": NotAttempted, "bogus": NotAttempted} {
+		req.RemoteAddr = addr
+		if status, id := a.Authenticate(req); status != expected {
+			t.Errorf("Expected %d for %s got %d", expected, addr, status)
+		} else if status == Passed && (id.User != "foo" || !id.HasGroup("ops")) {
+			t.Error("Unexpected identity", id)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("192.168.0.0/16,10.1.1.1,fd00::/8")
+	if err != nil || len(nets) != 3 {
+		t.Fatal("Unexpected result", nets, err)
+	}
+
+	if !IPInNets(net.ParseIP("10.1.1.1"), nets) || IPInNets(net.ParseIP("10.1.1.2"), nets) || !IPInNets(net.ParseIP("fd00::1"), nets) {
+		t.Error("Unexpected matching")
+	}
+
+	if _, err = ParseCIDRs("bogus"); err == nil {
+		t.Error("Invalid CIDRs should be rejected")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, _ := ParseCIDRs("10.0.0.0/8, fd00::/8")
+
+	for _, c := range []struct {
+		remote, header, value, expected string
+	}{
+		{"192.168.1.1:1234", "X-Forwarded-For", "1.2.3.4", "192.168.1.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2", "1.2.3.4"},
+		{"[fd00::1]:1234", "Forwarded", `for=6.6.6.6, for="[2001:db8::1]:4711";proto=https`, "2001:db8::1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "bogus", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+	} {
+		req := ldapReq("", "")
+		req.RemoteAddr = c.remote
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+
+		if ip := ClientIP(req, proxies, c.header); ip.String() != c.expected {
+			t.Errorf("Expected %s for %s %s, got %s", c.expected, c.remote, c.value, ip)
+		}
+	}
+
+	// The header the proxies do not set is passed on as sent by the client, and ignored.
+	req := ldapReq("", "")
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", "for=10.0.0.3")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if ip := ClientIP(req, proxies, "X-Forwarded-For"); ip.String() != "1.2.3.4" {
+		t.Error("Expected 1.2.3.4, got", ip)
+	}
+}
@@ -0,0 +1,167 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays are the names of the days of the week, as used in schedules.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule restricts access in time: to a validity window (NotBefore, ExpiresAt) and/or to
+// some days of the week and hours of the day, in a given time zone.
+type Schedule struct {
+	NotBefore, ExpiresAt time.Time
+	// Days holds the days of the week (by time.Weekday) access is restricted to, if any.
+	Days []bool
+	// From and To hold the minutes of the day between which access is restricted to (To
+	// excluded), if they differ. From can be past To, for windows spanning midnight.
+	From, To int
+	Location *time.Location
+	raw      string
+}
+
+// ParseSchedule parses a schedule given as space separated key=value tokens, i.e.:
+//
+// 		not-before=2026-10-01 expires-at=2026-12-31T1800 days=mon-fri hours=0800-1800 tz=Europe/Bucharest
+//
+// All of them are optional. The dates (with optional times) and the hours are in the given
+// time zone, UTC by default. The days can be ranges and/or lists (i.e. mon,wed,fri-sun).
+func ParseSchedule(s string) (sch *Schedule, err error) {
+	sch = &Schedule{Location: time.UTC, raw: strings.TrimSpace(s)}
+	values := map[string]string{}
+	for _, token := range strings.Fields(s) {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("Invalid schedule token " + token)
+		}
+		values[kv[0]] = kv[1]
+	}
+
+	if tz, ok := values["tz"]; ok {
+		if sch.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, value := range values {
+		switch key {
+		case "tz":
+		case "not-before":
+			sch.NotBefore, err = parseScheduleTime(value, sch.Location)
+		case "expires-at":
+			sch.ExpiresAt, err = parseScheduleTime(value, sch.Location)
+		case "days":
+			sch.Days, err = parseScheduleDays(value)
+		case "hours":
+			sch.From, sch.To, err = parseScheduleHours(value)
+		default:
+			err = errors.New("Unknown schedule key " + key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// parseScheduleTime parses a date, with an optional time (i.e. 2026-10-01 or 2026-10-01T0800).
+func parseScheduleTime(value string, loc *time.Location) (time.Time, error) {
+	if strings.Contains(value, "T") {
+		return time.ParseInLocation("2006-01-02T1504", value, loc)
+	}
+
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// parseScheduleDays parses a list of days and day ranges (i.e. mon-fri or sat,sun).
+func parseScheduleDays(value string) (days []bool, err error) {
+	days = make([]bool, 7)
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, last := weekdayIndex(bounds[0]), weekdayIndex(bounds[len(bounds)-1])
+		if first < 0 || last < 0 {
+			return nil, errors.New("Invalid schedule days " + value)
+		}
+
+		for d := first; ; d = (d + 1) % 7 {
+			if days[d] = true; d == last {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// weekdayIndex returns the index of the day named name, -1 if unknown.
+func weekdayIndex(name string) int {
+	for i, day := range weekdays {
+		if strings.EqualFold(day, name) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parseScheduleHours parses an hours range (i.e. 0800-1800) into minutes of the day.
+func parseScheduleHours(value string) (from, to int, err error) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return 0, 0, errors.New("Invalid schedule hours " + value)
+	}
+
+	minutes := make([]int, 2)
+	for i, bound := range bounds {
+		n, e := strconv.Atoi(bound)
+		if e != nil || len(bound) != 4 || n/100 > 24 || n%100 > 59 || n > 2400 {
+			return 0, 0, errors.New("Invalid schedule hours " + value)
+		}
+		minutes[i] = n/100*60 + n%100
+	}
+
+	return minutes[0], minutes[1], nil
+}
+
+// Active determines if access is allowed by sch at t.
+func (sch *Schedule) Active(t time.Time) bool {
+	return sch.Explain(t) == ""
+}
+
+// Explain returns why access is not allowed by sch at t, or "" if it is.
+func (sch *Schedule) Explain(t time.Time) string {
+	t = t.In(sch.Location)
+	switch {
+	case !sch.NotBefore.IsZero() && t.Before(sch.NotBefore):
+		return fmt.Sprintf("not valid before %s", sch.NotBefore.Format(time.RFC3339))
+	case !sch.ExpiresAt.IsZero() && !t.Before(sch.ExpiresAt):
+		return fmt.Sprintf("expired at %s", sch.ExpiresAt.Format(time.RFC3339))
+	case sch.Days != nil && !sch.Days[t.Weekday()]:
+		return fmt.Sprintf("not valid on %s (%s)", weekdays[t.Weekday()], sch)
+	}
+
+	if sch.From != sch.To {
+		m := t.Hour()*60 + t.Minute()
+		inside := m >= sch.From && m < sch.To
+		if sch.From > sch.To {
+			inside = m >= sch.From || m < sch.To
+		}
+
+		if !inside {
+			return fmt.Sprintf("not valid at %s (%s)", t.Format("15:04"), sch)
+		}
+	}
+
+	return ""
+}
+
+// String returns sch as it was given.
+func (sch *Schedule) String() string {
+	return sch.raw
+}
@@ -0,0 +1,40 @@
+package authentication
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	sch, err := ParseSchedule("not-before=2026-10-01 expires-at=2026-12-31T1800 days=mon-fri hours=0800-1800 tz=UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for at, expected := range map[string]string{
+		"2026-10-05T09:00:00Z": "", // Monday
+		"2026-09-30T09:00:00Z": "not valid before 2026-10-01T00:00:00Z",
+		"2026-12-31T18:00:00Z": "expired at 2026-12-31T18:00:00Z",
+		"2026-10-04T09:00:00Z": "not valid on sun (" + sch.String() + ")",
+		"2026-10-05T18:00:00Z": "not valid at 18:00 (" + sch.String() + ")",
+	} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if actual := sch.Explain(tm); actual != expected {
+			t.Errorf("Expected %q at %s, got %q", expected, at, actual)
+		}
+	}
+
+	night, _ := ParseSchedule("days=fri-mon hours=2200-0600")
+	for at, expected := range map[string]bool{"2026-10-03T23:00:00Z": true, "2026-10-05T05:59:00Z": true, "2026-10-05T12:00:00Z": false, "2026-10-07T23:00:00Z": false} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if night.Active(tm) != expected {
+			t.Errorf("Expected %v at %s", expected, at)
+		}
+	}
+
+	for _, bogus := range []string{"days=someday", "hours=8-18", "hours=0800-2500", "expires-at=tomorrow", "color=red", "tz=Bogus/Zone", "days"} {
+		if _, err := ParseSchedule(bogus); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+}
@@ -7,21 +7,55 @@ LoadAuthorizations().
 Currently supported backends:
 
 	an AuthorizationStore variable directly
+	an AuthorizationsBackend implementation (i.e. the store package)
 	a Reader which can deliver data as specified in LoadAuthorizationsFromReader()
+	a file name, whose contents are as specified in LoadAuthorizationsFromReader()
 
 After the authorizations are loaded the main functionality is available via AuthorizationPassed()
 which can report if a given combination of {user, http method, http path} passes the
 authorization rules currently loaded.
+
+Rules are regular expressions matched against "METHOD /path". A rule can also start with
+a set of methods (i.e. "GET,HEAD /_cluster/health"), in which case the rest of it is only
+matched against the path, for those methods. Alternatively, rules can be anchored globs
+and path templates (i.e. "GET /{index}/_doc/{id}", see RuleSyntax), with regular
+expressions still available via a "~" prefix. The rules of the methods implied by others
+(see ImpliedMethods) apply to them as well.
+
+Rules can end with conditions on the query parameters, separated by spaces: "?name" (the
+parameter is required), "?!name" (it is forbidden) or "?name=a|b" (when present, it may
+only have one of the given values), i.e. "POST /logs/_doc ?!refresh". The rules which fail
+only on forbidden parameters (or values) can strip them instead: see StripQueryParams.
+
+Rules can also end with schedule tokens (see aa.ParseSchedule) prefixed by "@", i.e.
+"GET /logs @days=mon-fri @hours=0800-1800", in which case they only apply within it. Users
+and roles can likewise be given schedules (see LoadSchedules()), outside of which they have
+no access. Explain() reports the schedules weighing on a decision.
+
+Rules can also be defined for roles, under "@role" keys (i.e. "@readers"). They apply to
+the users which have no rules of their own, as the union of the rules of all their roles.
+
+A second, candidate set of authorizations can be loaded via LoadShadowAuthorizations().
+It is evaluated by ShadowAuthorizationPassed() in audit-only mode: its verdicts are
+compared with (and counted against) the enforced ones, but they never decide access.
 */
 package authorization
 
 import (
 	"errors"
+	"expvar"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -33,6 +67,13 @@ as follows:
 1. if DefaultRule == Allow; then Rules becomes a blacklisting mechanism;
 2. if DefaultRule == Deny; then rules becomes a whitelisting mechanism.
 
+Rules can also explicitly allow or deny, when prefixed by "allow " or "deny ", in which
+case they are evaluated in order (see RuleStrategy) and the DefaultRule only applies when
+none of them matches, i.e.:
+
+	deny GET /logs-secret
+	allow GET /logs-
+
 These combined allow for flexible and granular access control.
 */
 type AuthorizationRules struct {
@@ -43,30 +84,109 @@ type AuthorizationRules struct {
 // AuthorizationStore defines a container for all authorization rules.
 type AuthorizationStore map[string]AuthorizationRules
 
+// AuthorizationsBackend is implemented by pluggable authorizations storage backends
+// (see the store package), which can then be passed to LoadAuthorizations().
+type AuthorizationsBackend interface {
+	ReadAuthorizations() (AuthorizationStore, error)
+}
+
 // Small shortcut constants, for clarity.
 const (
 	Allow = true
 	Deny  = false
 )
 
+// Rule evaluation strategies (see RuleStrategy).
+const (
+	FirstMatch    = "first-match"
+	DenyOverrides = "deny-overrides"
+)
+
+// RuleStrategy selects how the rules are evaluated: FirstMatch (the first rule matching
+// decides) or DenyOverrides (any matching rule denying decides, otherwise any allowing).
+var RuleStrategy = FirstMatch
+
+// Rule syntaxes (see RuleSyntax).
+const (
+	RegexpSyntax = "regexp"
+	GlobSyntax   = "glob"
+)
+
+// RuleSyntax selects the syntax of the rules: RegexpSyntax (unanchored regular expressions
+// matched against "METHOD /path") or GlobSyntax (see globPattern). With either, the rules
+// prefixed by "~" are regular expressions.
+var RuleSyntax = RegexpSyntax
+
+// ImpliedMethods maps methods to the ones they follow: the rules for the latter apply to
+// the former as well (i.e. HEAD requests are allowed or denied like GET ones).
+var ImpliedMethods = map[string]string{"HEAD": "GET"}
+
+// methodSetRE matches the rules starting with a set of methods.
+var methodSetRE = regexp.MustCompile(`^([A-Z]+(?:,[A-Z]+)+) (.*)$`)
+
 // this will hold the authorization rules once they are loaded, and they MUST be
 // loaded before any authorization checks are performed.
 var authorizations AuthorizationStore
 
+// shadowAuthorizations holds the candidate (audit-only) rules, if any were loaded.
+var shadowAuthorizations AuthorizationStore
+
+// mu guards authorizations and shadowAuthorizations, which may be swapped at runtime.
+var mu sync.RWMutex
+
+// shadowChecks and shadowMismatches count the shadow evaluations and how many of
+// them disagreed with the enforced verdict. They are also published via expvar.
+var shadowChecks, shadowMismatches uint64
+
+func init() {
+	stats := expvar.NewMap("authorization")
+	stats.Set("shadow_checks", expvar.Func(func() interface{} { return ShadowChecks() }))
+	stats.Set("shadow_mismatches", expvar.Func(func() interface{} { return ShadowMismatches() }))
+}
+
 // LoadAuthorizations loads the given authorizations into the library.
 func LoadAuthorizations(backend interface{}) (err error) {
+	as, err := authorizationsFrom(backend)
+	if err == nil {
+		mu.Lock()
+		authorizations = as
+		mu.Unlock()
+	}
+
+	return
+}
+
+// LoadShadowAuthorizations loads the given authorizations as the shadow (audit-only) policy.
+// It accepts the same backends as LoadAuthorizations(). Loading a nil AuthorizationStore
+// turns shadow evaluation off.
+func LoadShadowAuthorizations(backend interface{}) (err error) {
+	as, err := authorizationsFrom(backend)
+	if err == nil {
+		mu.Lock()
+		shadowAuthorizations = as
+		mu.Unlock()
+	}
+
+	return
+}
+
+// authorizationsFrom reads an AuthorizationStore from any of the supported backends.
+func authorizationsFrom(backend interface{}) (as AuthorizationStore, err error) {
 	switch v := backend.(type) {
 	case AuthorizationStore:
-		authorizations = v
+		as = v
+	case AuthorizationsBackend:
+		as, err = v.ReadAuthorizations()
 	case io.Reader:
-		err = LoadAuthorizationsFromReader(v)
+		as, err = ReadAuthorizations(v)
 	case string: // assume filename
 		f, e := os.Open(v)
 		if e != nil {
-			return e
+			return nil, e
 		}
+		defer f.Close()
 
-		LoadAuthorizations(f)
+		as, err = ReadAuthorizations(f)
 	default:
 		err = errors.New("don't know how to handle backend")
 	}
@@ -79,44 +199,120 @@ func LoadAuthorizations(backend interface{}) (err error) {
 //
 // 		username:default_rule:rule1:...:ruleN
 func LoadAuthorizationsFromReader(r io.Reader) (err error) {
-	rawData, err := ioutil.ReadAll(r)
+	as, err := ReadAuthorizations(r)
 	if err == nil {
-		lines, as := strings.Split(strings.Trim(string(rawData), "\n"), "\n"), AuthorizationStore{}
-		for _, line := range lines {
-			tokens := strings.Split(strings.Trim(line, " "), ":")
-			if len(tokens) < 2 {
-				return errors.New("Invalid authorization line: " + line)
-			}
+		return LoadAuthorizations(as)
+	}
 
-			user, rule := tokens[0], false
-			if tokens[1] == "allow" {
-				rule = Allow
-			} else if tokens[1] == "deny" {
-				rule = Deny
-			} else {
-				return errors.New("Unknown default rule " + tokens[1])
-			}
+	return
+}
 
-			as[user] = AuthorizationRules{rule, tokens[2:]}
+// ReadAuthorizations reads the authorizations from the given r io.Reader, without loading
+// them. See LoadAuthorizationsFromReader() for the format.
+func ReadAuthorizations(r io.Reader) (as AuthorizationStore, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	lines, as := strings.Split(strings.Trim(string(rawData), "\n"), "\n"), AuthorizationStore{}
+	for _, line := range lines {
+		tokens := strings.Split(strings.Trim(line, " "), ":")
+		if len(tokens) < 2 {
+			return nil, errors.New("Invalid authorization line: " + line)
 		}
 
-		return LoadAuthorizations(as)
+		user, rule := tokens[0], false
+		if tokens[1] == "allow" {
+			rule = Allow
+		} else if tokens[1] == "deny" {
+			rule = Deny
+		} else {
+			return nil, errors.New("Unknown default rule " + tokens[1])
+		}
+
+		as[user] = AuthorizationRules{rule, tokens[2:]}
 	}
 
 	return
 }
 
+// Authorizations returns a copy of the currently loaded (enforced) authorizations.
+func Authorizations() AuthorizationStore {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	as := AuthorizationStore{}
+	for user, ar := range authorizations {
+		as[user] = AuthorizationRules{ar.DefaultRule, append([]string(nil), ar.Rules...)}
+	}
+
+	return as
+}
+
+// WriteAuthorizations writes as to w, in the format expected by LoadAuthorizationsFromReader().
+func WriteAuthorizations(w io.Writer, as AuthorizationStore) (err error) {
+	users := make([]string, 0, len(as))
+	for user := range as {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+		if err = ValidateRules(as[user]); err != nil {
+			return
+		}
+
+		tokens := append([]string{user, "deny"}, as[user].Rules...)
+		if as[user].DefaultRule {
+			tokens[1] = "allow"
+		}
+
+		if _, err = fmt.Fprintln(w, strings.Join(tokens, ":")); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// ValidateRules checks that all of ar's rules are valid regular expressions which can
+// also be represented in an authorizations file.
+func ValidateRules(ar AuthorizationRules) error {
+	for _, rule := range ar.Rules {
+		if strings.ContainsAny(rule, ":\n") {
+			return errors.New("Rule cannot contain ':' or newlines: " + rule)
+		}
+
+		r := parseRule(rule)
+		if r.scheduleErr != nil {
+			return r.scheduleErr
+		}
+
+		if _, err := regexp.Compile(r.pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // isEmpty determines if the given AuthorizationRules structure is empty.
 func (ar AuthorizationRules) isEmpty() bool {
 	return !ar.DefaultRule && len(ar.Rules) == 0
 }
 
-// hasRule determine if the given ar has a rule referring to verb + path.
-// TODO: bubble up the error all the way to exported func!
+// hasRule determine if the given ar has a rule referring to verb + path (none does, when
+// the query string of path can not be parsed).
 func (ar AuthorizationRules) hasRule(verb, path string) bool {
-	cannonicalPath := verb + " " + path
-	for _, rule := range ar.Rules {
-		if matched, _ := regexp.MatchString(rule, cannonicalPath); matched {
+	path, rawQuery := splitQuery(path)
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range ar.Rules {
+		if matched, _ := parseRule(s).matchesImplied(verb, path, query, false); matched {
 			return true
 		}
 	}
@@ -124,6 +320,245 @@ func (ar AuthorizationRules) hasRule(verb, path string) bool {
 	return false
 }
 
+// decide determines if ar allows verb + path (which may carry a query string), according to
+// RuleStrategy. The rules prefixed with "allow " or "deny " decide so; the others are
+// exceptions to the DefaultRule. When strip is set, the allowing rules failing only on
+// forbidden parameters (or on disallowed values) match as well and those parameters are
+// returned, for stripping. The requests whose query string can not be parsed are denied.
+func (ar AuthorizationRules) decide(verb, path string, strip bool) (allowed bool, stripped []string) {
+	path, rawQuery := splitQuery(path)
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false, nil
+	}
+
+	allowed, found := ar.DefaultRule, false
+	for _, s := range ar.Rules {
+		r := parseRule(s)
+		verdict := !ar.DefaultRule
+		if r.explicit {
+			verdict = r.allow
+		}
+
+		if !r.activeAt(now(), verdict) {
+			continue
+		}
+
+		matched, st := r.matchesImplied(verb, path, query, strip && verdict)
+		switch {
+		case !matched:
+		case RuleStrategy != DenyOverrides || !verdict:
+			return verdict, st
+		case !found:
+			allowed, stripped, found = true, st, true
+		}
+	}
+
+	return
+}
+
+// splitQuery splits path into the path proper and its query string.
+func splitQuery(path string) (string, string) {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+
+	return path, ""
+}
+
+// rule is a parsed authorization rule.
+type rule struct {
+	// explicit is set for the rules prefixed by "allow " or "deny " (in which case allow
+	// holds which).
+	explicit, allow bool
+	// methods holds the set of methods the rule applies to, if it starts with one (in
+	// which case pattern is only matched against the path).
+	methods []string
+	pattern string
+	query   []queryCondition
+	// schedule restricts when the rule applies, if set (see aa.ParseSchedule), unless it
+	// could not be parsed (see scheduleErr).
+	schedule    *aa.Schedule
+	scheduleErr error
+}
+
+// queryCondition is a condition on a query parameter: required (?name), forbidden
+// (?!name) or restricted to some values, when present (?name=a|b).
+type queryCondition struct {
+	name      string
+	forbidden bool
+	values    []string
+}
+
+// queryConditionRE matches the query condition ending a rule.
+var queryConditionRE = regexp.MustCompile(`\s+\?(!?)([\w.\-]+)(?:=(\S*))?$`)
+
+// scheduleTokenRE matches the schedule token (see aa.ParseSchedule) ending a rule, i.e.
+// "@days=mon-fri".
+var scheduleTokenRE = regexp.MustCompile(`\s+@([\w\-]+=\S+)$`)
+
+// parseRule parses the rule s.
+func parseRule(s string) (r rule) {
+	if strings.HasPrefix(s, "allow ") {
+		r.explicit, r.allow, s = true, true, strings.TrimPrefix(s, "allow ")
+	} else if strings.HasPrefix(s, "deny ") {
+		r.explicit, s = true, strings.TrimPrefix(s, "deny ")
+	}
+
+	var schedule []string
+	for {
+		if m := queryConditionRE.FindStringSubmatchIndex(s); m != nil {
+			cond := queryCondition{name: s[m[4]:m[5]], forbidden: m[3] > m[2]}
+			if m[6] >= 0 {
+				cond.values = strings.Split(s[m[6]:m[7]], "|")
+			}
+
+			r.query, s = append([]queryCondition{cond}, r.query...), s[:m[0]]
+		} else if m := scheduleTokenRE.FindStringSubmatchIndex(s); m != nil {
+			schedule, s = append(schedule, s[m[2]:m[3]]), s[:m[0]]
+		} else {
+			break
+		}
+	}
+
+	if schedule != nil {
+		r.schedule, r.scheduleErr = aa.ParseSchedule(strings.Join(schedule, " "))
+	}
+
+	if strings.HasPrefix(s, "~") {
+		s = strings.TrimPrefix(s, "~")
+	} else if RuleSyntax == GlobSyntax {
+		r.pattern = globPattern(s)
+		return
+	}
+
+	if m := methodSetRE.FindStringSubmatch(s); m != nil {
+		r.methods, s = strings.Split(m[1], ","), m[2]
+	}
+	r.pattern = s
+
+	return
+}
+
+// globPattern converts the glob rule s, i.e. "GET,HEAD /logs-*/_doc/{id}", to an anchored
+// regular expression matching "METHOD /path". The methods are a single one, a set or "*"
+// (any). In the path, "*" matches any part of a segment, "?" any single character of it,
+// "{name}" a whole (concrete) segment and "**" anything, including several segments. Only
+// "**" matches the commas separating the indices of multi-index paths, and the segments
+// starting with "_", "-" or "<" (APIs and index expressions such as _all, exclusions and
+// date math) are only matched by "**" or literally.
+func globPattern(s string) string {
+	methods, path := "*", s
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		methods, path = s[:i], s[i+1:]
+	}
+
+	pattern := "^[A-Z]+ "
+	if methods != "*" {
+		pattern = "^(?:" + regexp.QuoteMeta(strings.Replace(methods, ",", "|", -1)) + ") "
+		pattern = strings.Replace(pattern, `\|`, "|", -1)
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case strings.HasPrefix(path[i:], "**"):
+			pattern, i = pattern+".*", i+1
+		case c == '*' && segmentStart(path, i):
+			pattern += "(?:[^/,_<-][^/,]*)?"
+		case c == '*':
+			pattern += "[^/,]*"
+		case c == '?' && segmentStart(path, i):
+			pattern += "[^/,_<-]"
+		case c == '?':
+			pattern += "[^/,]"
+		case c == '{' && strings.IndexByte(path[i:], '}') > 0:
+			pattern, i = pattern+"[^/,*_<-][^/,*]*", i+strings.IndexByte(path[i:], '}')
+		default:
+			pattern += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return pattern + "$"
+}
+
+// segmentStart determines if the i-th character of path starts a segment.
+func segmentStart(path string, i int) bool {
+	return i == 0 || path[i-1] == '/'
+}
+
+// activeAt determines if r applies at t, according to its schedule. The rules with invalid
+// schedules only apply if they deny (verdict).
+func (r rule) activeAt(t time.Time, verdict bool) bool {
+	if r.scheduleErr != nil {
+		return !verdict
+	}
+
+	return r.schedule == nil || r.schedule.Active(t)
+}
+
+// matchesImplied is like matches, for verb as well as for the method it implies.
+func (r rule) matchesImplied(verb, path string, query url.Values, strip bool) (matched bool, stripped []string) {
+	for _, method := range []string{verb, ImpliedMethods[verb]} {
+		if method == "" {
+			continue
+		}
+
+		if matched, stripped = r.matches(method, path, query, strip); matched {
+			return
+		}
+	}
+
+	return false, nil
+}
+
+// matches determines if r matches verb + path and query (see decide for strip).
+func (r rule) matches(verb, path string, query url.Values, strip bool) (matched bool, stripped []string) {
+	if r.methods == nil {
+		matched, _ = regexp.MatchString(r.pattern, verb+" "+path)
+	} else {
+		for _, method := range r.methods {
+			if method == verb {
+				matched, _ = regexp.MatchString(r.pattern, path)
+			}
+		}
+	}
+
+	if !matched {
+		return
+	}
+
+	for _, cond := range r.query {
+		values, present := query[cond.name]
+		switch {
+		case cond.values == nil && !cond.forbidden && !present:
+			return false, nil
+		case cond.forbidden && present, cond.values != nil && present && !allowedValues(values, cond.values):
+			if !strip {
+				return false, nil
+			}
+			stripped = append(stripped, cond.name)
+		}
+	}
+
+	return
+}
+
+// allowedValues determines if all of values are among allowed.
+func allowedValues(values, allowed []string) bool {
+	for _, value := range values {
+		found := false
+		for _, a := range allowed {
+			found = found || value == a
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 // hasNoRule see hasRule and negate that.
 func (ar AuthorizationRules) hasNoRule(verb, path string) bool {
 	return !ar.hasRule(verb, path)
@@ -131,23 +566,108 @@ func (ar AuthorizationRules) hasNoRule(verb, path string) bool {
 
 // Allows determines if a give verb + path combination is allowed by ar.
 func (ar AuthorizationRules) allows(verb, path string) bool {
-	if ar.DefaultRule {
-		return ar.hasNoRule(verb, path)
+	allowed, _ := ar.decide(verb, path, false)
+	return allowed
+}
+
+// rulesFor returns the rules applying to user: their own, if they have any, or
+// otherwise those of their roles (stored under "@role" keys) whose schedules allow
+// access now.
+func (as AuthorizationStore) rulesFor(user string, roles []string) (rules []AuthorizationRules) {
+	if ar := as[user]; !ar.isEmpty() {
+		return []AuthorizationRules{ar}
+	}
+
+	for _, role := range roles {
+		if ar := as["@"+role]; !ar.isEmpty() && scheduleExplain("@"+role) == "" {
+			rules = append(rules, ar)
+		}
 	}
 
-	return ar.hasRule(verb, path)
+	return
 }
 
-// AuthorizationPassed determines if a give user is authorized to access path via verb.
-func AuthorizationPassed(user, verb, path string) bool {
-	if user == "" {
+// passes determines if user (having roles) is authorized to access path via verb according to as.
+func (as AuthorizationStore) passes(user string, roles []string, verb, path string) bool {
+	if user == "" || scheduleExplain(user) != "" {
 		return false
 	}
 
-	ar := authorizations[user]
-	if ar.isEmpty() {
-		return false
+	for _, ar := range as.rulesFor(user, roles) {
+		if ar.allows(verb, path) {
+			return true
+		}
 	}
 
-	return ar.allows(verb, path)
+	return false
+}
+
+// AuthorizationPassed determines if a give user is authorized to access path via verb.
+// The path may carry a query string (i.e. "/logs/_search?size=10"), for the rules with
+// query conditions.
+//
+// The user's own rules are used, if they have any. Otherwise, access is granted if it is
+// allowed by the rules of any of the given roles.
+func AuthorizationPassed(user, verb, path string, roles ...string) bool {
+	mu.RLock()
+	as := authorizations
+	mu.RUnlock()
+
+	return as.passes(user, roles, verb, path)
+}
+
+// AuthorizationPassedStripping is like AuthorizationPassed, except that when access is not
+// granted as such, but would be by allowing rules without the query parameters they
+// forbid (or whose values they disallow), it is granted and those parameters are returned,
+// to be stripped from the request.
+func AuthorizationPassedStripping(user, verb, path string, roles ...string) (passed bool, stripped []string) {
+	mu.RLock()
+	as := authorizations
+	mu.RUnlock()
+
+	if as.passes(user, roles, verb, path) {
+		return true, nil
+	} else if user == "" || scheduleExplain(user) != "" {
+		return false, nil
+	}
+
+	for _, ar := range as.rulesFor(user, roles) {
+		if passed, stripped = ar.decide(verb, path, true); passed {
+			return
+		}
+	}
+
+	return false, nil
+}
+
+// ShadowAuthorizationPassed evaluates the shadow policy for the same {user, verb, path}
+// (and roles) that was just decided by the enforced one (with the enforced verdict). It
+// reports the shadow verdict and whether it diverged from the enforced verdict. When no
+// shadow policy is loaded, it simply echoes enforced and never diverges.
+func ShadowAuthorizationPassed(user, verb, path string, enforced bool, roles ...string) (passed, diverged bool) {
+	mu.RLock()
+	as := shadowAuthorizations
+	mu.RUnlock()
+
+	if as == nil {
+		return enforced, false
+	}
+
+	atomic.AddUint64(&shadowChecks, 1)
+	if passed = as.passes(user, roles, verb, path); passed != enforced {
+		atomic.AddUint64(&shadowMismatches, 1)
+		diverged = true
+	}
+
+	return
+}
+
+// ShadowChecks returns how many requests were evaluated against the shadow policy.
+func ShadowChecks() uint64 {
+	return atomic.LoadUint64(&shadowChecks)
+}
+
+// ShadowMismatches returns how many shadow verdicts differed from the enforced ones.
+func ShadowMismatches() uint64 {
+	return atomic.LoadUint64(&shadowMismatches)
 }
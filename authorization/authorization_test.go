@@ -252,3 +252,296 @@ func TestAuthorizationPassed(t *testing.T) {
 		t.Error("Authorization should pass with correct user")
 	}
 }
+
+// Test shadow authorizations
+func TestLoadShadowAuthorizations(t *testing.T) {
+	shadowAuthorizations = nil
+	if err := LoadShadowAuthorizations("authorization_test.txt"); err != nil {
+		t.Error("Loading shadow authorizations failed", err)
+	}
+
+	if shadowAuthorizations["foo"].isEmpty() {
+		t.Error("shadow authorizations should have been loaded")
+	}
+
+	if err := LoadShadowAuthorizations("authorization_test.xxx"); err == nil {
+		t.Error("Loading shadow authorizations from invalid filename should error out")
+	}
+
+	LoadShadowAuthorizations(AuthorizationStore(nil))
+	if shadowAuthorizations != nil {
+		t.Error("Loading a nil store should turn shadow evaluation off")
+	}
+}
+
+func TestShadowAuthorizationPassedWithoutShadow(t *testing.T) {
+	loadAuthorizations()
+	LoadShadowAuthorizations(AuthorizationStore(nil))
+	checks := ShadowChecks()
+
+	if passed, diverged := ShadowAuthorizationPassed("foo", "GET", "/_cluster/health", false); passed || diverged {
+		t.Error("Without a shadow policy the enforced verdict should be echoed")
+	}
+
+	if ShadowChecks() != checks {
+		t.Error("Without a shadow policy nothing should be counted")
+	}
+}
+
+func TestShadowAuthorizationPassed(t *testing.T) {
+	loadAuthorizations()
+	LoadShadowAuthorizations(AuthorizationStore{
+		"foo": AuthorizationRules{Deny, []string{"GET /_cluster/stats"}},
+	})
+	defer LoadShadowAuthorizations(AuthorizationStore(nil))
+	checks, mismatches := ShadowChecks(), ShadowMismatches()
+
+	enforced := AuthorizationPassed("foo", "GET", "/_cluster/stats")
+	if passed, diverged := ShadowAuthorizationPassed("foo", "GET", "/_cluster/stats", enforced); !passed || diverged {
+		t.Error("Shadow policy should agree on GET /_cluster/stats")
+	}
+
+	enforced = AuthorizationPassed("foo", "GET", "/_nodes")
+	if passed, diverged := ShadowAuthorizationPassed("foo", "GET", "/_nodes", enforced); passed || !diverged {
+		t.Error("Shadow policy should disagree on GET /_nodes")
+	}
+
+	if ShadowChecks()-checks != 2 {
+		t.Error("Expected 2 shadow checks, got", ShadowChecks()-checks)
+	}
+
+	if ShadowMismatches()-mismatches != 1 {
+		t.Error("Expected 1 shadow mismatch, got", ShadowMismatches()-mismatches)
+	}
+}
+
+// Test authorizations accessors
+func TestAuthorizationsReturnsACopy(t *testing.T) {
+	loadAuthorizations()
+	as := Authorizations()
+	as["foo"].Rules[0] = "changed"
+
+	if authorizations["foo"].Rules[0] == "changed" {
+		t.Error("Authorizations() should return a copy")
+	}
+}
+
+func TestWriteAuthorizations(t *testing.T) {
+	var buf strings.Builder
+	err := WriteAuthorizations(&buf, AuthorizationStore{
+		"foo": AuthorizationRules{Allow, []string{"GET /_cluster/health"}},
+		"baz": AuthorizationRules{Deny, []string{"GET /_cluster/health", "GET /_nodes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "baz:deny:GET /_cluster/health:GET /_nodes\nfoo:allow:GET /_cluster/health\n"; buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+
+	err = WriteAuthorizations(&buf, AuthorizationStore{"foo": AuthorizationRules{Allow, []string{"GET /a:b"}}})
+	if err == nil {
+		t.Error("Rules containing ':' should not be written")
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	if err := ValidateRules(AuthorizationRules{Deny, []string{"GET /foo(bar)?$"}}); err != nil {
+		t.Error("Valid rules should pass validation, got", err)
+	}
+
+	if err := ValidateRules(AuthorizationRules{Deny, []string{"GET /foo(bar"}}); err == nil {
+		t.Error("Invalid regular expressions should fail validation")
+	}
+}
+
+// Test role rules
+func TestAuthorizationPassedWithRoles(t *testing.T) {
+	LoadAuthorizations(AuthorizationStore{
+		"foo":      AuthorizationRules{Deny, []string{"GET /own"}},
+		"@readers": AuthorizationRules{Deny, []string{"GET /logs"}},
+		"@writers": AuthorizationRules{Deny, []string{"POST /logs"}},
+	})
+
+	if !AuthorizationPassed("qux", "GET", "/logs", "readers", "writers") || !AuthorizationPassed("qux", "POST", "/logs", "readers", "writers") {
+		t.Error("The rules of all roles should apply")
+	}
+
+	if AuthorizationPassed("qux", "DELETE", "/logs", "readers", "writers") {
+		t.Error("Access not granted by any role should be denied")
+	}
+
+	if AuthorizationPassed("qux", "GET", "/logs") || AuthorizationPassed("qux", "GET", "/logs", "bogus") {
+		t.Error("Users without roles (with rules) should be denied")
+	}
+
+	if AuthorizationPassed("foo", "GET", "/logs", "readers") || !AuthorizationPassed("foo", "GET", "/own", "readers") {
+		t.Error("Users' own rules should take precedence over their roles'")
+	}
+}
+
+// Test method sets and implied methods
+func TestAllowWithMethodSets(t *testing.T) {
+	ar := AuthorizationRules{Deny, []string{"GET,POST /_search$"}}
+
+	if !ar.allows("GET", "/_search") || !ar.allows("POST", "/_search") {
+		t.Error("allows() should allow GET and POST /_search")
+	}
+
+	if ar.allows("DELETE", "/_search") || ar.allows("GET", "/_searches") {
+		t.Error("allows() should NOT allow DELETE /_search nor GET /_searches")
+	}
+
+	if err := ValidateRules(ar); err != nil {
+		t.Error("Method sets should pass validation, got", err)
+	}
+}
+
+func TestAllowWithImpliedMethods(t *testing.T) {
+	whitelist, blacklist := AuthorizationRules{Deny, []string{"GET /logs"}}, AuthorizationRules{Allow, []string{"GET /secret"}}
+
+	if !whitelist.allows("HEAD", "/logs") || blacklist.allows("HEAD", "/secret") {
+		t.Error("HEAD should follow GET")
+	}
+
+	defer func(implied map[string]string) { ImpliedMethods = implied }(ImpliedMethods)
+	ImpliedMethods = map[string]string{}
+
+	if whitelist.allows("HEAD", "/logs") || !blacklist.allows("HEAD", "/secret") {
+		t.Error("HEAD should no longer follow GET")
+	}
+}
+
+// Test query conditions
+func TestAllowWithQueryConditions(t *testing.T) {
+	whitelist := AuthorizationRules{Deny, []string{"GET /_search ?!refresh ?size=10|20", "POST /logs/_doc ?pipeline"}}
+	for path, expected := range map[string]bool{
+		"/_search":                      true,
+		"/_search?size=20&pretty":       true,
+		"/_search?size=100":             false,
+		"/_search?refresh=true":         false,
+		"/logs/_doc?pipeline=geoip":     false, // GET
+		"/_search?size=10&size=100":     false,
+		"/_search?sort=x&_source=false": true,
+		"/_search?size=10;refresh=true": false, // unparsable
+	} {
+		if whitelist.allows("GET", path) != expected {
+			t.Errorf("allows() should be %v for GET %s", expected, path)
+		}
+	}
+
+	if !whitelist.allows("POST", "/logs/_doc?pipeline=geoip") || whitelist.allows("POST", "/logs/_doc") {
+		t.Error("allows() should require the pipeline parameter")
+	}
+
+	blacklist := AuthorizationRules{Allow, []string{"POST /logs ?refresh=true|wait_for ?refresh"}}
+	if blacklist.allows("POST", "/logs/_doc?refresh=true") || !blacklist.allows("POST", "/logs/_doc?refresh=false") || !blacklist.allows("POST", "/logs/_doc") {
+		t.Error("allows() should only deny refreshing POSTs")
+	}
+
+	if blacklist.allows("POST", "/logs/_doc?x=1;refresh=true") {
+		t.Error("allows() should deny the requests whose query can not be parsed")
+	}
+
+	if err := ValidateRules(whitelist); err != nil {
+		t.Error("Query conditions should pass validation, got", err)
+	}
+}
+
+func TestAuthorizationPassedStripping(t *testing.T) {
+	LoadAuthorizations(AuthorizationStore{"foo": AuthorizationRules{Deny, []string{"GET /_search ?!refresh ?size=10|20"}}})
+
+	if passed, stripped := AuthorizationPassedStripping("foo", "GET", "/_search?size=10"); !passed || stripped != nil {
+		t.Error("Nothing should be stripped, got", passed, stripped)
+	}
+
+	if passed, stripped := AuthorizationPassedStripping("foo", "GET", "/_search?refresh&size=100"); !passed || len(stripped) != 2 {
+		t.Error("refresh and size should be stripped, got", passed, stripped)
+	}
+
+	if passed, _ := AuthorizationPassedStripping("foo", "POST", "/_search?refresh"); passed {
+		t.Error("Stripping should not allow other methods")
+	}
+}
+
+// Test explicit allow and deny rules
+func TestAllowWithExplicitRules(t *testing.T) {
+	defer func() { RuleStrategy = FirstMatch }()
+	ar := AuthorizationRules{Deny, []string{"allow GET /logs-", "deny GET /logs-secret", "GET /_cluster/health"}}
+
+	for _, c := range []struct {
+		strategy, verb, path string
+		expected             bool
+	}{
+		{FirstMatch, "GET", "/logs-1/_search", true},
+		{FirstMatch, "GET", "/logs-secret/_search", true},
+		{DenyOverrides, "GET", "/logs-secret/_search", false},
+		{DenyOverrides, "GET", "/logs-1/_search", true},
+		{DenyOverrides, "GET", "/_cluster/health", true},
+		{DenyOverrides, "GET", "/other", false},
+	} {
+		if RuleStrategy = c.strategy; ar.allows(c.verb, c.path) != c.expected {
+			t.Errorf("allows() should be %v for %s %s (%s)", c.expected, c.verb, c.path, c.strategy)
+		}
+	}
+
+	RuleStrategy = FirstMatch
+	ar = AuthorizationRules{Allow, []string{"deny GET /logs-secret", "allow GET /logs-", "deny GET /"}}
+	if ar.allows("GET", "/logs-secret/_search") || !ar.allows("GET", "/logs-1/_search") || ar.allows("GET", "/other") || !ar.allows("POST", "/other") {
+		t.Error("The first matching rule should decide, the DefaultRule otherwise")
+	}
+}
+
+// Test glob rules
+func TestGlobPattern(t *testing.T) {
+	for rule, expected := range map[string]string{
+		"GET /logs-*/_search":         `^(?:GET) /logs-[^/,]*/_search$`,
+		"GET,HEAD /{index}/_doc/{id}": `^(?:GET|HEAD) /[^/,*_<-][^/,*]*/_doc/[^/,*_<-][^/,*]*$`,
+		"* /_cat/**":                  `^[A-Z]+ /_cat/.*$`,
+		"/a?c.d":                      `^[A-Z]+ /a[^/,]c\.d$`,
+		"/*/_search":                  `^[A-Z]+ /(?:[^/,_<-][^/,]*)?/_search$`,
+	} {
+		if actual := globPattern(rule); actual != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, rule, actual)
+		}
+	}
+}
+
+func TestAllowWithGlobRules(t *testing.T) {
+	RuleSyntax = GlobSyntax
+	defer func() { RuleSyntax = RegexpSyntax }()
+	ar := AuthorizationRules{Deny, []string{"GET /logs", "GET,HEAD /logs-*/_search ?!scroll", "GET /{index}/_doc/{id}", "~^GET /_cat/"}}
+
+	for _, c := range []struct {
+		verb, path string
+		expected   bool
+	}{
+		{"GET", "/logs", true},
+		{"GET", "/logs-secret/_search", true},
+		{"GET", "/logs/_search", false},
+		{"GET", "/logs-1,secret/_search", false},
+		{"HEAD", "/logs-1/_search", true},
+		{"GET", "/logs-1/_search?scroll=1m", false},
+		{"GET", "/logs/_doc/1", true},
+		{"GET", "/*/_doc/1", false},
+		{"GET", "/logs/_doc/1/extra", false},
+		{"GET", "/_cat/indices", true},
+		{"GET", "/_all/_doc/1", false},
+		{"GET", "/-logs/_doc/1", false},
+		{"GET", "/<logs-{now/d}>/_doc/1", false},
+		{"GET", "/logs/_doc/_mget", false},
+	} {
+		if ar.allows(c.verb, c.path) != c.expected {
+			t.Errorf("allows() should be %v for %s %s", c.expected, c.verb, c.path)
+		}
+	}
+
+	if star := (AuthorizationRules{Deny, []string{"GET /*/_search"}}); star.allows("GET", "/_all/_search") || !star.allows("GET", "/logs/_search") {
+		t.Error("* should not match the _all index expression")
+	}
+
+	if err := ValidateRules(ar); err != nil {
+		t.Error("Glob rules should pass validation, got", err)
+	}
+}
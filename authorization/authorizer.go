@@ -0,0 +1,233 @@
+package authorization
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request holds everything known about a request when deciding whether to authorize it.
+type Request struct {
+	User       string            `json:"user"`
+	Groups     []string          `json:"groups"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      url.Values        `json:"query,omitempty"`
+	Header     http.Header       `json:"headers,omitempty"`
+	ClientIP   string            `json:"client_ip"`
+	// Indices holds the Elasticsearch indices targeted by the request, when known.
+	Indices []string `json:"indices,omitempty"`
+}
+
+// Authorizer is implemented by the authorization decision points. Authorize reports whether
+// req is allowed; when it cannot decide, it returns an error together with its fallback verdict.
+type Authorizer interface {
+	Authorize(req *Request) (allowed bool, err error)
+}
+
+// StripQueryParams controls whether RulesAuthorizer strips (from Request.Query) the query
+// parameters forbidden by the rules, instead of denying the requests carrying them (see
+// AuthorizationPassedStripping()).
+var StripQueryParams bool
+
+// RulesAuthorizer decides using the loaded authorization rules (see AuthorizationPassed()).
+type RulesAuthorizer struct{}
+
+// AllAuthorizers is an Authorizer which only allows the requests allowed by all of them.
+type AllAuthorizers []Authorizer
+
+// CalloutAuthorizer delegates the decisions to an external policy decision service: it
+// POSTs the Request (as JSON) to URL and expects a JSON response like:
+//
+// 		{"allow": true}
+//
+// URL can also point to a Unix socket, as unix:///path/to/socket (the request is then
+// POSTed to / over that socket). Decisions are cached for CacheTTL (if set), per user,
+// roles, attributes, client IP, method, path, query and indices (see Request.cacheKey()).
+// When the service cannot be reached in Timeout or misbehaves, the request is allowed if
+// FailOpen and denied otherwise.
+type CalloutAuthorizer struct {
+	URL      string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	FailOpen bool
+
+	once   sync.Once
+	client *http.Client
+	target string
+	mu     sync.Mutex
+	cache  map[[sha256.Size]byte]calloutDecision
+}
+
+type calloutDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// calloutCacheSize bounds the number of cached decisions (the cache is flushed when full).
+const calloutCacheSize = 10000
+
+// sensitiveHeaders are never passed to external decision services.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// NewRequest builds the Request for r, made by id.
+func NewRequest(r *http.Request, id aa.Identity) *Request {
+	header := r.Header.Clone()
+	for _, h := range sensitiveHeaders {
+		header.Del(h)
+	}
+
+	clientIP := ""
+	if ip := aa.RemoteIP(r); ip != nil {
+		clientIP = ip.String()
+	}
+
+	return &Request{
+		User:       id.User,
+		Groups:     id.Groups,
+		Attributes: id.Attributes,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.Query(),
+		Header:     header,
+		ClientIP:   clientIP,
+	}
+}
+
+// Authorize implements Authorizer.
+func (RulesAuthorizer) Authorize(req *Request) (bool, error) {
+	path := req.Path
+	if len(req.Query) > 0 {
+		path += "?" + req.Query.Encode()
+	}
+
+	if !StripQueryParams {
+		return AuthorizationPassed(req.User, req.Method, path, req.Groups...), nil
+	}
+
+	passed, stripped := AuthorizationPassedStripping(req.User, req.Method, path, req.Groups...)
+	for _, name := range stripped {
+		req.Query.Del(name)
+	}
+
+	return passed, nil
+}
+
+// Authorize implements Authorizer.
+func (all AllAuthorizers) Authorize(req *Request) (allowed bool, err error) {
+	for _, a := range all {
+		if allowed, err = a.Authorize(req); !allowed {
+			return
+		}
+	}
+
+	return len(all) > 0, err
+}
+
+// Authorize implements Authorizer.
+func (c *CalloutAuthorizer) Authorize(req *Request) (allowed bool, err error) {
+	c.once.Do(c.init)
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return c.FailOpen, err
+	}
+
+	key := req.cacheKey()
+	if c.CacheTTL > 0 {
+		c.mu.Lock()
+		d, ok := c.cache[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(d.expires) {
+			return d.allowed, nil
+		}
+	}
+
+	if allowed, err = c.callout(body); err != nil {
+		return c.FailOpen, err
+	}
+
+	if c.CacheTTL > 0 {
+		c.mu.Lock()
+		if len(c.cache) >= calloutCacheSize {
+			c.cache = map[[sha256.Size]byte]calloutDecision{}
+		}
+		c.cache[key] = calloutDecision{allowed, time.Now().Add(c.CacheTTL)}
+		c.mu.Unlock()
+	}
+
+	return
+}
+
+// cacheKey returns the key the decision for req is cached under. It leaves out the headers
+// only, as they vary from one request to the next (i.e. with the tracing ones).
+func (req *Request) cacheKey() (key [sha256.Size]byte) {
+	attributes := url.Values{}
+	for name, value := range req.Attributes {
+		attributes.Set(name, value)
+	}
+
+	h := sha256.New()
+	for _, part := range []string{req.User, strings.Join(req.Groups, ","), attributes.Encode(), req.ClientIP, req.Method, req.Path, req.Query.Encode(), strings.Join(req.Indices, ",")} {
+		h.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+	copy(key[:], h.Sum(nil))
+
+	return
+}
+
+func (c *CalloutAuthorizer) init() {
+	c.cache = map[[sha256.Size]byte]calloutDecision{}
+	c.client, c.target = &http.Client{Timeout: c.Timeout}, c.URL
+	if strings.HasPrefix(c.URL, "unix://") {
+		socket := strings.TrimPrefix(c.URL, "unix://")
+		c.target = "http://unix/"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+}
+
+func (c *CalloutAuthorizer) callout(body []byte) (allowed bool, err error) {
+	resp, err := c.client.Post(c.target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy decision service responded with %s", resp.Status)
+	}
+
+	var decision struct {
+		Allow *bool `json:"allow"`
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(raw, &decision); err != nil {
+		return
+	} else if decision.Allow == nil {
+		return false, errors.New("policy decision service gave no decision")
+	}
+
+	return *decision.Allow, nil
+}
@@ -0,0 +1,148 @@
+package authorization
+
+import (
+	"encoding/json"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// policyServer is a fake policy decision service, allowing the users named "foo".
+func policyServer(calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Header.Get("Authorization") != "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"allow": req.User == "foo"})
+	})
+}
+
+func TestNewRequest(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/logs/_search?size=10", nil)
+	r.RemoteAddr = "[::1]:1234"
+	r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("X-Opaque-Id", "42")
+
+	req := NewRequest(r, aa.Identity{User: "foo", Groups: []string{"ops"}})
+	if req.User != "foo" || req.Groups[0] != "ops" || req.Path != "/logs/_search" || req.Query.Get("size") != "10" || req.ClientIP != "::1" {
+		t.Error("Unexpected request", req)
+	}
+
+	if req.Header.Get("Authorization") != "" || req.Header.Get("X-Opaque-Id") != "42" || r.Header.Get("Authorization") == "" {
+		t.Error("Only the sensitive headers should have been dropped from the request", req.Header)
+	}
+}
+
+func TestRulesAuthorizer(t *testing.T) {
+	LoadAuthorizations(AuthorizationStore{"foo": {Deny, []string{"GET /_cluster/health"}}})
+
+	if allowed, err := (RulesAuthorizer{}).Authorize(&Request{User: "foo", Method: "GET", Path: "/_cluster/health"}); !allowed || err != nil {
+		t.Error("Request should have been allowed")
+	}
+
+	all := AllAuthorizers{RulesAuthorizer{}, &CalloutAuthorizer{URL: "http://127.0.0.1:1", Timeout: time.Second}}
+	if allowed, err := all.Authorize(&Request{User: "foo", Method: "GET", Path: "/_cluster/health"}); allowed || err == nil {
+		t.Error("All the authorizers should have to allow the request")
+	}
+}
+
+func TestRulesAuthorizerStripsQueryParams(t *testing.T) {
+	LoadAuthorizations(AuthorizationStore{"foo": {Deny, []string{"GET /_search ?!refresh"}}})
+	req := &Request{User: "foo", Method: "GET", Path: "/_search", Query: url.Values{"refresh": {"true"}, "size": {"1"}}}
+
+	if allowed, _ := (RulesAuthorizer{}).Authorize(req); allowed {
+		t.Error("Request should have been denied")
+	}
+
+	StripQueryParams = true
+	defer func() { StripQueryParams = false }()
+
+	if allowed, _ := (RulesAuthorizer{}).Authorize(req); !allowed || req.Query.Encode() != "size=1" {
+		t.Error("Request should have been allowed without refresh, got", allowed, req.Query)
+	}
+}
+
+func TestCalloutAuthorizer(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(policyServer(&calls))
+	defer srv.Close()
+
+	c := &CalloutAuthorizer{URL: srv.URL, Timeout: time.Second, CacheTTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		req := &Request{User: "foo", Method: "GET", Path: "/", Header: http.Header{"X-Request-Id": {strconv.Itoa(i)}}}
+		if allowed, err := c.Authorize(req); !allowed || err != nil {
+			t.Error("Request should have been allowed", err)
+		}
+	}
+
+	if allowed, _ := c.Authorize(&Request{User: "bar", Method: "GET", Path: "/"}); allowed {
+		t.Error("Request should have been denied")
+	}
+
+	// The decisions are not shared between the roles, attributes or client IPs of a user.
+	c.Authorize(&Request{User: "foo", Groups: []string{"ops"}, Method: "GET", Path: "/"})
+	c.Authorize(&Request{User: "foo", Attributes: map[string]string{"dept": "ops"}, Method: "GET", Path: "/"})
+	c.Authorize(&Request{User: "foo", ClientIP: "10.0.0.1", Method: "GET", Path: "/"})
+
+	if calls != 5 {
+		t.Error("Decisions should have been cached, got calls:", calls)
+	}
+}
+
+func TestCalloutAuthorizerOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "pdp.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip("Unix sockets not available:", err)
+	}
+
+	var calls int32
+	go http.Serve(l, policyServer(&calls))
+	defer l.Close()
+
+	c := &CalloutAuthorizer{URL: "unix://" + socket, Timeout: time.Second}
+	if allowed, err := c.Authorize(&Request{User: "foo"}); !allowed || err != nil {
+		t.Error("Request should have been allowed", err)
+	}
+}
+
+func TestCalloutAuthorizerFailures(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"deny": true}`))
+	}))
+	defer broken.Close()
+
+	for _, url := range []string{slow.URL, broken.URL, "http://127.0.0.1:1"} {
+		for _, failOpen := range []bool{true, false} {
+			c := &CalloutAuthorizer{URL: url, Timeout: 50 * time.Millisecond, FailOpen: failOpen}
+			if allowed, err := c.Authorize(&Request{User: "foo"}); allowed != failOpen || err == nil {
+				t.Errorf("Expected %v with an error for %s, got %v (%v)", failOpen, url, allowed, err)
+			}
+		}
+	}
+}
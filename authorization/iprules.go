@@ -0,0 +1,135 @@
+package authorization
+
+import (
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IPRule restricts the client IPs: those in Deny are refused and, unless Allow is empty,
+// only those in Allow are accepted.
+type IPRule struct {
+	Allow, Deny []*net.IPNet
+}
+
+// IPRules holds the client IP rules: global (under the "*" key), per user and per role
+// (under "@role" keys).
+type IPRules map[string]IPRule
+
+// ipRules holds the loaded client IP rules.
+var ipRules IPRules
+
+// ipRulesMu guards ipRules.
+var ipRulesMu sync.RWMutex
+
+// LoadIPRules loads the client IP rules from backend: an IPRules variable, an io.Reader
+// or a file name (see ReadIPRules() for the format).
+func LoadIPRules(backend interface{}) (err error) {
+	var rules IPRules
+	switch v := backend.(type) {
+	case IPRules:
+		rules = v
+	case io.Reader:
+		rules, err = ReadIPRules(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		rules, err = ReadIPRules(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		ipRulesMu.Lock()
+		ipRules = rules
+		ipRulesMu.Unlock()
+	}
+
+	return
+}
+
+// ReadIPRules reads the client IP rules from r. The file must have the format:
+//
+// 		name:allow|deny:cidr1,...,cidrN
+//
+// where name is "*" (for everybody), a user or a role (as "@role"). Both an allow and a deny
+// line can be given for the same name. The CIDRs can be IPv4 or IPv6 ones, or single IPs.
+func ReadIPRules(r io.Reader) (rules IPRules, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	rules = IPRules{}
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 3)
+		if len(tokens) != 3 {
+			return nil, errors.New("Invalid IP rule line: " + line)
+		}
+
+		nets, err := aa.ParseCIDRs(tokens[2])
+		if err != nil {
+			return nil, err
+		}
+
+		rule := rules[tokens[0]]
+		switch tokens[1] {
+		case "allow":
+			rule.Allow = append(rule.Allow, nets...)
+		case "deny":
+			rule.Deny = append(rule.Deny, nets...)
+		default:
+			return nil, errors.New("Unknown IP rule " + tokens[1])
+		}
+		rules[tokens[0]] = rule
+	}
+
+	return
+}
+
+// accepts determines if ir accepts ip.
+func (ir IPRule) accepts(ip net.IP) bool {
+	return !aa.IPInNets(ip, ir.Deny) && (len(ir.Allow) == 0 || aa.IPInNets(ip, ir.Allow))
+}
+
+// IPAllowed determines if user (having roles) may connect from ip. The global rules always
+// apply. Then the user's own rules apply, if they have any, or otherwise the rules of their
+// roles, any of which may accept ip.
+func IPAllowed(ip net.IP, user string, roles ...string) bool {
+	ipRulesMu.RLock()
+	rules := ipRules
+	ipRulesMu.RUnlock()
+
+	if rule, ok := rules["*"]; ok && !rule.accepts(ip) {
+		return false
+	}
+
+	if rule, ok := rules[user]; ok {
+		return rule.accepts(ip)
+	}
+
+	restricted := false
+	for _, role := range roles {
+		if rule, ok := rules["@"+role]; ok {
+			if rule.accepts(ip) {
+				return true
+			}
+			restricted = true
+		}
+	}
+
+	return !restricted
+}
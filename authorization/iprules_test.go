@@ -0,0 +1,60 @@
+package authorization
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadIPRules(t *testing.T) {
+	rules, err := ReadIPRules(strings.NewReader("*:deny:6.6.6.0/24\nadmin:allow:10.8.0.0/16,fd00::/8\nadmin:deny:10.8.1.1\n"))
+	if err != nil || len(rules) != 2 || len(rules["admin"].Allow) != 2 || len(rules["admin"].Deny) != 1 {
+		t.Fatal("Unexpected rules", rules, err)
+	}
+
+	for _, bogus := range []string{"admin:allow", "admin:maybe:10.0.0.1", "admin:allow:bogus"} {
+		if _, err = ReadIPRules(strings.NewReader(bogus)); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	LoadIPRules(IPRules{
+		"*":       {Deny: mustParseCIDRs("6.6.6.0/24")},
+		"admin":   {Allow: mustParseCIDRs("10.8.0.0/16,fd00::/8"), Deny: mustParseCIDRs("10.8.1.1")},
+		"@ops":    {Allow: mustParseCIDRs("10.0.0.0/8")},
+		"@remote": {Allow: mustParseCIDRs("192.168.0.0/16")},
+	})
+	defer LoadIPRules(IPRules(nil))
+
+	for _, c := range []struct {
+		ip, user string
+		roles    []string
+		expected bool
+	}{
+		{"1.2.3.4", "foo", nil, true},
+		{"6.6.6.6", "foo", nil, false},
+		{"10.8.0.1", "admin", nil, true},
+		{"fd00::1", "admin", nil, true},
+		{"10.8.1.1", "admin", nil, false},
+		{"1.2.3.4", "admin", []string{"ops"}, false},
+		{"10.1.1.1", "foo", []string{"ops", "readers"}, true},
+		{"192.168.1.1", "foo", []string{"ops", "remote"}, true},
+		{"1.2.3.4", "foo", []string{"ops", "remote"}, false},
+	} {
+		if IPAllowed(net.ParseIP(c.ip), c.user, c.roles...) != c.expected {
+			t.Errorf("Expected %v for %s %s %v", c.expected, c.ip, c.user, c.roles)
+		}
+	}
+}
+
+func mustParseCIDRs(list string) []*net.IPNet {
+	nets, err := aa.ParseCIDRs(list)
+	if err != nil {
+		panic(err)
+	}
+
+	return nets
+}
@@ -0,0 +1,56 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrAmbiguousPath is returned for the paths which can not be normalized safely, as the
+// backend may interpret them differently (i.e. with encoded slashes).
+var ErrAmbiguousPath = errors.New("ambiguous path")
+
+// ambiguousEncodings are the percent-encodings refused in paths: slash, backslash, percent
+// (double encoding) and NUL.
+var ambiguousEncodings = []string{"%2f", "%5c", "%25", "%00"}
+
+// Normalize canonicalizes the path of u, so that the rules are matched against the path
+// the backend will act upon: the percent-encodings of unreserved characters are decoded,
+// repeated slashes collapsed, dot segments resolved and the trailing slash dropped. The
+// paths with ambiguous encodings, backslashes or NULs are refused with ErrAmbiguousPath.
+//
+// The normalized path is also the one forwarded, with only the characters which can not
+// appear as such in a path percent-encoded.
+func Normalize(u *url.URL) error {
+	escaped := strings.ToLower(u.EscapedPath())
+	for _, enc := range ambiguousEncodings {
+		if strings.Contains(escaped, enc) {
+			return fmt.Errorf("%w: %s encoding", ErrAmbiguousPath, strings.ToUpper(enc))
+		}
+	}
+
+	if strings.ContainsAny(u.Path, "\\\x00") {
+		return fmt.Errorf("%w: backslash or NUL", ErrAmbiguousPath)
+	}
+
+	u.Path = path.Clean("/" + u.Path)
+	u.RawPath = escapePath(u.Path)
+
+	return nil
+}
+
+// escapePath percent-encodes the characters of p which can not appear as such in a path.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if c := p[i]; c > ' ' && c < 0x7f && !strings.ContainsRune("\"#%<>?\\^`{|}", rune(c)) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package authorization
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"/_cluster/health":          "/_cluster/health",
+		"//_cluster/health":         "/_cluster/health",
+		"/_cluster/./health":        "/_cluster/health",
+		"/logs/../_cluster/health":  "/_cluster/health",
+		"/%5Fcluster/health":        "/_cluster/health",
+		"/_cluster/health/":         "/_cluster/health",
+		"/../../_cluster/health":    "/_cluster/health",
+		"/.":                        "/",
+		"/_cat/indices/logs-*,a b":  "/_cat/indices/logs-*,a%20b",
+		"/_cat/indices/logs-%2A%3F": "/_cat/indices/logs-*%3F",
+	} {
+		u, err := url.ParseRequestURI(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = Normalize(u); err != nil || u.EscapedPath() != expected {
+			t.Errorf("Expected %s for %s, got %s (%v)", expected, raw, u.EscapedPath(), err)
+		}
+	}
+
+	for _, raw := range []string{"/_cluster%2Fhealth", "/_cluster%2fhealth", "/%255Fcluster/health", "/_cluster%5Chealth", "/a%00"} {
+		u, _ := url.ParseRequestURI(raw)
+		if err := Normalize(u); !errors.Is(err, ErrAmbiguousPath) {
+			t.Errorf("Expected %v for %s, got %v", ErrAmbiguousPath, raw, err)
+		}
+	}
+}
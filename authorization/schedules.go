@@ -0,0 +1,159 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedules holds the schedules restricting when users (and roles, under "@role" keys)
+// have access (see aa.ParseSchedule).
+type Schedules map[string]*aa.Schedule
+
+// schedules holds the loaded schedules.
+var schedules Schedules
+
+// schedulesMu guards schedules.
+var schedulesMu sync.RWMutex
+
+// now returns the current time (replaceable in tests).
+var now = time.Now
+
+// LoadSchedules loads the user and role schedules from backend: a Schedules variable, an
+// io.Reader or a file name (see ReadSchedules() for the format).
+func LoadSchedules(backend interface{}) (err error) {
+	var s Schedules
+	switch v := backend.(type) {
+	case Schedules:
+		s = v
+	case io.Reader:
+		s, err = ReadSchedules(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		s, err = ReadSchedules(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		schedulesMu.Lock()
+		schedules = s
+		schedulesMu.Unlock()
+	}
+
+	return
+}
+
+// ReadSchedules reads the user and role schedules from r. The file must have the format:
+//
+// 		name:schedule
+//
+// where name is a user or a role (as "@role") and schedule is as expected by
+// aa.ParseSchedule, i.e.:
+//
+// 		contractor:not-before=2026-10-01 expires-at=2026-12-31
+// 		@oncall:days=mon-fri hours=0800-1800 tz=Europe/Bucharest
+func ReadSchedules(r io.Reader) (s Schedules, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	s = Schedules{}
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return nil, errors.New("Invalid schedule line: " + line)
+		}
+
+		if s[tokens[0]], err = aa.ParseSchedule(tokens[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// scheduleExplain returns why name (a user or "@role") has no access now, according to its
+// schedule, or "" if it has.
+func scheduleExplain(name string) string {
+	schedulesMu.RLock()
+	sch := schedules[name]
+	schedulesMu.RUnlock()
+
+	if sch == nil {
+		return ""
+	}
+
+	return sch.Explain(now())
+}
+
+// HasCapability determines if id holds the capability role now: they must have it, and
+// neither their schedule nor that of the role may deny access at this time.
+func HasCapability(id aa.Identity, role string) bool {
+	return id.HasGroup(role) && scheduleExplain(id.User) == "" && scheduleExplain("@"+role) == ""
+}
+
+// Explain returns notes on the time constraints which weigh on the decision for {user, verb,
+// path} (and roles): the schedules of the user and of their roles, and those of the rules
+// matching it, which do not allow access now.
+func Explain(user, verb, path string, roles ...string) (notes []string) {
+	if why := scheduleExplain(user); why != "" {
+		notes = append(notes, fmt.Sprintf("user %s: %s", user, why))
+	}
+
+	for _, role := range roles {
+		if why := scheduleExplain("@" + role); why != "" {
+			notes = append(notes, fmt.Sprintf("role %s: %s", role, why))
+		}
+	}
+
+	mu.RLock()
+	as := authorizations
+	mu.RUnlock()
+
+	names := []string{user}
+	if as[user].isEmpty() {
+		names = names[:0]
+		for _, role := range roles {
+			names = append(names, "@"+role)
+		}
+	}
+
+	path, rawQuery := splitQuery(path)
+	query, _ := url.ParseQuery(rawQuery)
+	for _, name := range names {
+		for _, s := range as[name].Rules {
+			r := parseRule(s)
+			if r.schedule == nil && r.scheduleErr == nil {
+				continue
+			} else if matched, _ := r.matchesImplied(verb, path, query, false); !matched {
+				continue
+			}
+
+			if r.scheduleErr != nil {
+				notes = append(notes, fmt.Sprintf("rule %q (%s): invalid schedule: %v", s, name, r.scheduleErr))
+			} else if why := r.schedule.Explain(now()); why != "" {
+				notes = append(notes, fmt.Sprintf("rule %q (%s): %s", s, name, why))
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,90 @@
+package authorization
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at makes now return the given (RFC3339) time, until the returned func is called.
+func at(t *testing.T, value string) func() {
+	tm, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = func() time.Time { return tm }
+	return func() { now = time.Now }
+}
+
+func TestReadSchedules(t *testing.T) {
+	s, err := ReadSchedules(strings.NewReader("contractor:expires-at=2026-12-31\n@oncall:days=sat,sun\n"))
+	if err != nil || len(s) != 2 || s["@oncall"].Days == nil {
+		t.Fatal("Unexpected schedules", s, err)
+	}
+
+	for _, bogus := range []string{"contractor", ":days=mon", "contractor:days=someday"} {
+		if _, err = ReadSchedules(strings.NewReader(bogus)); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+}
+
+func TestAuthorizationPassedWithSchedules(t *testing.T) {
+	defer at(t, "2026-10-05T09:00:00Z")() // a Monday
+	expired, _ := aa.ParseSchedule("expires-at=2026-10-01")
+	weekend, _ := aa.ParseSchedule("days=sat-sun")
+	LoadSchedules(Schedules{"contractor": expired, "@oncall": weekend})
+	defer LoadSchedules(Schedules(nil))
+	LoadAuthorizations(AuthorizationStore{
+		"foo":        AuthorizationRules{Deny, []string{"GET /logs @hours=0800-1800", "GET /night @hours=2200-0600", "GET /bogus @days=someday"}},
+		"contractor": AuthorizationRules{Allow, []string{}},
+		"@oncall":    AuthorizationRules{Allow, []string{}},
+	})
+
+	if !AuthorizationPassed("foo", "GET", "/logs") || AuthorizationPassed("foo", "GET", "/night") || AuthorizationPassed("foo", "GET", "/bogus") {
+		t.Error("Rules should only apply within their schedules")
+	}
+
+	if AuthorizationPassed("contractor", "GET", "/logs") || AuthorizationPassed("qux", "GET", "/logs", "oncall") {
+		t.Error("Users and roles should have no access outside of their schedules")
+	}
+
+	notes := Explain("contractor", "GET", "/logs")
+	if len(notes) != 1 || notes[0] != "user contractor: expired at 2026-10-01T00:00:00Z" {
+		t.Error("Unexpected explanation", notes)
+	}
+
+	if notes = Explain("foo", "GET", "/night"); len(notes) != 1 || !strings.HasPrefix(notes[0], `rule "GET /night @hours=2200-0600" (foo): not valid at 09:00`) {
+		t.Error("Unexpected explanation", notes)
+	}
+
+	if notes = Explain("qux", "GET", "/logs", "oncall"); len(notes) != 1 || !strings.HasPrefix(notes[0], "role oncall: not valid on mon") {
+		t.Error("Unexpected explanation", notes)
+	}
+
+	if err := ValidateRules(AuthorizationRules{Deny, []string{"GET /bogus @days=someday"}}); err == nil {
+		t.Error("Invalid rule schedules should fail validation")
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	defer at(t, "2026-10-05T09:00:00Z")() // a Monday
+	expired, _ := aa.ParseSchedule("expires-at=2026-10-01")
+	weekend, _ := aa.ParseSchedule("days=sat-sun")
+	LoadSchedules(Schedules{"contractor": expired, "@oncall": weekend})
+	defer LoadSchedules(Schedules(nil))
+
+	if !HasCapability(aa.Identity{User: "foo", Groups: []string{"admin"}}, "admin") {
+		t.Error("foo should have the admin capability")
+	}
+
+	if HasCapability(aa.Identity{User: "foo"}, "admin") || HasCapability(aa.Identity{User: "contractor", Groups: []string{"admin"}}, "admin") {
+		t.Error("Capabilities should only be held by the users having the role, within their schedule")
+	}
+
+	if HasCapability(aa.Identity{User: "foo", Groups: []string{"oncall"}}, "oncall") {
+		t.Error("Capabilities should only be held within the role schedule")
+	}
+}
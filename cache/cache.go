@@ -0,0 +1,200 @@
+/*
+Package cache implements the response cache of the guardian: an in-memory, size bounded
+cache of the responses to idempotent read requests, which expire after the TTL of their
+route (see ReadRoutes()) or sooner, as the Cache-Control header of the response demands.
+
+The entries are keyed (see Key()) by the scope of the user the response was made for, as
+well as by everything in the request which makes a difference to the response. It is up
+to the callers to pick a scope which is only shared by users with the same permissions.
+*/
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	key     string
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache is a least recently used cache of responses, holding at most MaxSize bytes, of
+// entries of at most MaxEntrySize bytes.
+type Cache struct {
+	MaxSize, MaxEntrySize int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	stats   Stats
+}
+
+// Stats holds the statistics of a Cache.
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Stores    int64 `json:"stores"`
+	Evictions int64 `json:"evictions"`
+	Entries   int64 `json:"entries"`
+	Size      int64 `json:"size"`
+}
+
+// CacheControl holds the directives of a Cache-Control header which matter to the cache.
+type CacheControl struct {
+	NoStore, NoCache bool
+	// MaxAge is -1 when not given.
+	MaxAge time.Duration
+}
+
+// now returns the current time (replaceable in tests).
+var now = time.Now
+
+// New returns a new, empty, Cache.
+func New(maxSize, maxEntrySize int64) *Cache {
+	return &Cache{MaxSize: maxSize, MaxEntrySize: maxEntrySize, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// Key returns the key of the response to r, for a user of the given scope, given (the
+// already read) body of r. The query parameters are normalized (sorted), the body is hashed.
+func Key(scope string, r *http.Request, body []byte) string {
+	h := sha256.New()
+	for _, part := range []string{scope, r.Method, r.URL.Path, r.URL.Query().Encode(), r.Header.Get("Accept"), r.Header.Get("Accept-Encoding"), string(body)} {
+		h.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ParseCacheControl parses the Cache-Control header value s. A max-age of 0 is taken as
+// no-cache.
+func ParseCacheControl(s string) (cc CacheControl) {
+	cc.MaxAge = -1
+	for _, directive := range strings.Split(strings.ToLower(s), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+
+		switch name {
+		case "no-store":
+			cc.NoStore = true
+		case "no-cache":
+			cc.NoCache = true
+		case "max-age":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				cc.MaxAge = time.Duration(n) * time.Second
+				cc.NoCache = cc.NoCache || n == 0
+			}
+		}
+	}
+
+	return
+}
+
+// Get returns the (unexpired) entry stored under key, if any. The entry must not be modified.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok && now().Before(el.Value.(*Entry).expires) {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+
+		return el.Value.(*Entry), true
+	} else if ok {
+		c.remove(el)
+	}
+	c.stats.Misses++
+
+	return nil, false
+}
+
+// Put stores e under key, for ttl, evicting the least recently used entries as needed. It
+// reports whether e was stored (entries larger than MaxEntrySize, or MaxSize, are not).
+func (c *Cache) Put(key string, e *Entry, ttl time.Duration) bool {
+	size := e.size()
+	if ttl <= 0 || size > c.MaxEntrySize || size > c.MaxSize {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	for c.size+size > c.MaxSize {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	e.key, e.stored = key, now()
+	e.expires = e.stored.Add(ttl)
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += size
+	c.stats.Stores++
+
+	return true
+}
+
+// Purge removes all the entries of c.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries, c.size = map[string]*list.Element{}, 0
+	c.lru.Init()
+}
+
+// Age returns how long ago e was stored.
+func (e *Entry) Age() time.Duration {
+	return now().Sub(e.stored)
+}
+
+// Stats returns the statistics of c.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries, s.Size = int64(len(c.entries)), c.size
+
+	return s
+}
+
+// remove removes el from c (c.mu must be held).
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*Entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// size approximates the memory taken by e.
+func (e *Entry) size() (n int64) {
+	n = int64(len(e.Body))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+
+	return
+}
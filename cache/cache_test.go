@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	key := func(scope, method, target, accept string, body string) string {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Accept", accept)
+		return Key(scope, r, []byte(body))
+	}
+
+	base := key("foo", "GET", "/logs/_search?q=a&size=1", "", "")
+	if base != key("foo", "GET", "/logs/_search?size=1&q=a", "", "") {
+		t.Error("The query parameters order should not matter")
+	}
+
+	for _, other := range []string{
+		key("bar", "GET", "/logs/_search?q=a&size=1", "", ""),
+		key("foo", "POST", "/logs/_search?q=a&size=1", "", ""),
+		key("foo", "GET", "/other/_search?q=a&size=1", "", ""),
+		key("foo", "GET", "/logs/_search?q=b&size=1", "", ""),
+		key("foo", "GET", "/logs/_search?q=a&size=1", "text/plain", ""),
+		key("foo", "GET", "/logs/_search?q=a&size=1", "", "{}"),
+	} {
+		if other == base {
+			t.Error("Expected different keys")
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	for s, expected := range map[string]CacheControl{
+		"":                           {MaxAge: -1},
+		"no-store":                   {NoStore: true, MaxAge: -1},
+		"No-Cache, max-age=60":       {NoCache: true, MaxAge: time.Minute},
+		`private, max-age="30"`:      {MaxAge: 30 * time.Second},
+		"max-age=0":                  {NoCache: true},
+		"max-age=bogus, must-revali": {MaxAge: -1},
+	} {
+		if cc := ParseCacheControl(s); cc != expected {
+			t.Errorf("Expected %v for %q, got %v", expected, s, cc)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	entry := func(body string) *Entry {
+		return &Entry{Status: http.StatusOK, Header: http.Header{}, Body: []byte(body)}
+	}
+
+	c := New(30, 20)
+	if c.Put("big", entry(strings.Repeat("x", 21)), time.Minute) || c.Put("a", entry("a"), 0) {
+		t.Error("Entries larger than MaxEntrySize, or without a TTL, should not be stored")
+	}
+
+	c.Put("a", entry(strings.Repeat("a", 10)), time.Minute)
+	c.Put("b", entry(strings.Repeat("b", 10)), 10*time.Second)
+	if e, ok := c.Get("a"); !ok || string(e.Body) != strings.Repeat("a", 10) {
+		t.Fatal("Expected a hit, got", e)
+	}
+
+	// a was used more recently than b, so b gets evicted.
+	c.Put("c", entry(strings.Repeat("c", 15)), time.Minute)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+
+	now = func() time.Time { return start.Add(30 * time.Second) }
+	if e, ok := c.Get("c"); !ok || e.Age() != 30*time.Second {
+		t.Error("Expected c to be 30s old, got", e)
+	}
+
+	now = func() time.Time { return start.Add(time.Minute) }
+	if _, ok := c.Get("a"); ok {
+		t.Error("a should have expired")
+	}
+
+	if s := c.Stats(); s != (Stats{Hits: 2, Misses: 2, Stores: 3, Evictions: 1, Entries: 1, Size: 15}) {
+		t.Error("Unexpected stats", s)
+	}
+}
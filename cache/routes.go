@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route holds the TTL of the responses to the requests matching Pattern (a regular
+// expression matched against "METHOD /path", as the authorization rules).
+type Route struct {
+	TTL     time.Duration
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+// Routes holds the cached routes, in the order they were given.
+type Routes []Route
+
+// routes holds the loaded routes.
+var routes Routes
+
+// routesMu guards routes.
+var routesMu sync.RWMutex
+
+// searchAPIs lists the (read only) APIs whose POST requests may be cached.
+var searchAPIs = map[string]bool{"_search": true, "_msearch": true, "_count": true}
+
+// LoadRoutes loads the cached routes from backend: a Routes variable, an io.Reader or a
+// file name (see ReadRoutes() for the format).
+func LoadRoutes(backend interface{}) (err error) {
+	var rs Routes
+	switch v := backend.(type) {
+	case Routes:
+		rs = v
+		for i := range rs {
+			if rs[i].re, err = regexp.Compile(rs[i].Pattern); err != nil {
+				return
+			}
+		}
+	case io.Reader:
+		rs, err = ReadRoutes(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		rs, err = ReadRoutes(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		routesMu.Lock()
+		routes = rs
+		routesMu.Unlock()
+	}
+
+	return
+}
+
+// ReadRoutes reads the cached routes from r. The file must have the format:
+//
+// 		ttl:pattern
+//
+// where ttl is a duration (i.e. 30s) and pattern a regular expression matched against
+// "METHOD /path", i.e.:
+//
+// 		30s:GET /_cat/
+// 		10s:(GET|POST) /[^/]+/_search$
+//
+// The first matching route decides the TTL.
+func ReadRoutes(r io.Reader) (rs Routes, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) != 2 {
+			return nil, errors.New("Invalid cache route line: " + line)
+		}
+
+		route := Route{Pattern: tokens[1]}
+		if route.TTL, err = time.ParseDuration(tokens[0]); err != nil || route.TTL <= 0 {
+			return nil, errors.New("Invalid cache route TTL " + tokens[0])
+		}
+
+		if route.re, err = regexp.Compile(route.Pattern); err != nil {
+			return nil, fmt.Errorf("Invalid cache route %s: %v", route.Pattern, err)
+		}
+
+		rs = append(rs, route)
+	}
+
+	return
+}
+
+// TTLFor returns the TTL of the response to r, if it may be cached: GET requests and POST
+// requests to the search APIs, save for those dealing with scrolls and points in time,
+// which match a route.
+func TTLFor(r *http.Request) (time.Duration, bool) {
+	method, path := r.Method, r.URL.Path
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case method == "POST" && !searchAPIs[segments[len(segments)-1]], method != "GET" && method != "POST":
+		return 0, false
+	case strings.Contains(path, "/_search/scroll") || strings.Contains(path, "/_pit") || r.URL.Query().Get("scroll") != "":
+		return 0, false
+	}
+
+	routesMu.RLock()
+	rs := routes
+	routesMu.RUnlock()
+
+	for _, route := range rs {
+		if route.re.MatchString(method + " " + path) {
+			return route.TTL, true
+		}
+	}
+
+	return 0, false
+}
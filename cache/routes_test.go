@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRoutes(t *testing.T) {
+	rs, err := ReadRoutes(strings.NewReader("30s:GET /_cat/\n10s:(GET|POST) /[^/]+/_search$\n"))
+	if err != nil || len(rs) != 2 || rs[0].TTL != 30*time.Second || rs[1].Pattern != "(GET|POST) /[^/]+/_search$" {
+		t.Fatal("Unexpected routes", rs, err)
+	}
+
+	for _, bogus := range []string{"GET /_cat/", "soon:GET /_cat/", "0s:GET /_cat/", "1s:GET /_cat/("} {
+		if _, err = ReadRoutes(strings.NewReader(bogus)); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+
+	if LoadRoutes(42) == nil || LoadRoutes("bogus.txt") == nil || LoadRoutes(Routes{{TTL: time.Second, Pattern: "("}}) == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestTTLFor(t *testing.T) {
+	if err := LoadRoutes(strings.NewReader("30s:GET /_cat/\n10s:(GET|POST) /[^/]+/_(search|count)\n1m:.*")); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadRoutes(Routes(nil))
+
+	for _, c := range []struct {
+		method, target string
+		ttl            time.Duration
+	}{
+		{"GET", "/_cat/indices", 30 * time.Second},
+		{"GET", "/logs/_search?q=a", 10 * time.Second},
+		{"POST", "/logs/_search", 10 * time.Second},
+		{"POST", "/logs/_count", 10 * time.Second},
+		{"POST", "/_msearch", time.Minute},
+		{"GET", "/_cluster/health", time.Minute},
+		{"POST", "/logs/_doc", 0},
+		{"PUT", "/logs/_doc/1", 0},
+		{"HEAD", "/logs", 0},
+		{"POST", "/logs/_search?scroll=1m", 0},
+		{"POST", "/_search/scroll", 0},
+		{"POST", "/logs/_pit?keep_alive=1m", 0},
+	} {
+		if ttl, ok := TTLFor(httptest.NewRequest(c.method, c.target, nil)); ttl != c.ttl || ok != (c.ttl > 0) {
+			t.Errorf("Expected %v for %s %s, got %v", c.ttl, c.method, c.target, ttl)
+		}
+	}
+}
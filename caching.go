@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"github.com/alexaandru/elastic_guardian/cache"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+The responses to the idempotent read requests (GET ones and, if so configured, POST ones
+to the search APIs) matching one of the -cache-routes routes can be cached in memory, up
+to -cache-size bytes, for their route TTL (see the cache package). The responses which
+are larger than -cache-entry-size, or which are not 200 OK ones, are not cached.
+
+The cache is consulted after all the protections have been applied to the request, and
+its entries are scoped to the user (see cacheScope), so that a response is only ever
+served to the user it was made for. It is also purged whenever the authentication or
+authorization data is (re)loaded.
+
+The Cache-Control header is honored: requests with no-cache (or max-age=0) bypass the
+cache, those with no-store are not cached either, as are the responses with no-store or
+no-cache, while a response max-age shorter than the route TTL takes precedence. The
+responses carry an X-Cache header (HIT or MISS) and, when served from the cache, an Age
+header. The cache statistics are published via expvar.
+*/
+
+// CacheRoutesPath holds the path to the cached routes file (see cache.ReadRoutes for its
+// format, nothing is cached if empty).
+var CacheRoutesPath string
+
+// CacheSize holds the maximum size of the cache (see es.ParseSize for its format).
+var CacheSize string
+
+// CacheEntrySize holds the maximum size of a cached response (see es.ParseSize for its format).
+var CacheEntrySize string
+
+// responseCache holds the response cache (nil when nothing is cached).
+var responseCache *cache.Cache
+
+// cacheRecorder passes a response through, while recording it (up to max bytes) for the
+// cache.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func init() {
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		if c := responseCache; c != nil {
+			return c.Stats()
+		}
+
+		return nil
+	}))
+}
+
+// initCache sets up the response cache and loads its routes, if any were given.
+func initCache() (err error) {
+	if responseCache = nil; CacheRoutesPath == "" {
+		return cache.LoadRoutes(cache.Routes(nil))
+	}
+
+	size, err := es.ParseSize(CacheSize)
+	if err != nil {
+		return
+	}
+
+	entrySize, err := es.ParseSize(CacheEntrySize)
+	if err != nil {
+		return
+	}
+
+	if err = cache.LoadRoutes(CacheRoutesPath); err == nil {
+		responseCache = cache.New(size, entrySize)
+	}
+
+	return
+}
+
+// purgeCache drops all the cached responses, i.e. when the permissions may have changed.
+func purgeCache() {
+	if responseCache != nil {
+		responseCache.Purge()
+	}
+}
+
+// cacheScope returns the cache scope of id: the user, along with the roles and attributes
+// they were authenticated with.
+func cacheScope(id aa.Identity) string {
+	groups := append([]string(nil), id.Groups...)
+	sort.Strings(groups)
+
+	attributes := []string{}
+	for name, value := range id.Attributes {
+		attributes = append(attributes, name+"="+value)
+	}
+	sort.Strings(attributes)
+
+	return id.User + "\n" + strings.Join(groups, ",") + "\n" + strings.Join(attributes, "\n")
+}
+
+// wrapCache serves the cacheable requests (see cache.TTLFor) from responseCache, when their
+// responses are in it, or caches their responses otherwise.
+func wrapCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := responseCache
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ttl, ok := cache.TTLFor(r)
+		cc := cache.ParseCacheControl(r.Header.Get("Cache-Control"))
+		if !ok || cc.NoStore {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Method == "POST" {
+			var err error
+			if body, err = es.ReadBody(r); err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		id, _ := aa.FromContext(r.Context())
+		key := cache.Key(cacheScope(id), r, body)
+		if !cc.NoCache {
+			if e, ok := c.Get(key); ok {
+				serveCached(w, e)
+				return
+			}
+		}
+
+		rec := &cacheRecorder{ResponseWriter: w, max: c.MaxEntrySize}
+		h.ServeHTTP(rec, r)
+
+		rcc := cache.ParseCacheControl(rec.header.Get("Cache-Control"))
+		if rec.status != http.StatusOK || rec.overflow || rcc.NoStore || rcc.NoCache {
+			return
+		} else if rcc.MaxAge >= 0 && rcc.MaxAge < ttl {
+			ttl = rcc.MaxAge
+		}
+
+		c.Put(key, &cache.Entry{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}, ttl)
+	})
+}
+
+// serveCached writes the cached response e to w.
+func serveCached(w http.ResponseWriter, e *cache.Entry) {
+	for name, values := range e.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(e.Age().Seconds())))
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if cr.status != 0 {
+		return
+	}
+
+	cr.status, cr.header = status, cr.ResponseWriter.Header().Clone()
+	cr.ResponseWriter.Header().Set("X-Cache", "MISS")
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	cr.WriteHeader(http.StatusOK)
+	if !cr.overflow && int64(cr.body.Len()+len(p)) <= cr.max {
+		cr.body.Write(p)
+	} else {
+		cr.overflow = true
+		cr.body.Reset()
+	}
+
+	return cr.ResponseWriter.Write(p)
+}
+
+// Unwrap gives access to the wrapped http.ResponseWriter (see http.ResponseController).
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if strings.HasSuffix(r.URL.Path, "/_count") {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte(`{"user":"` + r.Header.Get("X-Authenticated-User") + `"}`))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	CacheRoutesPath, CacheSize, CacheEntrySize = filepath.Join(dir, "routes.txt"), "1mb", "1kb"
+	ioutil.WriteFile(CacheRoutesPath, []byte("1m:GET /_cat/\n1m:POST /[^/]+/_(search|count)$\n"), 0600)
+	defer func() { CacheRoutesPath = ""; initCache() }()
+	if err = initCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	loadRoleTestData()
+	uri, _ := url.Parse(backend.URL)
+	handler := initReverseProxy(uri, wrapCache, wrapAuthentication)
+	for i, c := range []struct {
+		header, method, target, body, cacheControl string
+		cached                                     bool
+	}{
+		{foobar, "GET", "/_cat/indices?v&h=index", "", "", false},
+		{foobar, "GET", "/_cat/indices?h=index&v", "", "", true},
+		{quxquux, "GET", "/_cat/indices?v&h=index", "", "", false},
+		{quxquux, "GET", "/_cat/indices?v&h=index", "", "", true},
+		{foobar, "GET", "/_cat/indices?v&h=index", "", "no-cache", false},
+		{foobar, "GET", "/_cat/indices?v&h=index", "", "", true},
+		{foobar, "POST", "/logs/_search", `{"size":1}`, "", false},
+		{foobar, "POST", "/logs/_search", `{"size":1}`, "", true},
+		{foobar, "POST", "/logs/_search", `{"size":2}`, "", false},
+		{foobar, "POST", "/logs/_search?scroll=1m", `{"size":1}`, "", false},
+		{foobar, "POST", "/logs/_search?scroll=1m", `{"size":1}`, "", false},
+		{foobar, "POST", "/logs/_count", `{}`, "", false},
+		{foobar, "POST", "/logs/_count", `{}`, "", false},
+		{foobar, "GET", "/_cluster/health", "", "", false},
+		{foobar, "GET", "/_cluster/health", "", "", false},
+	} {
+		before := calls
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.Header.Set("Authorization", "Basic "+c.header)
+		req.Header.Set("Cache-Control", c.cacheControl)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if cached := calls == before; cached != c.cached {
+			t.Errorf("Expected request #%d (%s %s) to be cached: %v, got %v", i, c.method, c.target, c.cached, cached)
+		} else if c.cached && recorder.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("Expected request #%d to be a cache hit", i)
+		} else if expected := `{"user":"foo"}`; c.header == foobar && recorder.Body.String() != expected {
+			t.Errorf("Expected %s for request #%d, got %s", expected, i, recorder.Body.String())
+		}
+	}
+
+	purgeCache()
+	req := httptest.NewRequest("GET", "/_cat/indices?v&h=index", nil)
+	req.Header.Set("Authorization", "Basic "+foobar)
+	before := calls
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if calls == before {
+		t.Error("The cache should have been purged")
+	}
+}
@@ -17,6 +17,85 @@ It currently supports loading the authentication and authorization data from two
 	inline variables (see settings.go) or
 	external files (filenames passed via commandline flags)
 
+The credentials, roles and authorizations can alternatively be kept in an embedded DB
+(see the store package), given via -store, which can be shared by several processes.
+
+Credentials can also be verified against an LDAP directory (see -ldap-url and related
+flags), for the users not found in the credentials. Their LDAP groups are mapped to roles
+and authorization rules can be given for roles as well as for users.
+
+Requests are authenticated by a configurable chain of providers (see listeners.go): the
+credentials, LDAP, htpasswd files, API keys, JWTs, TLS client certificates and trusted
+headers set by an authenticating proxy. Several listeners, each with its own chain, can
+be configured via -listen.
+
+An optional admin API (see admin.go) can be exposed on a separate address via -admin. It
+is only accessible to users having the -admin-role role and allows managing users, their
+roles and authorization rules at runtime.
+
+Searches can be restricted to the documents matching per user or per role filters (see
+-dls), which are injected into their queries. Fields can likewise be hidden per user or
+per role (see -fls), both by rewriting the requests and by stripping them from responses.
+Tenants (see -tenants) see their own namespace of indices, physically prefixed and/or
+suffixed per user or per role. Index listings are filtered down to the indices the user
+may search (see -filter-listings).
+
+Searches can be held to per user or per role cost limits (see -cost): maximum size, from
+and aggregation buckets, forbidden query types and mandatory timeouts.
+
+Built-in guardrails (see -guardrails) stop the operations which can wreck a cluster, such
+as wildcard deletes or shutdowns, for all but the users with the -guardrails-role role.
+Scripts can likewise be reserved (see -restrict-scripts) to the users with the -script-role
+role, optionally limited to a list of stored scripts (see -stored-scripts). Scrolls, points
+in time and async searches can only be continued or deleted by the users who created them
+(see -cursor-ownership). The nodes addresses are kept from the clients which sniff them, so that
+they can not bypass the guardian (see -sniffing).
+
+Rules can be given for sets of methods and the methods implied by others (see
+-implied-methods) are authorized like them, i.e. HEAD like GET. The method override headers
+are either rejected or honored (see -method-override), but the method authorized is always
+the one the backend executes.
+
+Rules are regular expressions by default, but they can also be written as anchored globs
+and path templates, i.e. "GET /{index}/_doc/{id}" (see -rule-syntax). Rules can explicitly
+allow or deny, in which case they are evaluated in order, the first matching one deciding,
+or with any matching deny overriding the allows (see -rule-strategy). Rules can also have
+conditions on the query parameters and the forbidden parameters can be stripped instead of
+denying the requests carrying them (see -strip-params).
+
+Request paths are normalized before being authorized (repeated slashes, dot segments and
+needlessly percent-encoded characters), and forwarded as such; ambiguous ones, such as
+those with encoded slashes, are refused.
+
+Clients can be restricted by IP (see -ip-rules), globally as well as per user or per role.
+The client IPs passed by the proxies in front of the guardian are trusted only for those
+given via -forwarded-proxies, and only in the header they set (see -forwarded-header).
+
+Users, roles (see -schedules), API keys and individual rules can be restricted in time:
+to validity windows and/or to recurring schedules (i.e. weekdays, 08:00-18:00). The
+capability roles (-admin-role, -guardrails-role and -script-role) are only held within the
+schedules of the user and of the role. The admin API reports those weighing on the
+decisions it tests.
+
+The request bodies can be limited in size (see -max-body and -body-limits), globally as well
+as per path, per user and per role. The requests exceeding their limit are refused with 413
+Request Entity Too Large, the chunked uploads as soon as they do, and counted (see the
+body_limits metrics).
+
+Usage (requests, ingested and returned bytes) can be counted per user (see quotas.go), and
+capped by daily and monthly quotas given per user or per role.
+
+The responses to the idempotent read requests can be cached (see caching.go and
+-cache-routes), per user, with TTLs per route and honoring the Cache-Control headers.
+
+Access can additionally (or instead) be decided by an external policy decision service
+(see -authorizers and the -pdp-* flags), which receives the full request context: the
+identity, method, path, query, headers, client IP and targeted indices.
+
+A candidate authorizations file can additionally be given via -shadow-apath. It is evaluated
+for every request alongside the enforced one, in audit-only mode: disagreements are logged
+and counted, but only the enforced authorizations decide access.
+
 Whether the external files are used or not can be controled (at compile time) via AllowAuthFromFiles
 constant. See that constant definition for further details.
 
@@ -31,17 +110,25 @@ by default.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	aa "github.com/alexaandru/elastic_guardian/authentication"
 	az "github.com/alexaandru/elastic_guardian/authorization"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"github.com/alexaandru/elastic_guardian/store"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // AllowAuthFromFiles controls whether the files specified via command lien flags for
@@ -71,8 +158,95 @@ var CredentialsPath string
 // AuthorizationsPath holds the path to the authorizations file.
 var AuthorizationsPath string
 
+// ShadowAuthorizationsPath holds the path to the shadow (audit-only) authorizations file.
+var ShadowAuthorizationsPath string
+
+// RolesPath holds the path to the roles file.
+var RolesPath string
+
+// StorePath holds the path to the embedded DB store (see the store package). When set,
+// it is used instead of the credentials, roles and authorizations files.
+var StorePath string
+
+// StorePollInterval controls how often the DB store is checked for changes made by
+// other processes.
+var StorePollInterval time.Duration
+
+// authStore is the store the credentials, roles and authorizations are loaded from.
+var authStore store.Store
+
+// LDAP holds the settings of the LDAP authentication backend (disabled when LDAP.URL is empty).
+var LDAP aa.LDAPConfig
+
+// LDAPCAPath holds the path to a PEM file with the CA certificates trusted for LDAP connections
+// (the system ones are used when empty).
+var LDAPCAPath string
+
+// LDAPGroupsPath holds the path to the file mapping LDAP groups to roles (see aa.LoadRolesFromReader
+// for its format, with group names in place of user names).
+var LDAPGroupsPath string
+
+// AdminURL points to the URL the admin API will accept requests on (disabled when empty).
+var AdminURL string
+
+// Authorizers holds the comma separated list of authorizers which must all allow a request
+// (rules for the authorization rules, callout for the policy decision service).
+var Authorizers string
+
+// PDP holds the settings of the policy decision service callout (disabled when PDP.URL is empty).
+var PDP az.CalloutAuthorizer
+
+// ImpliedMethods holds the comma separated METHOD=IMPLIED pairs of methods authorized like
+// others (see az.ImpliedMethods).
+var ImpliedMethods string
+
+// MethodOverride holds how the method override headers (see methodOverrideHeaders) are
+// handled: "reject" (the requests carrying them) or "honor" (authorize and forward the
+// requests with the overriding method).
+var MethodOverride string
+
+// methodOverrideHeaders are the headers clients and frameworks use for overriding the method.
+var methodOverrideHeaders = []string{"X-HTTP-Method-Override", "X-HTTP-Method", "X-Method-Override"}
+
+// RuleSyntax holds the syntax of the rules (see az.RuleSyntax).
+var RuleSyntax string
+
+// RuleStrategy holds how the explicit allow and deny rules are evaluated (see az.RuleStrategy).
+var RuleStrategy string
+
+// StripQueryParams controls whether the query parameters forbidden by the rules are stripped
+// instead of denying the requests carrying them (see az.StripQueryParams).
+var StripQueryParams bool
+
+// IPRulesPath holds the path to the client IP rules file (see az.ReadIPRules for its format).
+var IPRulesPath string
+
+// SchedulesPath holds the path to the user and role schedules file (see az.ReadSchedules
+// for its format).
+var SchedulesPath string
+
+// ForwardedProxies holds the comma separated CIDRs of the proxies trusted to pass the client
+// IPs (via the ForwardedHeader).
+var ForwardedProxies string
+
+// ForwardedHeader holds the header the ForwardedProxies pass the client IPs in: either
+// X-Forwarded-For or Forwarded.
+var ForwardedHeader string
+
+// forwardedProxies holds the parsed ForwardedProxies.
+var forwardedProxies []*net.IPNet
+
+// authorizer decides which requests are allowed.
+var authorizer az.Authorizer = az.RulesAuthorizer{}
+
+// AdminRole holds the role a user must have in order to access the admin API.
+var AdminRole string
+
 func initReverseProxy(uri *url.URL, handlers ...handlerWrapper) (rp http.Handler) {
-	rp = httputil.NewSingleHostReverseProxy(uri)
+	proxy := httputil.NewSingleHostReverseProxy(uri)
+	proxy.ModifyResponse = modifyResponse
+	proxy.ErrorHandler = proxyError
+	rp = proxy
 	for _, handler := range handlers {
 		rp = handler(rp)
 	}
@@ -81,25 +255,117 @@ func initReverseProxy(uri *url.URL, handlers ...handlerWrapper) (rp http.Handler
 }
 
 func wrapAuthentication(h http.Handler) http.Handler {
+	return authenticateWith(authChain)(h)
+}
+
+// authenticateWith returns a wrapper which authenticates requests with auth. The identity
+// of authenticated users is passed down via the request context (see aa.FromContext).
+func authenticateWith(auth aa.Authenticator) handlerWrapper {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, id := auth.Authenticate(r)
+			if status == aa.Passed {
+				r.Header.Set("X-Authenticated-User", id.User)
+				h.ServeHTTP(w, r.WithContext(aa.NewContext(r.Context(), id)))
+			} else if status == aa.NotAttempted {
+				go logPrint(r, "401 Unauthorized")
+				w.Header().Set("WWW-Authenticate", "Basic realm=\""+Realm+"\"")
+				http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			} else {
+				go logPrint(r, "403 Forbidden (authentication)")
+				http.Error(w, "403 Forbidden (authentication)", http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// wrapNormalization normalizes the request path (see az.Normalize), before anything else
+// looks at it, refusing the ambiguous ones.
+func wrapNormalization(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status, user := aa.BasicAuthPassed(r)
-		if status == aa.Passed {
-			r.Header.Set("X-Authenticated-User", user)
-			h.ServeHTTP(w, r)
-		} else if status == aa.NotAttempted {
-			go logPrint(r, "401 Unauthorized")
-			w.Header().Set("WWW-Authenticate", "Basic realm=\""+Realm+"\"")
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-		} else {
-			go logPrint(r, "403 Forbidden (authentication)")
-			http.Error(w, "403 Forbidden (authentication)", http.StatusForbidden)
+		if err := az.Normalize(r.URL); err != nil {
+			msg := "400 Bad Request (normalization): " + err.Error()
+			go logPrint(r, msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrapMethodOverride handles the method override headers as set by MethodOverride, so that
+// the method authorized is the one the backend executes.
+func wrapMethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := ""
+		for _, header := range methodOverrideHeaders {
+			if value := strings.ToUpper(strings.TrimSpace(r.Header.Get(header))); value == "" {
+				continue
+			} else if MethodOverride != "honor" || method != "" && method != value || strings.Trim(value, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+				msg := "400 Bad Request (method override): " + header + " " + value
+				go logPrint(r, msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			} else {
+				method = value
+			}
+			r.Header.Del(header)
+		}
+
+		if method != "" {
+			r.Method = method
 		}
+
+		h.ServeHTTP(w, r)
 	})
 }
 
 func wrapAuthorization(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if az.AuthorizationPassed(r.Header.Get("X-Authenticated-User"), r.Method, r.URL.Path) {
+		// The rules are matched against the parsed query, which must thus be the whole of it.
+		if _, err := url.ParseQuery(r.URL.RawQuery); err != nil {
+			msg := "400 Bad Request (query): " + err.Error()
+			go logPrint(r, msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		id, _ := aa.FromContext(r.Context())
+		user, roles := id.User, id.Groups
+
+		ip := clientIP(r)
+		if !az.IPAllowed(ip, user, roles...) {
+			go logPrint(r, "403 Forbidden (client IP)")
+			http.Error(w, "403 Forbidden (client IP)", http.StatusForbidden)
+			return
+		}
+
+		req := az.NewRequest(r, id)
+		req.Indices = es.Indices(r.URL.Path)
+		if ip != nil {
+			req.ClientIP = ip.String()
+		}
+		passed, err := authorizer.Authorize(req)
+		if err != nil {
+			go logPrint(r, fmt.Sprintf("authorization error (%s): %v", verdict(passed), err))
+		}
+
+		if query := req.Query.Encode(); passed && query != r.URL.Query().Encode() {
+			go logPrint(r, "stripped query parameters, forwarding ?"+query)
+			r.URL.RawQuery = query
+		}
+
+		path := r.URL.Path
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+
+		if shadow, diverged := az.ShadowAuthorizationPassed(user, r.Method, path, passed, roles...); diverged {
+			go logPrint(r, fmt.Sprintf("shadow policy mismatch (enforced: %s, shadow: %s)", verdict(passed), verdict(shadow)))
+		}
+
+		if passed {
 			go logPrint(r, "202 Accepted")
 			h.ServeHTTP(w, r)
 		} else {
@@ -109,6 +375,15 @@ func wrapAuthorization(h http.Handler) http.Handler {
 	})
 }
 
+// verdict spells out an authorization decision, for logging purposes.
+func verdict(passed bool) string {
+	if passed {
+		return "allow"
+	}
+
+	return "deny"
+}
+
 func processCmdLineFlags() {
 	flag.StringVar(&BackendURL, "backend", "http://localhost:9200", "Backend URL (where to proxy requests to)")
 	flag.StringVar(&FrontendURL, "frontend", ":9600", "Frontend URL (where to expose the proxied backend)")
@@ -116,6 +391,74 @@ func processCmdLineFlags() {
 	flag.StringVar(&LogPath, "logpath", "", "Path to the logfile (if not set, will dump to stdout)")
 	flag.StringVar(&CredentialsPath, "cpath", "", "Path to the credentials file")
 	flag.StringVar(&AuthorizationsPath, "apath", "", "Path to the authorizations file")
+	flag.StringVar(&ShadowAuthorizationsPath, "shadow-apath", "", "Path to a candidate authorizations file, evaluated in audit-only mode")
+	flag.StringVar(&DocumentFiltersPath, "dls", "", "Path to the document level security filters file (JSON)")
+	flag.StringVar(&FieldRulesPath, "fls", "", "Path to the field level security rules file (JSON)")
+	flag.StringVar(&TenanciesPath, "tenants", "", "Path to the tenancies (index prefixes and suffixes) file")
+	flag.BoolVar(&Guardrails, "guardrails", true, "Stop wildcard deletes, closing all indices, shutdowns and dangerous cluster settings changes")
+	flag.StringVar(&GuardrailsRole, "guardrails-role", "admin", "Role (capability) which lifts the guardrails")
+	flag.BoolVar(&RestrictScripts, "restrict-scripts", false, "Allow scripts and stored scripts changes only to the users with the -script-role role")
+	flag.StringVar(&ScriptRole, "script-role", "script", "Role (capability) which allows using scripts")
+	flag.StringVar(&StoredScripts, "stored-scripts", "", "Comma separated IDs of the only stored scripts allowed (inline scripts are then refused)")
+	flag.BoolVar(&CursorOwnership, "cursor-ownership", true, "Allow continuing or deleting scrolls, points in time and async searches only to the users who created them")
+	flag.StringVar(&Sniffing, "sniffing", "rewrite", "How the nodes APIs are handled: rewrite (the nodes addresses with -advertise), block (the nodes info API) or pass")
+	flag.StringVar(&AdvertisedAddress, "advertise", "", "Address (host:port) replacing the nodes addresses (default: the one the client used)")
+	flag.BoolVar(&FilterListings, "filter-listings", true, "Filter the index listings (_cat/indices, _aliases, _mapping, _stats) to the indices the user may search")
+	flag.StringVar(&MaxBodySize, "max-body", "", "Maximum request body size, i.e. 100mb, of the users without a body limit (not limited if not set)")
+	flag.StringVar(&BodyLimitsPath, "body-limits", "", "Path to the request body size limits file (per path, user and role)")
+	flag.StringVar(&QuotasPath, "quotas", "", "Path to the daily and monthly usage quotas file (requires -quota-usage)")
+	flag.StringVar(&QuotaUsagePath, "quota-usage", "", "Path to the file the usage counters are saved to (usage is not counted if not set)")
+	flag.DurationVar(&QuotaFlushInterval, "quota-flush", 10*time.Second, "How often to save the usage counters")
+	flag.BoolVar(&QuotaReport, "quota-report", false, "Print the current usage per user (from -quota-usage) and exit")
+	flag.StringVar(&CacheRoutesPath, "cache-routes", "", "Path to the cached routes file (responses are not cached if not set)")
+	flag.StringVar(&CacheSize, "cache-size", "64mb", "Maximum size of the response cache")
+	flag.StringVar(&CacheEntrySize, "cache-entry-size", "1mb", "Maximum size of a cached response")
+	flag.StringVar(&CostLimitsPath, "cost", "", "Path to the query cost limits file (JSON)")
+	flag.StringVar(&RolesPath, "rpath", "", "Path to the roles file")
+	flag.StringVar(&StorePath, "store", "", "Path to the embedded DB store (used instead of the cpath, rpath and apath files)")
+	flag.DurationVar(&StorePollInterval, "store-poll", 5*time.Second, "How often to check the DB store for changes made by other processes")
+	flag.StringVar(&LDAP.URL, "ldap-url", "", "LDAP server URL, ldaps:// or ldap:// with -ldap-starttls (LDAP authentication is disabled if not set)")
+	flag.BoolVar(&LDAP.StartTLS, "ldap-starttls", false, "Use StartTLS for ldap:// URLs")
+	flag.StringVar(&LDAPCAPath, "ldap-ca", "", "Path to the PEM encoded CA certificates trusted for LDAP connections")
+	flag.StringVar(&LDAP.BindDN, "ldap-bind-dn", "uid=%s,ou=people,dc=example,dc=com", "LDAP DN to bind as, with %s standing for the user name")
+	flag.StringVar(&LDAP.GroupBaseDN, "ldap-group-base", "", "LDAP base DN for group lookups (groups are not looked up if not set)")
+	flag.StringVar(&LDAP.GroupFilter, "ldap-group-filter", "(member=%s)", "LDAP filter for group lookups, with %s standing for the user DN")
+	flag.StringVar(&LDAP.GroupAttribute, "ldap-group-attr", "cn", "LDAP attribute holding the group name")
+	flag.StringVar(&LDAPGroupsPath, "ldap-groups", "", "Path to the LDAP groups to roles mapping file (group names are used as roles if not set)")
+	flag.DurationVar(&LDAP.CacheTTL, "ldap-cache-ttl", 5*time.Minute, "How long to cache successful LDAP authentications")
+	flag.DurationVar(&LDAP.Timeout, "ldap-timeout", 10*time.Second, "Timeout for LDAP operations")
+	flag.StringVar(&AdminURL, "admin", "", "Admin API URL (where to expose the admin API, disabled if not set)")
+	flag.StringVar(&AdminRole, "admin-role", "admin", "Role required for accessing the admin API")
+	flag.StringVar(&ImpliedMethods, "implied-methods", "HEAD=GET", "Comma separated METHOD=IMPLIED pairs of methods authorized by the rules of others")
+	flag.StringVar(&MethodOverride, "method-override", "reject", "How the method override headers (i.e. X-HTTP-Method-Override) are handled: reject or honor")
+	flag.StringVar(&RuleSyntax, "rule-syntax", az.RegexpSyntax, "Syntax of the rules: regexp or glob (anchored globs and path templates, regexps prefixed by ~)")
+	flag.StringVar(&RuleStrategy, "rule-strategy", az.FirstMatch, "How the explicit allow and deny rules are evaluated: first-match or deny-overrides")
+	flag.BoolVar(&StripQueryParams, "strip-params", false, "Strip the query parameters forbidden by the rules instead of denying the requests")
+	flag.StringVar(&IPRulesPath, "ip-rules", "", "Path to the client IP rules file")
+	flag.StringVar(&SchedulesPath, "schedules", "", "Path to the user and role schedules file (validity windows and recurring schedules)")
+	flag.StringVar(&ForwardedProxies, "forwarded-proxies", "", "Comma separated CIDRs of the proxies trusted to pass the client IPs (see -forwarded-header)")
+	flag.StringVar(&ForwardedHeader, "forwarded-header", "X-Forwarded-For", "Header the trusted proxies pass the client IPs in: X-Forwarded-For or Forwarded")
+	flag.StringVar(&Authorizers, "authorizers", "rules", "Comma separated authorizers which must all allow a request: rules and/or callout")
+	flag.StringVar(&PDP.URL, "pdp-url", "", "Policy decision service URL, http(s):// or unix:///path/to/socket (callout authorizer)")
+	flag.DurationVar(&PDP.Timeout, "pdp-timeout", 2*time.Second, "Timeout for the policy decision service calls")
+	flag.DurationVar(&PDP.CacheTTL, "pdp-cache-ttl", 0, "How long to cache the policy decision service decisions (not cached if not set)")
+	flag.BoolVar(&PDP.FailOpen, "pdp-fail-open", false, "Allow the requests when the policy decision service fails (denied otherwise)")
+	flag.StringVar(&AuthChain, "auth-chain", defaultAuthChain, "Authentication chain of the frontend listener (see listeners.go)")
+	flag.Var(&Listeners, "listen", "Additional listener, as [https://]address[=provider1,...,providerN] (can be repeated)")
+	flag.StringVar(&TLSCertPath, "tls-cert", "", "Path to the PEM encoded certificate of the https listeners")
+	flag.StringVar(&TLSKeyPath, "tls-key", "", "Path to the PEM encoded key of the https listeners")
+	flag.StringVar(&TLSClientCAPath, "tls-client-ca", "", "Path to the PEM encoded CA certificates client certificates are verified against")
+	flag.StringVar(&HtpasswdPath, "htpasswd", "", "Path to the htpasswd file (htpasswd authenticator)")
+	flag.StringVar(&APIKeysPath, "apikeys", "", "Path to the API keys file (apikey authenticator)")
+	flag.StringVar(&JWTSecret, "jwt-secret", "", "HMAC secret JWTs are verified with (jwt authenticator)")
+	flag.StringVar(&JWTKeyPath, "jwt-key", "", "Path to the PEM encoded public key or certificate JWTs are verified with (jwt authenticator)")
+	flag.StringVar(&JWT.Issuer, "jwt-issuer", "", "Required JWT issuer (not checked if not set)")
+	flag.StringVar(&JWT.Audience, "jwt-audience", "", "Required JWT audience (not checked if not set)")
+	flag.StringVar(&JWT.UserClaim, "jwt-user-claim", "sub", "JWT claim holding the user name")
+	flag.StringVar(&JWT.GroupsClaim, "jwt-groups-claim", "groups", "JWT claim holding the user groups")
+	flag.StringVar(&TrustedHeaders.UserHeader, "trusted-header", "X-Remote-User", "Header holding the user name (header authenticator)")
+	flag.StringVar(&TrustedHeaders.GroupsHeader, "trusted-groups-header", "X-Remote-Groups", "Header holding the comma separated user groups (header authenticator)")
+	flag.StringVar(&TrustedProxies, "trusted-proxies", "", "Comma separated CIDRs of the authenticating proxies (header authenticator)")
 	flag.Parse()
 }
 
@@ -135,22 +478,240 @@ func redirectLogsToFile(path string) (f *os.File, err error) {
 }
 
 func logPrint(r *http.Request, msg string) {
-	tokens := strings.Split(r.RemoteAddr, ":")
-	log.Println(fmt.Sprintf("%s \"%s %s %s\" %s", tokens[0], r.Method, r.URL.Path, r.Proto, msg))
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := clientIP(r); ip != nil {
+		host = ip.String()
+	}
+
+	user := "-"
+	if id, ok := aa.FromContext(r.Context()); ok {
+		user = id.User
+	}
+
+	log.Println(fmt.Sprintf("%s %s \"%s %s %s\" %s", host, user, r.Method, r.URL.Path, r.Proto, msg))
+}
+
+// clientIP returns the IP address of the client r originates from (see aa.ClientIP).
+func clientIP(r *http.Request) net.IP {
+	return aa.ClientIP(r, forwardedProxies, ForwardedHeader)
+}
+
+// initAuthStore initializes the store holding credentials, roles and authorizations:
+// either the DB store or the files given via command line flags, with the inline
+// variables as fallback. A new DB store is seeded from the latter.
+func initAuthStore() (s store.Store, err error) {
+	fs := &store.Files{Defaults: store.Data{
+		Credentials:    inlineCredentials,
+		Roles:          inlineRoles,
+		Authorizations: inlineAuthorizations,
+	}}
+	if !AllowAuthFromFiles {
+		return fs, nil
+	}
+
+	fs.CredentialsPath, fs.RolesPath, fs.AuthorizationsPath = CredentialsPath, RolesPath, AuthorizationsPath
+	if StorePath == "" {
+		return fs, nil
+	}
+
+	db, err := store.Open(StorePath)
+	if err != nil {
+		return
+	}
+
+	seed, err := fs.Load()
+	if err != nil {
+		return
+	}
+
+	err = db.UpdateVersion(0, func(d *store.Data) error {
+		*d = *seed
+		return nil
+	})
+	if err == store.ErrConflict {
+		err = nil
+	}
+
+	return db, err
+}
+
+// loadAuthData loads the credentials, roles and authorizations from authStore, as well as
+// the shadow authorizations and the Elasticsearch security rules (see loadSecurityRules).
+func loadAuthData() (err error) {
+	d, err := authStore.Load()
+	if err != nil {
+		return
+	}
+	d.Apply()
+	// Purged last, so no response cached under the old rules survives the reload.
+	defer purgeCache()
+
+	if !AllowAuthFromFiles || ShadowAuthorizationsPath == "" {
+		az.LoadShadowAuthorizations(az.AuthorizationStore(nil))
+	} else if err = az.LoadShadowAuthorizations(ShadowAuthorizationsPath); err != nil {
+		return
+	}
+
+	return loadSecurityRules()
+}
+
+// initLDAP enables the LDAP authentication backend, if configured.
+func initLDAP() (err error) {
+	if LDAP.URL == "" {
+		return aa.LoadLDAP(nil)
+	}
+
+	cfg := LDAP
+	if LDAPCAPath != "" {
+		pem, e := ioutil.ReadFile(LDAPCAPath)
+		if e != nil {
+			return e
+		}
+
+		cfg.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		if !cfg.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in " + LDAPCAPath)
+		}
+	}
+
+	if LDAPGroupsPath != "" {
+		f, e := os.Open(LDAPGroupsPath)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		if cfg.GroupRoles, err = aa.ReadRoles(f); err != nil {
+			return
+		}
+	}
+
+	return aa.LoadLDAP(&cfg)
+}
+
+// initMethods sets up the implied methods given via -implied-methods and validates
+// -method-override.
+func initMethods() error {
+	implied := map[string]string{}
+	for _, pair := range strings.Split(ImpliedMethods, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		tokens := strings.Split(pair, "=")
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return errors.New("Invalid implied method " + pair)
+		}
+
+		implied[strings.ToUpper(tokens[0])] = strings.ToUpper(tokens[1])
+	}
+	az.ImpliedMethods = implied
+
+	switch MethodOverride {
+	case "", "reject", "honor":
+		return nil
+	}
+
+	return errors.New("Unknown method override handling " + MethodOverride)
+}
+
+// initAuthorizer sets up the authorizers given via -authorizers.
+func initAuthorizer() error {
+	az.StripQueryParams = StripQueryParams
+	switch RuleStrategy {
+	case "":
+		az.RuleStrategy = az.FirstMatch
+	case az.FirstMatch, az.DenyOverrides:
+		az.RuleStrategy = RuleStrategy
+	default:
+		return errors.New("Unknown rule strategy " + RuleStrategy)
+	}
+
+	switch RuleSyntax {
+	case "":
+		az.RuleSyntax = az.RegexpSyntax
+	case az.RegexpSyntax, az.GlobSyntax:
+		az.RuleSyntax = RuleSyntax
+	default:
+		return errors.New("Unknown rule syntax " + RuleSyntax)
+	}
+
+	var all az.AllAuthorizers
+	for _, name := range strings.Split(Authorizers, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "rules":
+			all = append(all, az.RulesAuthorizer{})
+		case "callout":
+			if PDP.URL == "" {
+				return errors.New("The callout authorizer requires -pdp-url")
+			}
+
+			all = append(all, &az.CalloutAuthorizer{URL: PDP.URL, Timeout: PDP.Timeout, CacheTTL: PDP.CacheTTL, FailOpen: PDP.FailOpen})
+		default:
+			return errors.New("Unknown authorizer " + name)
+		}
+	}
+
+	if authorizer = all; len(all) == 1 {
+		authorizer = all[0]
+	}
+
+	return nil
 }
 
 func setup() (uri *url.URL, f *os.File, err error) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	if !AllowAuthFromFiles || CredentialsPath == "" {
-		aa.LoadCredentials(inlineCredentials)
-	} else if err = aa.LoadCredentials(CredentialsPath); err != nil {
+	if authStore, err = initAuthStore(); err != nil {
 		return
 	}
 
-	if !AllowAuthFromFiles || AuthorizationsPath == "" {
-		az.LoadAuthorizations(inlineAuthorizations)
-	} else if err = az.LoadAuthorizations(AuthorizationsPath); err != nil {
+	if err = loadAuthData(); err != nil {
+		return
+	}
+
+	if err = initLDAP(); err != nil {
+		return
+	}
+
+	if err = initAuthenticators(); err != nil {
+		return
+	}
+
+	if err = initAuthorizer(); err != nil {
+		return
+	}
+
+	if err = initMethods(); err != nil {
+		return
+	}
+
+	if forwardedProxies, err = aa.ParseCIDRs(ForwardedProxies); err != nil {
+		return
+	}
+
+	if h := http.CanonicalHeaderKey(ForwardedHeader); h != "X-Forwarded-For" && h != "Forwarded" {
+		err = errors.New("Invalid -forwarded-header " + ForwardedHeader)
+		return
+	}
+
+	if err = initSniffing(); err != nil {
+		return
+	}
+
+	if err = initBodyLimits(); err != nil {
+		return
+	}
+
+	if err = initQuotas(); err != nil {
+		return
+	}
+
+	if err = initCache(); err != nil {
 		return
 	}
 
@@ -166,6 +727,14 @@ func setup() (uri *url.URL, f *os.File, err error) {
 func main() {
 	processCmdLineFlags()
 
+	if QuotaReport {
+		if err := printQuotaReport(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	uri, f, err := setup()
 	if f != nil {
 		defer f.Close()
@@ -174,9 +743,43 @@ func main() {
 		log.Fatal(err)
 	}
 
-	reverseProxy := initReverseProxy(uri, wrapAuthorization, wrapAuthentication)
-	http.Handle("/", reverseProxy)
-	if err := http.ListenAndServe(FrontendURL, nil); err != nil {
-		log.Fatal(err)
+	if db, ok := authStore.(*store.DB); ok {
+		if d, err := db.Load(); err == nil {
+			go store.Watch(db, d.Version, StorePollInterval, func(d *store.Data) {
+				d.Apply()
+				purgeCache()
+				log.Println("Reloaded store", db.Path(), "at version", d.Version)
+			}, nil)
+		}
 	}
+
+	if quotaCounters != nil {
+		go saveQuotaUsage(quotaCounters, QuotaFlushInterval)
+	}
+
+	if AdminURL != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(AdminURL, initAdmin()))
+		}()
+	}
+
+	listeners := Listeners
+	if FrontendURL != "" {
+		listeners = append(listenersFlag{{Addr: FrontendURL, Chain: AuthChain, auth: authChain}}, listeners...)
+	}
+
+	if len(listeners) == 0 {
+		log.Fatal("No listeners configured")
+	}
+
+	// The proxy is served directly (rather than via http.DefaultServeMux) so that
+	// handlers registered there by imported packages (i.e. expvar) are not exposed.
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			errs <- serveListener(l, uri)
+		}(l)
+	}
+
+	log.Fatal(<-errs)
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	aa "github.com/alexaandru/elastic_guardian/authentication"
 	az "github.com/alexaandru/elastic_guardian/authorization"
 	"net/http"
@@ -14,9 +16,10 @@ type testCase struct {
 	url, header, body string
 }
 
-var foobar, foobogus, bazboo = base64.StdEncoding.EncodeToString([]byte("foo:bar")),
+var foobar, foobogus, bazboo, quxquux = base64.StdEncoding.EncodeToString([]byte("foo:bar")),
 	base64.StdEncoding.EncodeToString([]byte("foo:bogus")),
-	base64.StdEncoding.EncodeToString([]byte("baz:boo"))
+	base64.StdEncoding.EncodeToString([]byte("baz:boo")),
+	base64.StdEncoding.EncodeToString([]byte("qux:quux"))
 
 var testCases = map[string]testCase{
 	"request_authentication_if_blank": {"whatever", "", "401 Unauthorized\n"},
@@ -25,6 +28,8 @@ var testCases = map[string]testCase{
 	"fail_when_blacklisting_forbids":  {"/_cluster/health", "Basic " + foobar, "403 Forbidden (authorization)\n"},
 	"pass_when_whitelisting_allows":   {"/_cluster/health", "Basic " + bazboo, ""},
 	"fail_when_whitelisting_forbids":  {"/_cluster/stats", "Basic " + bazboo, "403 Forbidden (authorization)\n"},
+	"pass_when_role_allows":           {"/_cluster/health", "Basic " + quxquux, ""},
+	"fail_when_role_forbids":          {"/_cluster/stats", "Basic " + quxquux, "403 Forbidden (authorization)\n"},
 }
 
 func loadCredentials() {
@@ -41,6 +46,20 @@ func loadAuthorizations() {
 	})
 }
 
+// loadRoleTestData loads the credentials and authorizations, along with qux, who only
+// gets the rules of their role (readers).
+func loadRoleTestData() {
+	loadCredentials()
+	loadAuthorizations()
+
+	cs, as := aa.Credentials(), az.Authorizations()
+	cs["qux"] = aa.Hash("quux")
+	as["@readers"] = az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{"GET /_cluster/health"}}
+	aa.LoadCredentials(cs)
+	aa.LoadRoles(aa.RolesStore{"qux": {"readers"}})
+	az.LoadAuthorizations(as)
+}
+
 // Test wrappers
 func TestShouldRequestAuthenticationIfBlank(t *testing.T) {
 	assertPassesTestCase(t, testCases["request_authentication_if_blank"])
@@ -66,9 +85,179 @@ func TestShouldFailWhenWhitelistingForbids(t *testing.T) {
 	assertPassesTestCase(t, testCases["fail_when_whitelisting_forbids"])
 }
 
-func assertPassesTestCase(t *testing.T, tc testCase) {
+func TestShouldPassWhenRoleAllows(t *testing.T) {
+	assertPassesTestCase(t, testCases["pass_when_role_allows"])
+}
+
+func TestShouldFailWhenRoleForbids(t *testing.T) {
+	assertPassesTestCase(t, testCases["fail_when_role_forbids"])
+}
+
+func TestShadowPolicyDoesNotDecide(t *testing.T) {
+	az.LoadShadowAuthorizations(az.AuthorizationStore{
+		"foo": az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{}},
+		"baz": az.AuthorizationRules{DefaultRule: az.Allow, Rules: []string{}},
+	})
+	defer az.LoadShadowAuthorizations(az.AuthorizationStore(nil))
+	mismatches := az.ShadowMismatches()
+
+	assertPassesTestCase(t, testCases["pass_when_blacklisting_allows"])
+	assertPassesTestCase(t, testCases["fail_when_whitelisting_forbids"])
+
+	if az.ShadowMismatches()-mismatches != 2 {
+		t.Error("Expected 2 shadow mismatches, got", az.ShadowMismatches()-mismatches)
+	}
+}
+
+func TestCalloutAuthorizerDecides(t *testing.T) {
+	var indices []string
+	pdp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req az.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		indices = req.Indices
+		w.Write([]byte(`{"allow": ` + fmt.Sprint(req.User == "baz") + `}`))
+	}))
+	defer pdp.Close()
+
+	Authorizers, PDP.URL = "rules,callout", pdp.URL
+	defer func() { Authorizers, PDP.URL, authorizer = "", "", az.RulesAuthorizer{} }()
+	if err := initAuthorizer(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPassesTestCase(t, testCase{"/_cluster/health/logs", "Basic " + bazboo, ""})
+	if len(indices) != 1 || indices[0] != "logs" {
+		t.Error("The indices should have been passed to the callout, got", indices)
+	}
+
+	assertPassesTestCase(t, testCase{"/_cluster/stats", "Basic " + foobar, "403 Forbidden (authorization)\n"})
+
+	for _, bogus := range []string{"bogus", "callout"} {
+		Authorizers, PDP.URL = bogus, ""
+		if initAuthorizer() == nil {
+			t.Errorf("Authorizers %q should be rejected", bogus)
+		}
+	}
+
+	Authorizers, RuleStrategy = "rules", "bogus"
+	defer func() { RuleStrategy, RuleSyntax = "", "" }()
+	if initAuthorizer() == nil {
+		t.Error("Unknown rule strategies should be rejected")
+	}
+
+	if RuleStrategy, RuleSyntax = "", "bogus"; initAuthorizer() == nil {
+		t.Error("Unknown rule syntaxes should be rejected")
+	}
+}
+
+func TestNormalizationBeforeAuthorization(t *testing.T) {
+	var path string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+	}))
+	defer backend.Close()
+
 	loadCredentials()
 	loadAuthorizations()
+	uri, _ := url.Parse(backend.URL)
+	handler := initReverseProxy(uri, wrapAuthorization, wrapAuthentication, wrapNormalization)
+
+	for _, c := range []struct {
+		url, header string
+		code        int
+	}{
+		{"//_cluster/health", "Basic " + foobar, http.StatusForbidden},
+		{"/_cluster/./health", "Basic " + foobar, http.StatusForbidden},
+		{"/%5Fcluster/health/", "Basic " + foobar, http.StatusForbidden},
+		{"/_cluster%2Fhealth", "Basic " + foobar, http.StatusBadRequest},
+		{"/_cluster//health/", "Basic " + bazboo, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", c.url, nil)
+		req.Header.Set("Authorization", c.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != c.code {
+			t.Errorf("Expected %d for %s, got %d", c.code, c.url, recorder.Code)
+		}
+	}
+
+	if path != "/_cluster/health" {
+		t.Error("The normalized path should have been forwarded, got", path)
+	}
+}
+
+func TestStripQueryParams(t *testing.T) {
+	var query string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+	}))
+	defer backend.Close()
+
+	loadCredentials()
+	az.LoadAuthorizations(az.AuthorizationStore{"baz": az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{"GET /_search ?!refresh"}}})
+	StripQueryParams = true
+	defer func() { StripQueryParams = false; initAuthorizer() }()
+	initAuthorizer()
+
+	uri, _ := url.Parse(backend.URL)
+	handler := initReverseProxy(uri, wrapAuthorization, wrapAuthentication)
+	req, _ := http.NewRequest("GET", "/_search?refresh=true&size=1", nil)
+	req.Header.Set("Authorization", "Basic "+bazboo)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || query != "size=1" {
+		t.Error("Expected the refresh parameter to be stripped, got", recorder.Code, query)
+	}
+
+	req, _ = http.NewRequest("GET", "/_search?x=1;refresh=true", nil)
+	req.Header.Set("Authorization", "Basic "+bazboo)
+	recorder = httptest.NewRecorder()
+	if handler.ServeHTTP(recorder, req); recorder.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for an unparsable query, got", recorder.Code)
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	var method string
+	handler := wrapMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { method = r.Method }))
+	defer func() { MethodOverride = "" }()
+
+	for _, c := range []struct {
+		policy, override string
+		code             int
+		method           string
+	}{
+		{"reject", "DELETE", http.StatusBadRequest, ""},
+		{"reject", "", http.StatusOK, "POST"},
+		{"honor", "delete", http.StatusOK, "DELETE"},
+		{"honor", "DEL ETE", http.StatusBadRequest, ""},
+	} {
+		MethodOverride, method = c.policy, ""
+		req := httptest.NewRequest("POST", "/logs", nil)
+		if c.override != "" {
+			req.Header.Set("X-HTTP-Method-Override", c.override)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != c.code || method != c.method || req.Header.Get("X-HTTP-Method-Override") != "" && c.code == http.StatusOK {
+			t.Errorf("Expected %d %s for %s %s, got %d %s", c.code, c.method, c.policy, c.override, recorder.Code, method)
+		}
+	}
+
+	if ImpliedMethods = "HEAD"; initMethods() == nil {
+		t.Error("Invalid implied methods should be rejected")
+	}
+
+	if ImpliedMethods, MethodOverride = "HEAD=GET", "bogus"; initMethods() == nil {
+		t.Error("Unknown method override handling should be rejected")
+	}
+}
+
+func assertPassesTestCase(t *testing.T, tc testCase) {
+	loadRoleTestData()
 
 	uri, err := url.Parse("http://localhost:9000")
 	if err != nil {
@@ -102,6 +291,15 @@ func TestCmdLineFlagDefaults(t *testing.T) {
 		{"FrontendURL", FrontendURL, ":9600"},
 		{"Realm", Realm, "Elasticsearch"},
 		{"LogPath", LogPath, ""},
+		{"AdminRole", AdminRole, "admin"},
+		{"LDAP.GroupFilter", LDAP.GroupFilter, "(member=%s)"},
+		{"AuthChain", AuthChain, "static,ldap"},
+		{"MethodOverride", MethodOverride, "reject"},
+		{"RuleStrategy", RuleStrategy, "first-match"},
+		{"RuleSyntax", RuleSyntax, "regexp"},
+		{"MaxBodySize", MaxBodySize, ""},
+		{"CacheSize", CacheSize, "64mb"},
+		{"TrustedHeaders.UserHeader", TrustedHeaders.UserHeader, "X-Remote-User"},
 	}
 
 	for _, row := range assertions {
@@ -223,12 +421,36 @@ func TestSetupWithIncorrectURI(t *testing.T) {
 	}
 	BackendURL = ""
 
-	expected := "parse %BOGUS: invalid URL escape \"%BO\""
+	_, parseErr := url.Parse("%BOGUS")
+	expected := parseErr.Error()
+	if err == nil {
+		t.Error("Error should NOT be nil")
+	} else if err.Error() != expected {
+		t.Errorf("Expected %s error got %v", expected, err)
+	}
+}
+
+func TestSetupWithShadowAuthorizations(t *testing.T) {
+	CredentialsPath, AuthorizationsPath, LogPath = "", "", ""
+	ShadowAuthorizationsPath = "authorization/bogus/authorization_test.txt"
+	defer func() { ShadowAuthorizationsPath = "" }()
+
+	_, f, err := setup()
+	if f != nil {
+		defer f.Close()
+	}
+
+	expected := "open authorization/bogus/authorization_test.txt: no such file or directory"
 	if err == nil {
 		t.Error("Error should NOT be nil")
 	} else if err.Error() != expected {
 		t.Errorf("Expected %s error got %v", expected, err)
 	}
+
+	ShadowAuthorizationsPath = "authorization/authorization_test.txt"
+	if _, _, err = setup(); err != nil {
+		t.Error("Error should be nil, got", err)
+	}
 }
 
 func TestSetupWithIncorrectLogPath(t *testing.T) {
@@ -246,3 +468,39 @@ func TestSetupWithIncorrectLogPath(t *testing.T) {
 		t.Errorf("Expected %s error got %v", expected, err)
 	}
 }
+
+func TestClientIPRules(t *testing.T) {
+	vpn, _ := aa.ParseCIDRs("10.8.0.0/16")
+	az.LoadIPRules(az.IPRules{"baz": {Allow: vpn}})
+	defer az.LoadIPRules(az.IPRules(nil))
+
+	forwardedProxies, _ = aa.ParseCIDRs("127.0.0.1")
+	defer func() { forwardedProxies = nil }()
+
+	loadCredentials()
+	loadAuthorizations()
+	handler := wrapAuthentication(wrapAuthorization(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, c := range []struct {
+		remote, forwarded string
+		code              int
+	}{
+		{"10.8.1.1:1234", "", http.StatusOK},
+		{"192.168.1.1:1234", "", http.StatusForbidden},
+		{"192.168.1.1:1234", "10.8.1.1", http.StatusForbidden},
+		{"127.0.0.1:1234", "10.8.1.1", http.StatusOK},
+		{"127.0.0.1:1234", "192.168.1.1", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("GET", "/_cluster/health", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("Authorization", "Basic "+bazboo)
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != c.code {
+			t.Errorf("Expected %d for %s (%s), got %d", c.code, c.remote, c.forwarded, recorder.Code)
+		}
+	}
+}
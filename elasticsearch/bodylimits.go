@@ -0,0 +1,189 @@
+package elasticsearch
+
+import (
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BodyLimit holds the maximum request body size (in bytes, 0 standing for no limit) of
+// one user, role (as "@role") or everybody ("*"), for the request paths matching Path
+// (a regular expression, as in the authorization rules) or for all of them (when empty).
+type BodyLimit struct {
+	Name string
+	Max  int64
+	Path string
+
+	re *regexp.Regexp
+}
+
+// BodyLimits holds the request body size limits, in the order they were given.
+type BodyLimits []BodyLimit
+
+// bodyLimits holds the loaded body size limits.
+var bodyLimits BodyLimits
+
+// bodyLimitsMu guards bodyLimits.
+var bodyLimitsMu sync.RWMutex
+
+// sizeUnits maps the size suffixes to their multipliers.
+var sizeUnits = map[string]int64{"b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}
+
+// LoadBodyLimits loads the body size limits from backend: a BodyLimits variable, an
+// io.Reader or a file name (see ReadBodyLimits() for the format).
+func LoadBodyLimits(backend interface{}) (err error) {
+	var bl BodyLimits
+	switch v := backend.(type) {
+	case BodyLimits:
+		bl = v
+		for i := range bl {
+			if err = bl[i].compile(); err != nil {
+				return
+			}
+		}
+	case io.Reader:
+		bl, err = ReadBodyLimits(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		bl, err = ReadBodyLimits(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		bodyLimitsMu.Lock()
+		bodyLimits = bl
+		bodyLimitsMu.Unlock()
+	}
+
+	return
+}
+
+// ReadBodyLimits reads the body size limits from r. The file must have the format:
+//
+// 		name:size[:path]
+//
+// where name is "*" (for everybody), a user or a role (as "@role"), size is given in bytes
+// or with a b, kb, mb or gb suffix (see ParseSize) and path is a regular expression the
+// request paths are matched against, i.e.:
+//
+// 		*:10mb
+// 		*:100mb:/_bulk$
+// 		@shippers:1gb:/_bulk$
+func ReadBodyLimits(r io.Reader) (bl BodyLimits, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 3)
+		if len(tokens) < 2 || tokens[0] == "" {
+			return nil, errors.New("Invalid body limit line: " + line)
+		}
+
+		l := BodyLimit{Name: tokens[0]}
+		if l.Max, err = ParseSize(tokens[1]); err != nil {
+			return nil, err
+		}
+
+		if len(tokens) == 3 {
+			l.Path = tokens[2]
+		}
+
+		if err = l.compile(); err != nil {
+			return nil, err
+		}
+
+		bl = append(bl, l)
+	}
+
+	return
+}
+
+// ParseSize parses a size given in bytes, or with a b, kb, mb or gb suffix (i.e. "10mb").
+func ParseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := strings.TrimLeft(s, "0123456789")
+	multiplier, ok := sizeUnits[unit]
+	if unit == "" {
+		multiplier, ok = 1, true
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSuffix(s, unit), 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+func (l *BodyLimit) compile() (err error) {
+	if l.Path == "" {
+		l.re = nil
+	} else if l.re, err = regexp.Compile(l.Path); err != nil {
+		err = fmt.Errorf("Invalid body limit path for %s: %v", l.Name, err)
+	}
+
+	return
+}
+
+// limitOf returns the limit of name for path, if it has any: the first one given for a
+// matching path or, lacking that, the one given for all paths.
+func (bl BodyLimits) limitOf(name, path string) (max int64, ok bool) {
+	for _, l := range bl {
+		if l.Name != name {
+			continue
+		} else if l.re != nil && l.re.MatchString(path) {
+			return l.Max, true
+		} else if l.re == nil && !ok {
+			max, ok = l.Max, true
+		}
+	}
+
+	return
+}
+
+// BodyLimitFor returns the maximum body size (0 standing for no limit) of the requests of
+// id to path, if any was given. The user's own limit is used, if they have one. Otherwise,
+// the most permissive of the limits of their roles which have one applies and, lacking
+// those, the limit of everybody.
+func BodyLimitFor(id aa.Identity, path string) (max int64, ok bool) {
+	bodyLimitsMu.RLock()
+	bl := bodyLimits
+	bodyLimitsMu.RUnlock()
+
+	if max, ok = bl.limitOf(id.User, path); ok {
+		return
+	}
+
+	for _, group := range id.Groups {
+		if m, found := bl.limitOf("@"+group, path); !found {
+			continue
+		} else if !ok || m == 0 || max != 0 && m > max {
+			max, ok = m, true
+		}
+	}
+
+	if ok {
+		return
+	}
+
+	return bl.limitOf("*", path)
+}
@@ -0,0 +1,77 @@
+package elasticsearch
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"strings"
+	"testing"
+)
+
+const bodyLimitsTestData = `
+*:10mb
+*:100mb:/_bulk$
+@shippers:1gb:/_bulk$
+@shippers:20mb
+@loaders:0:/_bulk$
+bulky:2gb
+`
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"1024": 1024, "10b": 10, "1kb": 1 << 10, "10MB": 10 << 20, " 2gb ": 2 << 30, "0": 0} {
+		if n, err := ParseSize(s); err != nil || n != expected {
+			t.Errorf("Expected %d for %q, got %d (%v)", expected, s, n, err)
+		}
+	}
+
+	for _, bogus := range []string{"", "mb", "10tb", "-1", "1.5mb"} {
+		if _, err := ParseSize(bogus); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+}
+
+func TestReadBodyLimits(t *testing.T) {
+	bl, err := ReadBodyLimits(strings.NewReader(bodyLimitsTestData))
+	if err != nil || len(bl) != 6 || bl[1].Path != "/_bulk$" || bl[2].Max != 1<<30 {
+		t.Fatal("Unexpected limits", bl, err)
+	}
+
+	for _, bogus := range []string{"*", ":10mb", "*:lots", "*:10mb:/_bulk("} {
+		if _, err = ReadBodyLimits(strings.NewReader(bogus)); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+
+	if LoadBodyLimits(42) == nil || LoadBodyLimits("bogus.txt") == nil || LoadBodyLimits(BodyLimits{{Name: "*", Path: "("}}) == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestBodyLimitFor(t *testing.T) {
+	if _, ok := BodyLimitFor(aa.Identity{User: "foo"}, "/_bulk"); ok {
+		t.Error("Expected no limit without body limits")
+	}
+
+	if err := LoadBodyLimits(strings.NewReader(bodyLimitsTestData)); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadBodyLimits(BodyLimits(nil))
+
+	for _, c := range []struct {
+		user   string
+		groups []string
+		path   string
+		max    int64
+	}{
+		{"foo", nil, "/logs/_search", 10 << 20},
+		{"foo", nil, "/logs/_bulk", 100 << 20},
+		{"foo", []string{"shippers"}, "/logs/_bulk", 1 << 30},
+		{"foo", []string{"shippers"}, "/logs/_doc", 20 << 20},
+		{"foo", []string{"shippers", "loaders"}, "/_bulk", 0},
+		{"foo", []string{"loaders"}, "/logs/_doc", 10 << 20},
+		{"bulky", []string{"loaders"}, "/_bulk", 2 << 30},
+	} {
+		if max, ok := BodyLimitFor(aa.Identity{User: c.user, Groups: c.groups}, c.path); !ok || max != c.max {
+			t.Errorf("Expected %d for %s %v %s, got %d", c.max, c.user, c.groups, c.path, max)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CostLimits holds the query cost limits, by user or by role (under "@role" keys), i.e.:
+
+	{
+		"@analysts": {
+			"max_size": 1000,
+			"max_from": 10000,
+			"max_buckets": 5000,
+			"forbid": ["script", "regexp", "leading_wildcard"],
+			"timeout": "30s",
+			"clamp": true
+		}
+	}
+
+Searches asking for more hits (size, from) or aggregation buckets than allowed are rejected
+or, with clamp, clamped to the limits. The bucket limit applies to the size of each terms
+like aggregation, as well as to their product when nested. Forbidden query types (see
+forbiddableQueries) are always rejected, wherever a query may appear; script also forbids
+the scripts of score functions, fields, sorts and aggregations, while leading_wildcard
+stands for the wildcard queries starting with * or ?, and makes query_string queries
+disallow them. Sizes are taken as numbers or numeric strings. The timeout is injected
+into the searches which have none or a longer one.
+
+The user's own limits are used, if they have any. Otherwise, the most permissive of the
+limits of their roles which have some apply. Users without any limits are not restricted.
+*/
+type CostLimits map[string]CostLimit
+
+// CostLimit holds the query cost limits of one user or role (see CostLimits). Zero values
+// stand for no limit.
+type CostLimit struct {
+	MaxSize    int      `json:"max_size,omitempty"`
+	MaxFrom    int      `json:"max_from,omitempty"`
+	MaxBuckets int      `json:"max_buckets,omitempty"`
+	Forbid     []string `json:"forbid,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+	Clamp      bool     `json:"clamp,omitempty"`
+
+	timeout time.Duration
+}
+
+// costLimits holds the loaded cost limits.
+var costLimits CostLimits
+
+// costMu guards costLimits.
+var costMu sync.RWMutex
+
+// bucketAggregations lists the aggregations whose size is their number of buckets.
+var bucketAggregations = map[string]bool{
+	"terms": true, "multi_terms": true, "significant_terms": true, "composite": true, "rare_terms": true,
+}
+
+// forbiddableQueries lists the query types (and options) which can be forbidden.
+var forbiddableQueries = map[string]bool{
+	"script": true, "script_score": true, "function_score": true, "regexp": true, "wildcard": true,
+	"prefix": true, "fuzzy": true, "query_string": true, "simple_query_string": true,
+	"more_like_this": true, "percolate": true, "terms_set": true, "intervals": true, "span_multi": true,
+	"nested": true, "has_child": true, "has_parent": true, "geo_shape": true, "knn": true,
+	"leading_wildcard": true,
+}
+
+// LoadCostLimits loads the given cost limits (a CostLimits variable, an io.Reader or a
+// filename with their JSON representation) into the library.
+func LoadCostLimits(backend interface{}) (err error) {
+	var cl CostLimits
+	switch v := backend.(type) {
+	case CostLimits:
+		cl = v
+		for key, l := range cl {
+			if err = checkForbid(key, l.Forbid); err != nil {
+				return
+			} else if l.timeout, err = parseTimeout(l.Timeout); err != nil {
+				return fmt.Errorf("Invalid timeout for %s: %v", key, err)
+			}
+			cl[key] = l
+		}
+	case io.Reader:
+		cl, err = ReadCostLimits(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		cl, err = ReadCostLimits(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		costMu.Lock()
+		costLimits = cl
+		costMu.Unlock()
+	}
+
+	return
+}
+
+// ReadCostLimits reads (and validates) the JSON representation of CostLimits from r.
+func ReadCostLimits(r io.Reader) (cl CostLimits, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&cl); err != nil {
+		return nil, err
+	}
+
+	for key, l := range cl {
+		if l.MaxSize < 0 || l.MaxFrom < 0 || l.MaxBuckets < 0 {
+			return nil, errors.New("Invalid cost limits for " + key)
+		}
+
+		if err = checkForbid(key, l.Forbid); err != nil {
+			return nil, err
+		}
+
+		if l.timeout, err = parseTimeout(l.Timeout); err != nil {
+			return nil, fmt.Errorf("Invalid timeout for %s: %v", key, err)
+		}
+		cl[key] = l
+	}
+
+	return
+}
+
+// checkForbid checks that the forbidden query types of key are known ones.
+func checkForbid(key string, forbid []string) error {
+	for _, t := range forbid {
+		if !forbiddableQueries[t] {
+			return fmt.Errorf("Unknown forbidden query type %s for %s", t, key)
+		}
+	}
+
+	return nil
+}
+
+// CostLimitFor returns the cost limit applying to id, or nil if id is not restricted.
+func CostLimitFor(id aa.Identity) *CostLimit {
+	costMu.RLock()
+	cl := costLimits
+	costMu.RUnlock()
+
+	if l, ok := cl[id.User]; ok {
+		return &l
+	}
+
+	var limit *CostLimit
+	for _, group := range id.Groups {
+		if l, ok := cl["@"+group]; ok {
+			if limit == nil {
+				first := l
+				limit = &first
+			} else {
+				limit.relax(l)
+			}
+		}
+	}
+
+	return limit
+}
+
+// relax makes l the most permissive combination of itself and other.
+func (l *CostLimit) relax(other CostLimit) {
+	l.MaxSize, l.MaxFrom, l.MaxBuckets = looser(l.MaxSize, other.MaxSize), looser(l.MaxFrom, other.MaxFrom), looser(l.MaxBuckets, other.MaxBuckets)
+
+	var forbid []string
+	for _, t := range l.Forbid {
+		if hasString(other.Forbid, t) {
+			forbid = append(forbid, t)
+		}
+	}
+	l.Forbid = forbid
+
+	if l.timeout == 0 || other.timeout == 0 {
+		l.timeout, l.Timeout = 0, ""
+	} else if other.timeout > l.timeout {
+		l.timeout, l.Timeout = other.timeout, other.Timeout
+	}
+
+	l.Clamp = l.Clamp || other.Clamp
+}
+
+func looser(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	} else if a > b {
+		return a
+	}
+
+	return b
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTimeout parses an Elasticsearch time value (i.e. 30s, 1m, 500ms or 1d).
+func parseTimeout(value string) (time.Duration, error) {
+	switch {
+	case value == "":
+		return 0, nil
+	case strings.HasSuffix(value, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	case strings.HasSuffix(value, "nanos"):
+		value = strings.TrimSuffix(value, "nanos") + "ns"
+	case strings.HasSuffix(value, "micros"):
+		value = strings.TrimSuffix(value, "micros") + "us"
+	}
+
+	return time.ParseDuration(value)
+}
+
+// Enforce enforces l on the search request r: it clamps or rejects (with ErrUnsafeRequest)
+// the requests exceeding the limits and injects the timeout.
+func (l CostLimit) Enforce(r *http.Request) (err error) {
+	api, rest := API(r.URL.Path)
+	if !searchAPIs[api] || rest != "" {
+		return
+	}
+
+	query := r.URL.Query()
+	for _, param := range []string{"size", "from"} {
+		if value := query.Get(param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%w: invalid %s %s", ErrUnsafeRequest, param, value)
+			}
+
+			if clamped, err := l.limit(param, n); err != nil {
+				return err
+			} else if clamped != n {
+				query.Set(param, strconv.Itoa(clamped))
+			}
+		}
+	}
+
+	if l.timeout > 0 && api != "_count" {
+		query.Del("timeout")
+	}
+
+	if _, ok := query["q"]; ok && hasString(l.Forbid, "leading_wildcard") {
+		query.Set("allow_leading_wildcard", "false")
+	}
+	r.URL.RawQuery = query.Encode()
+
+	body, err := ReadBody(r)
+	if err != nil {
+		return
+	}
+
+	if api == "_msearch" {
+		var out bytes.Buffer
+		lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+		if len(lines)%2 != 0 {
+			return fmt.Errorf("%w: malformed multi search", ErrUnsafeRequest)
+		}
+
+		for i := 0; i < len(lines); i += 2 {
+			search, err := l.enforceBody(api, lines[i+1])
+			if err != nil {
+				return err
+			}
+
+			out.Write(lines[i])
+			out.WriteByte('\n')
+			out.Write(search)
+			out.WriteByte('\n')
+		}
+		body = out.Bytes()
+	} else if body, err = l.enforceBody(api, body); err != nil {
+		return
+	}
+
+	SetBody(r, body)
+
+	return
+}
+
+// limit checks n against the limit of param, returning it clamped if need be.
+func (l CostLimit) limit(param string, n int) (int, error) {
+	max := map[string]int{"size": l.MaxSize, "from": l.MaxFrom, "buckets": l.MaxBuckets}[param]
+	if max == 0 || n <= max {
+		return n, nil
+	} else if l.Clamp {
+		return max, nil
+	}
+
+	return n, fmt.Errorf("%w: %s %d exceeds the maximum of %d", ErrUnsafeRequest, param, n, max)
+}
+
+func (l CostLimit) enforceBody(api string, body []byte) ([]byte, error) {
+	search := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&search); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+	}
+
+	if err := l.checkQueries(search); err != nil {
+		return nil, err
+	}
+
+	for _, param := range []string{"size", "from"} {
+		if value, ok := search[param]; ok {
+			n, err := intValue(param, value)
+			if err != nil {
+				return nil, err
+			}
+
+			clamped, err := l.limit(param, n)
+			if err != nil {
+				return nil, err
+			}
+			search[param] = clamped
+		}
+	}
+
+	for _, key := range []string{"aggs", "aggregations"} {
+		if aggs, ok := search[key].(map[string]interface{}); ok {
+			if err := l.limitBuckets(aggs, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if l.timeout > 0 && api != "_count" {
+		if current, _ := search["timeout"].(string); current == "" || exceeds(current, l.timeout) {
+			search["timeout"] = l.Timeout
+		}
+	}
+
+	return json.Marshal(search)
+}
+
+// intValue returns the integer value of the body parameter param, which Elasticsearch takes
+// as a JSON number or a numeric string, or fails with ErrUnsafeRequest.
+func intValue(param string, value interface{}) (int, error) {
+	var n int64
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		n, err = v.Int64()
+	case string:
+		n, err = strconv.ParseInt(v, 10, 0)
+	default:
+		err = errors.New("not a number")
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %v", ErrUnsafeRequest, param, value)
+	}
+
+	return int(n), nil
+}
+
+func exceeds(value string, max time.Duration) bool {
+	d, err := parseTimeout(value)
+	return err != nil || d <= 0 || d > max
+}
+
+// limitBuckets limits the sizes of the bucket aggregations among aggs, which are nested in
+// aggregations whose sizes multiply to outer.
+func (l CostLimit) limitBuckets(aggs map[string]interface{}, outer int) error {
+	for name, agg := range aggs {
+		a, ok := agg.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: malformed aggregation %s", ErrUnsafeRequest, name)
+		}
+
+		buckets := outer
+		for kind, def := range a {
+			d, ok := def.(map[string]interface{})
+			if !ok || !bucketAggregations[kind] {
+				continue
+			}
+
+			size := 10
+			if value, ok := d["size"]; ok {
+				n, err := intValue("size", value)
+				if err != nil {
+					return err
+				}
+				size = n
+			}
+
+			clamped, err := l.limit("buckets", size)
+			if err != nil {
+				return err
+			} else if clamped != size {
+				d["size"] = clamped
+			}
+
+			buckets *= clamped
+			if l.MaxBuckets > 0 && buckets > l.MaxBuckets {
+				return fmt.Errorf("%w: nested aggregation %s may return %d buckets, exceeding the maximum of %d", ErrUnsafeRequest, name, buckets, l.MaxBuckets)
+			}
+		}
+
+		for _, key := range []string{"aggs", "aggregations"} {
+			if sub, ok := a[key].(map[string]interface{}); ok {
+				if err := l.limitBuckets(sub, buckets); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkQueries looks for forbidden query types among the query clauses of the search body
+// search (see walkSearch) and, when scripts are forbidden, for the scripts of its fields,
+// sorts and aggregations.
+func (l CostLimit) checkQueries(search map[string]interface{}) error {
+	if hasString(l.Forbid, "script") {
+		scriptSort := false
+		for _, sort := range asList(search["sort"]) {
+			if s, ok := sort.(map[string]interface{}); ok && s["_script"] != nil {
+				scriptSort = true
+			}
+		}
+
+		if search["script_fields"] != nil || search["runtime_mappings"] != nil || scriptSort {
+			return fmt.Errorf("%w: script queries are not allowed", ErrUnsafeRequest)
+		}
+	}
+
+	return walkSearch(search, l.checkQuery, func(kind string, params interface{}) error {
+		if hasString(l.Forbid, "script") && (kind == "scripted_metric" || len(findScripts(params, nil)) > 0) {
+			return fmt.Errorf("%w: script queries are not allowed", ErrUnsafeRequest)
+		}
+
+		return nil
+	})
+}
+
+// checkQuery fails with ErrUnsafeRequest for the forbidden query clauses (of type kind).
+func (l CostLimit) checkQuery(kind string, body interface{}) error {
+	if hasString(l.Forbid, kind) || kind == "script_score" && hasString(l.Forbid, "script") {
+		return fmt.Errorf("%w: %s queries are not allowed", ErrUnsafeRequest, kind)
+	}
+
+	if hasString(l.Forbid, "leading_wildcard") {
+		if kind == "wildcard" && hasLeadingWildcard(body) {
+			return fmt.Errorf("%w: leading wildcard queries are not allowed", ErrUnsafeRequest)
+		} else if q, ok := body.(map[string]interface{}); ok && kind == "query_string" {
+			q["allow_leading_wildcard"] = false
+		}
+	}
+
+	return nil
+}
+
+// hasLeadingWildcard determines if the wildcard query q has a pattern starting with * or ?.
+func hasLeadingWildcard(q interface{}) bool {
+	fields, _ := q.(map[string]interface{})
+	for _, value := range fields {
+		pattern, ok := value.(string)
+		if m, isMap := value.(map[string]interface{}); isMap {
+			if pattern, ok = m["value"].(string); !ok {
+				pattern, ok = m["wildcard"].(string)
+			}
+		}
+
+		if ok && strings.IndexAny(pattern, "*?") == 0 {
+			return true
+		}
+	}
+
+	return false
+}
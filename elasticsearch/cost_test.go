@@ -0,0 +1,106 @@
+package elasticsearch
+
+import (
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const costLimitsTestData = `{
+	"@analysts": {"max_size": 100, "max_from": 1000, "max_buckets": 500, "forbid": ["script", "regexp", "leading_wildcard"], "timeout": "30s"},
+	"@ops":      {"max_size": 500, "forbid": ["script"], "timeout": "1m", "clamp": true}
+}`
+
+func TestReadCostLimits(t *testing.T) {
+	for _, bogus := range []string{"[]", `{"a": {"max_size": -1}}`, `{"a": {"timeout": "soon"}}`, `{"a": {"bogus": 1}}`, `{"a": {"forbid": ["regex"]}}`} {
+		if _, err := ReadCostLimits(strings.NewReader(bogus)); err == nil {
+			t.Errorf("Limits %s should be rejected", bogus)
+		}
+	}
+
+	if LoadCostLimits(42) == nil || LoadCostLimits("bogus.json") == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestCostLimitFor(t *testing.T) {
+	if err := LoadCostLimits(strings.NewReader(costLimitsTestData)); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadCostLimits(CostLimits(nil))
+
+	if l := CostLimitFor(aa.Identity{User: "foo"}); l != nil {
+		t.Error("Expected no limits, got", l)
+	}
+
+	l := CostLimitFor(aa.Identity{User: "foo", Groups: []string{"analysts", "ops"}})
+	if l == nil || l.MaxSize != 500 || l.MaxFrom != 0 || l.MaxBuckets != 0 || len(l.Forbid) != 1 || l.timeout != time.Minute || !l.Clamp {
+		t.Error("Unexpected combined limits", l)
+	}
+
+	if l = CostLimitFor(aa.Identity{User: "foo", Groups: []string{"analysts"}}); l == nil || l.MaxSize != 100 || l.timeout != 30*time.Second {
+		t.Error("Unexpected limits", l)
+	}
+}
+
+func TestCostLimitEnforce(t *testing.T) {
+	LoadCostLimits(strings.NewReader(costLimitsTestData))
+	defer LoadCostLimits(CostLimits(nil))
+	reject := *CostLimitFor(aa.Identity{Groups: []string{"analysts"}})
+	clamp := reject
+	clamp.Clamp = true
+
+	cases := map[string]struct {
+		limit                      CostLimit
+		url, body, query, expected string
+	}{
+		"within limits": {reject, "/_search?size=10", `{"size":10,"timeout":"5s"}`, "size=10", `{"size":10,"timeout":"5s"}`},
+		"timeout":       {reject, "/_search?timeout=5m", `{}`, "", `{"timeout":"30s"}`},
+		"clamp":         {clamp, "/_search?size=1000", `{"from":5000,"size":1000,"timeout":"1h"}`, "size=100", `{"from":1000,"size":100,"timeout":"30s"}`},
+		"clamp buckets": {clamp, "/_search", `{"aggs":{"a":{"terms":{"field":"x","size":1000}}}}`, "", `{"aggs":{"a":{"terms":{"field":"x","size":500}}},"timeout":"30s"}`},
+		"query string":  {reject, "/_count?q=*x", `{"query":{"query_string":{"query":"*x"}}}`, "allow_leading_wildcard=false&q=%2Ax", `{"query":{"query_string":{"allow_leading_wildcard":false,"query":"*x"}}}`},
+		"not search":    {reject, "/logs/_doc/1?size=1000", `{"size":1000}`, "size=1000", `{"size":1000}`},
+		"string sizes":  {clamp, "/_search", `{"size":"1000","aggs":{"a":{"terms":{"field":"x","size":"1000"}}}}`, "", `{"aggs":{"a":{"terms":{"field":"x","size":500}}},"size":100,"timeout":"30s"}`},
+		"field names":   {reject, "/_search", `{"query":{"match":{"script":"x"}},"aggs":{"regexp":{"terms":{"field":"nested"}}}}`, "", `{"aggs":{"regexp":{"terms":{"field":"nested"}}},"query":{"match":{"script":"x"}},"timeout":"30s"}`},
+	}
+
+	for name, c := range cases {
+		req := searchReq("POST", c.url, c.body)
+		if err := c.limit.Enforce(req); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.RawQuery != c.query || string(body) != c.expected {
+			t.Errorf("%s: expected %s %s got %s %s", name, c.query, c.expected, req.URL.RawQuery, body)
+		}
+	}
+
+	for name, c := range map[string]struct {
+		limit     CostLimit
+		url, body string
+	}{
+		"size param":       {reject, "/_search?size=1000", ""},
+		"from":             {reject, "/_search", `{"from":1001}`},
+		"buckets":          {reject, "/_search", `{"aggs":{"a":{"composite":{"size":501}}}}`},
+		"nested buckets":   {clamp, "/_search", `{"aggs":{"a":{"terms":{"size":100},"aggs":{"b":{"terms":{"size":10}}}}}}`},
+		"script":           {clamp, "/_search", `{"query":{"bool":{"filter":[{"script":{}}]}}}`},
+		"regexp":           {reject, "/_msearch", "{}\n{\"query\":{\"regexp\":{\"f\":\"a.*\"}}}\n"},
+		"leading wildcard": {reject, "/_search", `{"query":{"wildcard":{"f":{"value":"*a"}}}}`},
+		"all indices":      {reject, "/_all/_search", `{"size":1000}`},
+		"string size":      {reject, "/_search", `{"size":"100000"}`},
+		"invalid size":     {reject, "/_search", `{"size":[1]}`},
+		"string buckets":   {reject, "/_search", `{"aggs":{"a":{"terms":{"size":"100000"}}}}`},
+		"function score":   {reject, "/_search", `{"query":{"function_score":{"functions":[{"script_score":{"script":"1"}}]}}}`},
+		"agg script":       {reject, "/_search", `{"aggs":{"a":{"terms":{"script":"doc['x'].value"}}}}`},
+		"script fields":    {reject, "/_search", `{"script_fields":{"a":{"script":"1"}}}`},
+	} {
+		if err := c.limit.Enforce(searchReq("POST", c.url, c.body)); !errors.Is(err, ErrUnsafeRequest) {
+			t.Errorf("%s: expected ErrUnsafeRequest got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKeepAlive is how long the scrolls and PITs are tracked for, when their keep alive
+// is not known.
+const defaultKeepAlive = 5 * time.Minute
+
+// asyncSearchKeepAlive is the default keep alive of the async searches (as in Elasticsearch).
+const asyncSearchKeepAlive = 5 * 24 * time.Hour
+
+// ErrNotOwner is returned for the requests continuing or deleting scrolls, PITs (point in
+// time) or async searches which were not created by the user making them (or whose keep
+// alive lapsed).
+var ErrNotOwner = errors.New("the scroll, point in time or async search was not created by you or has expired")
+
+// cursor holds the owner of a scroll, PIT or async search and when its keep alive lapses.
+type cursor struct {
+	user    string
+	expires time.Time
+}
+
+var cursors = struct {
+	sync.Mutex
+	owners map[string]cursor
+	swept  time.Time
+}{owners: map[string]cursor{}}
+
+// Cursors holds what a request does with the scrolls, PITs and async searches: the IDs it
+// continues (or gets) or deletes, the keep alive it asks for and whether its response may
+// hold new IDs.
+type Cursors struct {
+	IDs       []string
+	KeepAlive time.Duration
+	Opens     bool
+}
+
+// CursorsOf returns what the request r does with the scrolls, PITs and async searches, nil
+// if nothing. Clearing all the scrolls is refused, as they belong to several users.
+func CursorsOf(r *http.Request) (c *Cursors, err error) {
+	api, rest := API(r.URL.Path)
+	query := r.URL.Query()
+	c = &Cursors{}
+
+	switch {
+	case api == "_search" && (rest == "scroll" || strings.HasPrefix(rest, "scroll/")):
+		if c.KeepAlive, err = parseTimeout(query.Get("scroll")); err != nil {
+			return nil, fmt.Errorf("%w: invalid scroll %s", ErrUnsafeRequest, query.Get("scroll"))
+		}
+
+		c.Opens = r.Method != "DELETE"
+		c.IDs = splitIndices(strings.TrimPrefix(strings.TrimPrefix(rest, "scroll"), "/"))
+		if id := query.Get("scroll_id"); id != "" {
+			c.IDs = append(c.IDs, id)
+		}
+
+		var body struct {
+			ScrollID interface{} `json:"scroll_id"`
+			Scroll   string      `json:"scroll"`
+		}
+		if err = readCursorsBody(r, &body); err != nil {
+			return
+		}
+
+		switch id := body.ScrollID.(type) {
+		case string:
+			c.IDs = append(c.IDs, id)
+		case []interface{}:
+			for _, id := range id {
+				if id, ok := id.(string); ok {
+					c.IDs = append(c.IDs, id)
+				}
+			}
+		}
+
+		if body.Scroll != "" {
+			if c.KeepAlive, err = parseTimeout(body.Scroll); err != nil {
+				return nil, fmt.Errorf("%w: invalid scroll %s", ErrUnsafeRequest, body.Scroll)
+			}
+		}
+
+		for _, id := range c.IDs {
+			if id == "_all" {
+				return nil, errors.New("clearing all the scrolls is not allowed")
+			}
+		}
+	case api == "_search" && rest == "":
+		var body struct {
+			PIT *struct {
+				ID        string `json:"id"`
+				KeepAlive string `json:"keep_alive"`
+			} `json:"pit"`
+		}
+		if err = readCursorsBody(r, &body); err != nil {
+			return
+		}
+
+		if body.PIT != nil {
+			c.IDs, c.Opens = []string{body.PIT.ID}, true
+			if c.KeepAlive, err = parseTimeout(body.PIT.KeepAlive); err != nil {
+				return nil, fmt.Errorf("%w: invalid keep_alive %s", ErrUnsafeRequest, body.PIT.KeepAlive)
+			}
+		} else if scroll := query.Get("scroll"); scroll != "" {
+			c.Opens = true
+			if c.KeepAlive, err = parseTimeout(scroll); err != nil {
+				return nil, fmt.Errorf("%w: invalid scroll %s", ErrUnsafeRequest, scroll)
+			}
+		}
+	case api == "_async_search":
+		if rest != "" {
+			c.IDs = []string{strings.TrimPrefix(rest, "status/")}
+		}
+
+		c.Opens = rest == "" || r.Method == "GET" && !strings.HasPrefix(rest, "status/")
+		if c.KeepAlive, err = parseTimeout(query.Get("keep_alive")); err != nil {
+			return nil, fmt.Errorf("%w: invalid keep_alive %s", ErrUnsafeRequest, query.Get("keep_alive"))
+		} else if rest == "" && c.KeepAlive == 0 {
+			c.KeepAlive = asyncSearchKeepAlive
+		}
+	case api == "_pit" && r.Method == "DELETE":
+		var body struct {
+			ID string `json:"id"`
+		}
+		if err = readCursorsBody(r, &body); err != nil {
+			return
+		}
+		c.IDs = []string{body.ID}
+	case api == "_pit":
+		c.Opens = true
+		if c.KeepAlive, err = parseTimeout(query.Get("keep_alive")); err != nil {
+			return nil, fmt.Errorf("%w: invalid keep_alive %s", ErrUnsafeRequest, query.Get("keep_alive"))
+		}
+	}
+
+	if len(c.IDs) == 0 && !c.Opens {
+		return nil, nil
+	}
+
+	return
+}
+
+// readCursorsBody reads the JSON body of r (if any) into v.
+func readCursorsBody(r *http.Request, v interface{}) error {
+	body, err := ReadBody(r)
+	if err != nil || len(strings.TrimSpace(string(body))) == 0 {
+		return err
+	}
+
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+	}
+
+	return nil
+}
+
+// Check checks that all the IDs continued or deleted were created by user and did not
+// expire.
+func (c Cursors) Check(user string) error {
+	cursors.Lock()
+	defer cursors.Unlock()
+
+	now := time.Now()
+	for _, id := range c.IDs {
+		if owner, ok := cursors.owners[id]; !ok || owner.user != user || now.After(owner.expires) {
+			return ErrNotOwner
+		}
+	}
+
+	return nil
+}
+
+// Record records user as the owner of the scroll, PIT and async search IDs found in the
+// (JSON) response body, for the keep alive asked for. The IDs which were continued keep
+// their expiry when no keep alive was asked for.
+func (c Cursors) Record(user string, body []byte) error {
+	var resp struct {
+		ScrollID string `json:"_scroll_id"`
+		PITID    string `json:"pit_id"`
+		ID       string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+
+	cursors.Lock()
+	defer cursors.Unlock()
+
+	now := time.Now()
+	if now.Sub(cursors.swept) > time.Minute {
+		for id, owner := range cursors.owners {
+			if now.After(owner.expires) {
+				delete(cursors.owners, id)
+			}
+		}
+		cursors.swept = now
+	}
+
+	for _, id := range []string{resp.ScrollID, resp.PITID, resp.ID} {
+		if id == "" {
+			continue
+		}
+
+		expires := now.Add(c.KeepAlive)
+		if c.KeepAlive == 0 {
+			if owner, ok := cursors.owners[id]; ok && owner.user == user {
+				expires = owner.expires
+			} else {
+				expires = now.Add(defaultKeepAlive)
+			}
+		}
+
+		cursors.owners[id] = cursor{user: user, expires: expires}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package elasticsearch
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursorsOf(t *testing.T) {
+	cases := map[string]struct {
+		method, url, body string
+		ids               []string
+		keepAlive         time.Duration
+		opens             bool
+	}{
+		"scroll":         {"POST", "/logs/_search?scroll=1m", `{}`, nil, time.Minute, true},
+		"continue":       {"POST", "/_search/scroll", `{"scroll":"30s","scroll_id":"abc"}`, []string{"abc"}, 30 * time.Second, true},
+		"continue query": {"GET", "/_search/scroll?scroll_id=abc", "", []string{"abc"}, 0, true},
+		"clear":          {"DELETE", "/_search/scroll", `{"scroll_id":["abc","def"]}`, []string{"abc", "def"}, 0, false},
+		"clear path":     {"DELETE", "/_search/scroll/abc,def", "", []string{"abc", "def"}, 0, false},
+		"open pit":       {"POST", "/logs/_pit?keep_alive=1m", "", nil, time.Minute, true},
+		"search pit":     {"POST", "/_search", `{"pit":{"id":"p1","keep_alive":"2m"}}`, []string{"p1"}, 2 * time.Minute, true},
+		"close pit":      {"DELETE", "/_pit", `{"id":"p1"}`, []string{"p1"}, 0, false},
+		"async search":   {"POST", "/logs/_async_search", `{}`, nil, asyncSearchKeepAlive, true},
+		"async get":      {"GET", "/_async_search/a1?keep_alive=1m", "", []string{"a1"}, time.Minute, true},
+		"async status":   {"GET", "/_async_search/status/a1", "", []string{"a1"}, 0, false},
+		"async delete":   {"DELETE", "/_async_search/a1", "", []string{"a1"}, 0, false},
+	}
+
+	for name, c := range cases {
+		cur, err := CursorsOf(searchReq(c.method, c.url, c.body))
+		if err != nil || cur == nil {
+			t.Errorf("%s: unexpected %v %v", name, cur, err)
+			continue
+		}
+
+		if len(cur.IDs) != len(c.ids) || cur.KeepAlive != c.keepAlive || cur.Opens != c.opens {
+			t.Errorf("%s: unexpected %+v", name, cur)
+		}
+
+		for i, id := range c.ids {
+			if cur.IDs[i] != id {
+				t.Errorf("%s: expected %v got %v", name, c.ids, cur.IDs)
+			}
+		}
+	}
+
+	if cur, err := CursorsOf(searchReq("POST", "/logs/_search", `{}`)); cur != nil || err != nil {
+		t.Error("Plain searches should be left alone, got", cur, err)
+	}
+
+	if _, err := CursorsOf(searchReq("DELETE", "/_search/scroll/_all", "")); err == nil {
+		t.Error("Clearing all the scrolls should be refused")
+	}
+}
+
+func TestCursorsOwnership(t *testing.T) {
+	opened := Cursors{KeepAlive: time.Minute, Opens: true}
+	if err := opened.Record("foo", []byte(`{"_scroll_id":"s1","hits":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	opened.Record("foo", []byte(`{"id":"p1"}`))
+
+	if err := (Cursors{IDs: []string{"s1", "p1"}}).Check("foo"); err != nil {
+		t.Error("The owner should be allowed, got", err)
+	}
+
+	for user, ids := range map[string][]string{"baz": {"s1"}, "foo": {"s1", "unknown"}} {
+		if err := (Cursors{IDs: ids}).Check(user); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("Expected %v for %s %v, got %v", ErrNotOwner, user, ids, err)
+		}
+	}
+
+	(Cursors{KeepAlive: -time.Second}).Record("foo", []byte(`{"_scroll_id":"s2"}`))
+	if err := (Cursors{IDs: []string{"s2"}}).Check("foo"); err == nil {
+		t.Error("Expired scrolls should be refused")
+	}
+
+	if err := opened.Record("foo", []byte(`bogus`)); err == nil {
+		t.Error("Invalid responses should be reported")
+	}
+}
@@ -0,0 +1,374 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+DocumentFilters holds the document level security (DLS) filters, by user or by role
+(under "@role" keys, as for the authorization rules). A filter is an Elasticsearch query
+which the documents visible to the user must match, i.e.:
+
+	{
+		"@tenants": {"term": {"tenant_id": "{{attributes.tenant}}"}},
+		"foo":      {"terms": {"team": ["a", "b"]}}
+	}
+
+The filters may refer to the user as {{user}} and to their attributes (see aa.Identity)
+as {{attributes.name}}; the values are substituted as JSON strings contents.
+
+The user's own filter is used, if they have one. Otherwise, the filters of their roles
+which have one are combined: a document is visible if it matches any of them. Users
+without any filter are not restricted.
+*/
+type DocumentFilters map[string]json.RawMessage
+
+// documentFilters holds the loaded DLS filters.
+var documentFilters DocumentFilters
+
+// dlsMu guards documentFilters.
+var dlsMu sync.RWMutex
+
+// searchAPIs lists the APIs whose bodies get the DLS filter injected.
+var searchAPIs = map[string]bool{"_search": true, "_count": true, "_async_search": true, "_msearch": true}
+
+// unfilteredAPIs lists the APIs which do not read documents and are thus left alone: for
+// any method when true, or only for writes when false (bulk update actions excepted, see
+// checkBulkActions). Any other API, i.e. _update, reads documents which can not be filtered,
+// and is refused to the users having a DLS filter (or FLS rules, save for the document
+// reads FieldFilter.RestrictRequest() rewrites).
+var unfilteredAPIs = map[string]bool{
+	"": true, "_doc": false, "_create": false, "_bulk": false, "_mapping": true,
+	"_settings": true, "_alias": true, "_aliases": true, "_stats": true, "_refresh": true,
+	"_flush": true, "_forcemerge": true, "_open": true, "_close": true, "_rollover": true,
+	"_cat": true, "_cluster": true, "_nodes": true, "_tasks": true, "_pit": true, "_analyze": true,
+}
+
+// unsafeSearchKeys lists the search body keys which escape the query (and thus the filter).
+var unsafeSearchKeys = []string{"suggest", "knn"}
+
+// placeholderRE matches the placeholders of the DLS filters.
+var placeholderRE = regexp.MustCompile(`{{\s*([a-z]+)(?:\.([^}\s]+))?\s*}}`)
+
+// ErrUnsafeRequest is returned for the requests whose shape can not be safely restricted.
+var ErrUnsafeRequest = errors.New("request can not be safely restricted")
+
+// LoadDocumentFilters loads the given DLS filters (a DocumentFilters variable, an io.Reader
+// or a filename with their JSON representation) into the library.
+func LoadDocumentFilters(backend interface{}) (err error) {
+	var fs DocumentFilters
+	switch v := backend.(type) {
+	case DocumentFilters:
+		fs = v
+	case io.Reader:
+		fs, err = ReadDocumentFilters(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		fs, err = ReadDocumentFilters(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		dlsMu.Lock()
+		documentFilters = fs
+		dlsMu.Unlock()
+	}
+
+	return
+}
+
+// ReadDocumentFilters reads (and validates) the JSON representation of DocumentFilters from r.
+func ReadDocumentFilters(r io.Reader) (fs DocumentFilters, err error) {
+	if err = json.NewDecoder(r).Decode(&fs); err != nil {
+		return nil, err
+	}
+
+	for key, filter := range fs {
+		var query map[string]interface{}
+		if err = json.Unmarshal(filter, &query); err != nil || len(query) != 1 {
+			return nil, errors.New("Invalid document filter for " + key)
+		}
+	}
+
+	return
+}
+
+// DocumentFilter returns the DLS filter applying to id, with its placeholders replaced, or
+// nil if id is not restricted.
+func DocumentFilter(id aa.Identity) (filter json.RawMessage, err error) {
+	dlsMu.RLock()
+	fs := documentFilters
+	dlsMu.RUnlock()
+
+	var filters []json.RawMessage
+	if f, ok := fs[id.User]; ok {
+		filters = append(filters, f)
+	} else {
+		for _, group := range id.Groups {
+			if f, ok := fs["@"+group]; ok {
+				filters = append(filters, f)
+			}
+		}
+	}
+
+	for i, f := range filters {
+		if filters[i], err = expandFilter(f, id); err != nil {
+			return
+		}
+	}
+
+	switch len(filters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filters[0], nil
+	}
+
+	return json.Marshal(map[string]interface{}{"bool": map[string]interface{}{"should": filters, "minimum_should_match": 1}})
+}
+
+// expandFilter replaces the placeholders of filter with the values of id.
+func expandFilter(filter json.RawMessage, id aa.Identity) (json.RawMessage, error) {
+	var err error
+	expanded := placeholderRE.ReplaceAllFunc(filter, func(m []byte) []byte {
+		sub := placeholderRE.FindSubmatch(m)
+		value, ok := "", false
+		switch string(sub[1]) {
+		case "user":
+			value, ok = id.User, len(sub[2]) == 0
+		case "attributes":
+			value, ok = id.Attributes[string(sub[2])]
+		}
+
+		if !ok {
+			err = fmt.Errorf("no value for %s in the document filter of %s", m, id.User)
+			return m
+		}
+
+		raw, _ := json.Marshal(value)
+
+		return raw[1 : len(raw)-1]
+	})
+
+	return expanded, err
+}
+
+// RestrictSearch injects filter into the request r, when it is a search, or fails with
+// ErrUnsafeRequest for the requests which read documents but can not be restricted.
+func RestrictSearch(r *http.Request, filter json.RawMessage) (err error) {
+	api, rest := API(r.URL.Path)
+	if !searchAPIs[api] {
+		if anyMethod, ok := unfilteredAPIs[api]; !ok || !anyMethod && (r.Method == "GET" || r.Method == "HEAD") {
+			return fmt.Errorf("%w: %s is not available", ErrUnsafeRequest, api)
+		} else if api == "_bulk" {
+			return checkBulkActions(r)
+		}
+
+		return
+	}
+
+	switch {
+	case api == "_search" && rest == "scroll", api == "_async_search" && rest != "":
+		return // continuations of searches which were already restricted
+	case rest != "":
+		return fmt.Errorf("%w: %s/%s is not available", ErrUnsafeRequest, api, rest)
+	}
+
+	for _, param := range []string{"q", "source"} {
+		if _, ok := r.URL.Query()[param]; ok {
+			return fmt.Errorf("%w: the %s parameter is not supported", ErrUnsafeRequest, param)
+		}
+	}
+
+	body, err := ReadBody(r)
+	if err != nil {
+		return
+	}
+
+	if api == "_msearch" {
+		body, err = restrictMultiSearch(body, filter)
+	} else {
+		body, err = restrictSearchBody(body, filter)
+	}
+
+	if err == nil {
+		SetBody(r, body)
+	}
+
+	return
+}
+
+// checkBulkActions fails with ErrUnsafeRequest for the bulk request r if it has update
+// actions, which read the documents (and may return them).
+func checkBulkActions(r *http.Request) error {
+	body, err := ReadBody(r)
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		var action map[string]json.RawMessage
+		if err = json.Unmarshal(lines[i], &action); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+
+		if _, ok := action["update"]; ok {
+			return fmt.Errorf("%w: bulk updates are not available", ErrUnsafeRequest)
+		} else if _, ok := action["delete"]; !ok {
+			i++ // skip the document
+		}
+	}
+
+	return nil
+}
+
+// restrictSearchBody wraps the query of the search body in a bool query along with filter.
+func restrictSearchBody(body []byte, filter json.RawMessage) ([]byte, error) {
+	search := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &search); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+	}
+
+	for _, key := range unsafeSearchKeys {
+		if _, ok := search[key]; ok {
+			return nil, fmt.Errorf("%w: %s is not supported", ErrUnsafeRequest, key)
+		}
+	}
+
+	for _, key := range []string{"aggs", "aggregations"} {
+		if aggs, ok := search[key]; ok && hasGlobalAggregation(aggs) {
+			return nil, fmt.Errorf("%w: global aggregations are not supported", ErrUnsafeRequest)
+		}
+	}
+
+	query := search["query"]
+	if query == nil {
+		query = json.RawMessage(`{"match_all":{}}`)
+	}
+
+	restricted, err := json.Marshal(map[string]interface{}{
+		"bool": map[string]interface{}{"must": query, "filter": filter},
+	})
+	if err != nil {
+		return nil, err
+	}
+	search["query"] = restricted
+
+	return json.Marshal(search)
+}
+
+// restrictMultiSearch restricts every search of the multi search (NDJSON) body.
+func restrictMultiSearch(body []byte, filter json.RawMessage) ([]byte, error) {
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("%w: malformed multi search", ErrUnsafeRequest)
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(lines); i += 2 {
+		search, err := restrictSearchBody(lines[i+1], filter)
+		if err != nil {
+			return nil, err
+		}
+
+		out.Write(lines[i])
+		out.WriteByte('\n')
+		out.Write(search)
+		out.WriteByte('\n')
+	}
+
+	return out.Bytes(), nil
+}
+
+// hasGlobalAggregation determines if aggs (an aggregations object) contains a global
+// aggregation, at any level.
+func hasGlobalAggregation(aggs json.RawMessage) bool {
+	var named map[string]map[string]json.RawMessage
+	if json.Unmarshal(aggs, &named) != nil {
+		return true // can not tell, so assume the worst
+	}
+
+	for _, agg := range named {
+		if _, ok := agg["global"]; ok {
+			return true
+		}
+
+		for _, key := range []string{"aggs", "aggregations"} {
+			if sub, ok := agg[key]; ok && hasGlobalAggregation(sub) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// API returns the API (the first path segment starting with "_", save for the index
+// expressions such as _all, see IndexExpression()) the request to path is made to and the
+// remainder of the path following it.
+func API(path string) (api, rest string) {
+	segments := Segments(path)
+	for i, s := range segments {
+		if strings.HasPrefix(s, "_") && !(i == 0 && IndexExpression(s)) {
+			return s, strings.Join(segments[i+1:], "/")
+		}
+	}
+
+	return
+}
+
+// ReadBody reads (and then restores) the body of r. Compressed and non JSON bodies are
+// refused with ErrUnsafeRequest, as they can not be inspected.
+func ReadBody(r *http.Request) (body []byte, err error) {
+	if r.Body == nil {
+		return
+	}
+
+	if ce := r.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return nil, fmt.Errorf("%w: %s encoded bodies are not supported", ErrUnsafeRequest, ce)
+	}
+
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	r.Body.Close()
+
+	ct := r.Header.Get("Content-Type")
+	if len(bytes.TrimSpace(body)) > 0 && ct != "" && !strings.Contains(ct, "json") {
+		return nil, fmt.Errorf("%w: %s bodies are not supported", ErrUnsafeRequest, ct)
+	}
+
+	SetBody(r, body)
+
+	return
+}
+
+// SetBody replaces the body of r with body.
+func SetBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+}
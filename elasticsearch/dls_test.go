@@ -0,0 +1,154 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const filtersTestData = `{
+	"@tenants": {"term": {"tenant_id": "{{attributes.tenant}}"}},
+	"@teams":   {"term": {"team": "{{user}}"}},
+	"foo":      {"term": {"owner": "foo"}}
+}`
+
+func loadDocumentFilters(t *testing.T) {
+	if err := LoadDocumentFilters(strings.NewReader(filtersTestData)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func searchReq(method, url, body string) *http.Request {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	return req
+}
+
+func TestReadDocumentFilters(t *testing.T) {
+	for _, bogus := range []string{"[]", `{"foo": 1}`, `{"foo": {"a": {}, "b": {}}}`} {
+		if _, err := ReadDocumentFilters(strings.NewReader(bogus)); err == nil {
+			t.Errorf("Filters %s should be rejected", bogus)
+		}
+	}
+
+	if LoadDocumentFilters(42) == nil || LoadDocumentFilters("bogus.json") == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestDocumentFilter(t *testing.T) {
+	loadDocumentFilters(t)
+	defer LoadDocumentFilters(DocumentFilters(nil))
+
+	cases := map[string]struct {
+		id       aa.Identity
+		expected string
+	}{
+		"unrestricted": {aa.Identity{User: "bar", Groups: []string{"readers"}}, ""},
+		"own filter":   {aa.Identity{User: "foo", Groups: []string{"tenants"}}, `{"term": {"owner": "foo"}}`},
+		"role filter": {aa.Identity{User: "b\"az", Groups: []string{"teams"}},
+			`{"term": {"team": "b\"az"}}`},
+		"attribute": {aa.Identity{User: "qux", Groups: []string{"tenants"}, Attributes: map[string]string{"tenant": "acme"}},
+			`{"term": {"tenant_id": "acme"}}`},
+		"combined": {aa.Identity{User: "qux", Groups: []string{"tenants", "teams"}, Attributes: map[string]string{"tenant": "acme"}},
+			`{"bool":{"minimum_should_match":1,"should":[{"term":{"tenant_id":"acme"}},{"term":{"team":"qux"}}]}}`},
+	}
+
+	for name, c := range cases {
+		filter, err := DocumentFilter(c.id)
+		if err != nil || string(filter) != c.expected {
+			t.Errorf("%s: expected %s got %s (%v)", name, c.expected, filter, err)
+		}
+	}
+
+	if _, err := DocumentFilter(aa.Identity{User: "qux", Groups: []string{"tenants"}}); err == nil {
+		t.Error("Missing attributes should fail the filter")
+	}
+}
+
+func TestRestrictSearch(t *testing.T) {
+	filter := json.RawMessage(`{"term":{"tenant_id":"acme"}}`)
+	cases := map[string]struct {
+		req      *http.Request
+		expected string
+	}{
+		"search": {searchReq("POST", "/logs/_search", `{"query":{"match":{"msg":"x"}},"size":5}`),
+			`{"query":{"bool":{"filter":{"term":{"tenant_id":"acme"}},"must":{"match":{"msg":"x"}}}},"size":5}`},
+		"empty count": {searchReq("GET", "/_count", ""),
+			`{"query":{"bool":{"filter":{"term":{"tenant_id":"acme"}},"must":{"match_all":{}}}}}`},
+		"msearch": {searchReq("POST", "/_msearch", "{\"index\":\"a\"}\n{}\n{}\n{\"size\":1}\n"),
+			"{\"index\":\"a\"}\n{\"query\":{\"bool\":{\"filter\":{\"term\":{\"tenant_id\":\"acme\"}},\"must\":{\"match_all\":{}}}}}\n" +
+				"{}\n{\"query\":{\"bool\":{\"filter\":{\"term\":{\"tenant_id\":\"acme\"}},\"must\":{\"match_all\":{}}}},\"size\":1}\n"},
+		"scroll":      {searchReq("POST", "/_search/scroll", `{"scroll_id":"x"}`), `{"scroll_id":"x"}`},
+		"not search":  {searchReq("PUT", "/logs/_doc/1", `{"a":1}`), `{"a":1}`},
+		"async fetch": {searchReq("GET", "/_async_search/abc", ""), ""},
+		"all search": {searchReq("POST", "/_all/_search", `{}`),
+			`{"query":{"bool":{"filter":{"term":{"tenant_id":"acme"}},"must":{"match_all":{}}}}}`},
+		"bulk": {searchReq("POST", "/_bulk", "{\"index\":{\"_index\":\"logs\"}}\n{\"update\":1}\n{\"delete\":{\"_id\":\"1\"}}\n"),
+			"{\"index\":{\"_index\":\"logs\"}}\n{\"update\":1}\n{\"delete\":{\"_id\":\"1\"}}\n"},
+	}
+
+	for name, c := range cases {
+		if err := RestrictSearch(c.req, filter); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(c.req.Body)
+		if string(body) != c.expected {
+			t.Errorf("%s: expected %s got %s", name, c.expected, body)
+		} else if c.req.ContentLength != int64(len(body)) {
+			t.Errorf("%s: content length not updated", name)
+		}
+	}
+}
+
+func TestRestrictSearchRejectsUnsafeRequests(t *testing.T) {
+	gzipped := searchReq("POST", "/_search", "xxx")
+	gzipped.Header.Set("Content-Encoding", "gzip")
+
+	for name, req := range map[string]*http.Request{
+		"doc get":        searchReq("GET", "/logs/_doc/1", ""),
+		"mget":           searchReq("POST", "/_mget", `{"ids":["1"]}`),
+		"template":       searchReq("POST", "/_search/template", `{"id":"x"}`),
+		"q param":        searchReq("GET", "/_search?q=foo", ""),
+		"source param":   searchReq("GET", "/_search?source={}", ""),
+		"suggest":        searchReq("POST", "/_search", `{"suggest":{}}`),
+		"global agg":     searchReq("POST", "/_search", `{"aggs":{"a":{"terms":{"field":"x"},"aggs":{"b":{"global":{}}}}}}`),
+		"not json":       searchReq("POST", "/_search", "not json"),
+		"odd msearch":    searchReq("POST", "/_msearch", "{}\n"),
+		"gzipped":        gzipped,
+		"by query":       searchReq("POST", "/logs/_delete_by_query", `{}`),
+		"unsafe msearch": searchReq("POST", "/_msearch", "{}\n{\"knn\":{}}\n"),
+		"all doc get":    searchReq("GET", "/_all/_doc/1", ""),
+		"all mget":       searchReq("POST", "/_all/_mget", `{"ids":["1"]}`),
+		"unknown api":    searchReq("POST", "/logs/_query", `{}`),
+		"update":         searchReq("POST", "/logs/_update/1", `{"doc":{"a":1},"_source":true}`),
+		"bulk update":    searchReq("POST", "/_bulk", "{\"index\":{}}\n{}\n{\"update\":{\"_id\":\"1\"}}\n{\"doc\":{}}\n"),
+	} {
+		if err := RestrictSearch(req, json.RawMessage(`{"match_all":{}}`)); !errors.Is(err, ErrUnsafeRequest) {
+			t.Errorf("%s: expected ErrUnsafeRequest got %v", name, err)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	for path, expected := range map[string][2]string{
+		"/":                     {"", ""},
+		"/logs":                 {"", ""},
+		"/logs/_search":         {"_search", ""},
+		"/_search/scroll":       {"_search", "scroll"},
+		"/logs/_doc/1":          {"_doc", "1"},
+		"/_cluster/health/logs": {"_cluster", "health/logs"},
+		"/_all":                 {"", ""},
+		"/_all/_search":         {"_search", ""},
+		"/_all,-logs/_doc/1":    {"_doc", "1"},
+	} {
+		if api, rest := API(path); api != expected[0] || rest != expected[1] {
+			t.Errorf("Expected %v for %s got %s %s", expected, path, api, rest)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Package elasticsearch holds the Elasticsearch specific knowledge of the guardian, i.e.
+which indices a request targets.
+
+The rest of the guardian treats the backend as a generic HTTP API; this package is
+what lets authorization and the request/response rewriting reason about Elasticsearch
+requests.
+*/
+package elasticsearch
+
+import (
+	"strings"
+)
+
+// indexedAPIs lists the APIs which take the target indices after their own name, as
+// in /_cat/indices/{index}, rather than as the first path segment.
+var indexedAPIs = map[string]int{
+	"_cat/aliases":    2,
+	"_cat/count":      2,
+	"_cat/indices":    2,
+	"_cat/recovery":   2,
+	"_cat/segments":   2,
+	"_cat/shards":     2,
+	"_cluster/health": 2,
+	"_cluster/state":  3,
+}
+
+// Indices returns the index expressions (names, aliases, patterns) the request to path
+// targets, as given in its path. It returns nil for the requests targeting no index in
+// particular (i.e. /_search, which targets all of them, or /_nodes).
+func Indices(path string) []string {
+	segments := Segments(path)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	if !strings.HasPrefix(segments[0], "_") {
+		return splitIndices(segments[0])
+	}
+
+	for api, pos := range indexedAPIs {
+		prefix := strings.Split(api, "/")
+		if len(segments) > pos && hasPrefix(segments, prefix) {
+			return splitIndices(segments[pos])
+		}
+	}
+
+	return nil
+}
+
+// IndexExpression determines if the first path segment s is an index expression, even
+// though it starts with "_" as the APIs do (i.e. _all or _all,-logs).
+func IndexExpression(s string) bool {
+	return s == "_all" || strings.ContainsAny(s, ",*")
+}
+
+// Segments splits path into its (non empty) segments.
+func Segments(path string) (segments []string) {
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	return
+}
+
+func hasPrefix(segments, prefix []string) bool {
+	if len(segments) < len(prefix) {
+		return false
+	}
+
+	for i, p := range prefix {
+		if segments[i] != p {
+			return false
+		}
+	}
+
+	return true
+}
+
+func splitIndices(expr string) (indices []string) {
+	for _, index := range strings.Split(expr, ",") {
+		if index != "" {
+			indices = append(indices, index)
+		}
+	}
+
+	return
+}
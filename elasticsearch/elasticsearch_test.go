@@ -0,0 +1,26 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndices(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"/":                                nil,
+		"/_search":                         nil,
+		"/_nodes/stats":                    nil,
+		"/logs-2016/_search":               {"logs-2016"},
+		"/logs-*,-logs-old,metrics/_count": {"logs-*", "-logs-old", "metrics"},
+		"//logs//_doc/1":                   {"logs"},
+		"/_cat/indices":                    nil,
+		"/_cat/indices/logs*":              {"logs*"},
+		"/_cluster/health/a,b":             {"a", "b"},
+		"/_cluster/state/metadata/a":       {"a"},
+		"/_stats/docs":                     nil,
+	} {
+		if actual := Indices(path); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v for %s got %v", expected, path, actual)
+		}
+	}
+}
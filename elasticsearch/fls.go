@@ -0,0 +1,624 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+/*
+FieldRules holds the field level security (FLS) rules, by user or by role (under "@role"
+keys), each being a list of allowed and/or a list of denied fields, i.e.:
+
+	{
+		"@support":  {"deny": ["email", "ssn", "customer.*"]},
+		"@analysts": {"allow": ["@timestamp", "message", "geo"]}
+	}
+
+Fields are given by their full (dotted) names and may contain "*" wildcards; a rule for
+an object field applies to all the fields within it. A field is visible when it is allowed
+(or there is no allow list) and it is not denied. The searches querying, aggregating,
+sorting or highlighting on hidden fields, as well as those using scripts or suggesters,
+are refused.
+
+The user's own rules are used, if they have any. Otherwise, the rules of their roles which
+have some are combined: a field is visible if any of them makes it visible. Users without
+any rules are not restricted.
+*/
+type FieldRules map[string]FieldPolicy
+
+// FieldPolicy holds the allowed and denied fields of one user or role (see FieldRules).
+type FieldPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// FieldFilter holds the field policies applying to one user.
+type FieldFilter []FieldPolicy
+
+// fieldRules holds the loaded FLS rules.
+var fieldRules FieldRules
+
+// flsMu guards fieldRules.
+var flsMu sync.RWMutex
+
+// fieldListKeys lists the search body keys (and query parameters) holding lists of
+// fields to return.
+var fieldListKeys = []string{"stored_fields", "docvalue_fields", "fields"}
+
+// scriptingKeys lists the search body keys which give scripts access to all the fields, or
+// which return terms of any field (suggest).
+var scriptingKeys = []string{"script_fields", "runtime_mappings", "suggest"}
+
+// fieldKeyedQueries lists the query types (and score functions) whose bodies are keyed by
+// the field they apply to.
+var fieldKeyedQueries = map[string]bool{
+	"term": true, "terms": true, "terms_set": true, "prefix": true, "range": true, "wildcard": true,
+	"regexp": true, "fuzzy": true, "match": true, "match_phrase": true, "match_phrase_prefix": true,
+	"match_bool_prefix": true, "span_term": true, "intervals": true, "geo_distance": true,
+	"geo_bounding_box": true, "geo_polygon": true, "geo_shape": true, "shape": true, "gauss": true,
+	"linear": true, "exp": true,
+}
+
+// queryOptions lists the options found among the fields of the field keyed queries.
+var queryOptions = map[string]bool{
+	"boost": true, "_name": true, "distance": true, "distance_type": true, "validation_method": true,
+	"ignore_unmapped": true, "type": true, "multi_value_mode": true,
+}
+
+// fieldListQueries lists the query types which search the fields listed under their fields
+// key or, when there is none, all the fields.
+var fieldListQueries = map[string]bool{
+	"multi_match": true, "simple_query_string": true, "more_like_this": true, "combined_fields": true,
+}
+
+// LoadFieldRules loads the given FLS rules (a FieldRules variable, an io.Reader or a
+// filename with their JSON representation) into the library.
+func LoadFieldRules(backend interface{}) (err error) {
+	var fr FieldRules
+	switch v := backend.(type) {
+	case FieldRules:
+		fr = v
+	case io.Reader:
+		fr, err = ReadFieldRules(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		fr, err = ReadFieldRules(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		flsMu.Lock()
+		fieldRules = fr
+		flsMu.Unlock()
+	}
+
+	return
+}
+
+// ReadFieldRules reads (and validates) the JSON representation of FieldRules from r.
+func ReadFieldRules(r io.Reader) (fr FieldRules, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&fr); err != nil {
+		return nil, err
+	}
+
+	for key, p := range fr {
+		if len(p.Allow) == 0 && len(p.Deny) == 0 {
+			return nil, errors.New("Empty field rules for " + key)
+		}
+
+		for _, field := range append(append([]string(nil), p.Allow...), p.Deny...) {
+			if _, err = path.Match(field, ""); err != nil || field == "" {
+				return nil, errors.New("Invalid field " + field + " for " + key)
+			}
+		}
+	}
+
+	return
+}
+
+// FieldFilterFor returns the FieldFilter applying to id, or nil if id is not restricted.
+func FieldFilterFor(id aa.Identity) (ff FieldFilter) {
+	flsMu.RLock()
+	fr := fieldRules
+	flsMu.RUnlock()
+
+	if p, ok := fr[id.User]; ok {
+		return FieldFilter{p}
+	}
+
+	for _, group := range id.Groups {
+		if p, ok := fr["@"+group]; ok {
+			ff = append(ff, p)
+		}
+	}
+
+	return
+}
+
+// Visible determines if field (given by its full name) is visible according to ff.
+func (ff FieldFilter) Visible(field string) bool {
+	for _, p := range ff {
+		if p.visible(field) {
+			return true
+		}
+	}
+
+	return len(ff) == 0
+}
+
+func (p FieldPolicy) visible(field string) bool {
+	return (len(p.Allow) == 0 || matchesField(p.Allow, field)) && !matchesField(p.Deny, field)
+}
+
+// matchesField determines if any of patterns matches field or any of the objects it is in.
+func matchesField(patterns []string, field string) bool {
+	for name := field; name != ""; {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+
+	return false
+}
+
+// RestrictRequest rewrites the search and get request r so that it only asks for the fields
+// visible according to ff, or fails with ErrUnsafeRequest for the requests which could
+// reveal other fields.
+func (ff FieldFilter) RestrictRequest(r *http.Request) (err error) {
+	api, rest := API(r.URL.Path)
+	if api == "_search" && rest == "scroll" || api == "_async_search" && rest != "" {
+		return // continuations of searches which were already restricted
+	}
+
+	switch {
+	case api == "_count":
+		body, err := ReadBody(r)
+		if err != nil {
+			return err
+		}
+
+		search := map[string]interface{}{}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err = json.Unmarshal(body, &search); err != nil {
+				return fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+			}
+		}
+
+		return ff.checkSearch(search)
+	case api == "_msearch":
+	case api == "_search", api == "_async_search", api == "_mget":
+	case (api == "_doc" || api == "_source") && (r.Method == "GET" || r.Method == "HEAD"):
+	default:
+		if anyMethod, ok := unfilteredAPIs[api]; !ok || !anyMethod && (r.Method == "GET" || r.Method == "HEAD") {
+			return fmt.Errorf("%w: %s is not available", ErrUnsafeRequest, api)
+		} else if api == "_bulk" {
+			return checkBulkActions(r)
+		}
+
+		return
+	}
+
+	query := r.URL.Query()
+	for _, param := range []string{"q", "source"} {
+		if _, ok := query[param]; ok && searchAPIs[api] {
+			return fmt.Errorf("%w: the %s parameter is not supported", ErrUnsafeRequest, param)
+		}
+	}
+
+	if api != "_msearch" {
+		for _, param := range fieldListKeys {
+			if values, ok := query[param]; ok {
+				query.Set(param, strings.Join(ff.visibleFields(strings.Split(strings.Join(values, ","), ",")), ","))
+			}
+		}
+
+		if len(ff) == 1 {
+			if len(ff[0].Allow) > 0 && query.Get("_source_includes") == "" && query.Get("_source") == "" {
+				query.Set("_source_includes", strings.Join(ff[0].Allow, ","))
+			}
+			if len(ff[0].Deny) > 0 {
+				query.Set("_source_excludes", strings.Trim(query.Get("_source_excludes")+","+strings.Join(ff[0].Deny, ","), ","))
+			}
+		}
+		r.URL.RawQuery = query.Encode()
+	}
+
+	if !searchAPIs[api] {
+		return
+	}
+
+	body, err := ReadBody(r)
+	if err != nil {
+		return
+	}
+
+	if api == "_msearch" {
+		var out bytes.Buffer
+		lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+		if len(lines)%2 != 0 {
+			return fmt.Errorf("%w: malformed multi search", ErrUnsafeRequest)
+		}
+
+		for i := 0; i < len(lines); i += 2 {
+			search, err := ff.restrictSearchBody(lines[i+1])
+			if err != nil {
+				return err
+			}
+
+			out.Write(lines[i])
+			out.WriteByte('\n')
+			out.Write(search)
+			out.WriteByte('\n')
+		}
+		body = out.Bytes()
+	} else if body, err = ff.restrictSearchBody(body); err != nil {
+		return
+	}
+
+	SetBody(r, body)
+
+	return
+}
+
+// restrictSearchBody rewrites the search body so that it only asks for visible fields.
+func (ff FieldFilter) restrictSearchBody(body []byte) ([]byte, error) {
+	search := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &search); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+	}
+
+	if err := ff.checkSearch(search); err != nil {
+		return nil, err
+	}
+
+	for _, key := range fieldListKeys {
+		if list, ok := search[key].([]interface{}); ok {
+			search[key] = ff.visibleFieldEntries(list)
+		}
+	}
+
+	if len(ff) == 1 {
+		search["_source"] = ff[0].restrictSource(search["_source"])
+	}
+
+	return json.Marshal(search)
+}
+
+// checkSearch fails with ErrUnsafeRequest for the searches which could reveal the fields
+// which are not visible: through scripts, suggesters, or through the queries, aggregations,
+// sorts and highlights on them.
+func (ff FieldFilter) checkSearch(search map[string]interface{}) error {
+	for _, key := range scriptingKeys {
+		if _, ok := search[key]; ok {
+			return fmt.Errorf("%w: %s is not supported", ErrUnsafeRequest, key)
+		}
+	}
+
+	for _, key := range []string{"collapse", "highlight"} {
+		if field, ok := ff.deniedFieldIn(search[key]); ok {
+			return fmt.Errorf("%w: %s on field %s", ErrUnsafeRequest, key, field)
+		}
+	}
+
+	if field, ok := ff.deniedSortField(search["sort"]); ok {
+		return fmt.Errorf("%w: sort on field %s", ErrUnsafeRequest, field)
+	}
+
+	return walkSearch(search, ff.checkQuery, ff.checkAggregation)
+}
+
+// checkQuery fails with ErrUnsafeRequest for the query clauses (of type kind) on fields
+// which are not visible, or on fields which can not be told (query_string, scripts).
+func (ff FieldFilter) checkQuery(kind string, body interface{}) error {
+	b, _ := body.(map[string]interface{})
+	switch {
+	case kind == "query_string", kind == "script", kind == "script_score":
+		return fmt.Errorf("%w: %s queries are not supported", ErrUnsafeRequest, kind)
+	case fieldKeyedQueries[kind]:
+		for field := range b {
+			if !queryOptions[field] && len(ff.visibleFields([]string{field})) == 0 {
+				return fmt.Errorf("%w: %s query on field %s", ErrUnsafeRequest, kind, field)
+			}
+		}
+	case fieldListQueries[kind]:
+		fields, ok := b["fields"].([]interface{})
+		if !ok {
+			return fmt.Errorf("%w: %s queries must list their fields", ErrUnsafeRequest, kind)
+		}
+
+		for _, f := range fields {
+			field, _ := f.(string)
+			if field = strings.SplitN(field, "^", 2)[0]; len(ff.visibleFields([]string{field})) == 0 {
+				return fmt.Errorf("%w: %s query on field %s", ErrUnsafeRequest, kind, field)
+			}
+		}
+	}
+
+	if field, ok := ff.deniedFieldIn(body); ok {
+		return fmt.Errorf("%w: %s query on field %s", ErrUnsafeRequest, kind, field)
+	}
+
+	return nil
+}
+
+// checkAggregation fails with ErrUnsafeRequest for the aggregations (of type kind) on fields
+// which are not visible, or running scripts.
+func (ff FieldFilter) checkAggregation(kind string, params interface{}) error {
+	if kind == "scripted_metric" || len(findScripts(params, nil)) > 0 {
+		return fmt.Errorf("%w: scripts in aggregations are not supported", ErrUnsafeRequest)
+	}
+
+	if field, ok := ff.deniedFieldIn(params); ok {
+		return fmt.Errorf("%w: %s aggregation on field %s", ErrUnsafeRequest, kind, field)
+	}
+
+	if p, ok := params.(map[string]interface{}); ok {
+		if field, ok := ff.deniedSortField(p["sort"]); ok {
+			return fmt.Errorf("%w: %s aggregation sorted on field %s", ErrUnsafeRequest, kind, field)
+		}
+	}
+
+	return nil
+}
+
+// restrictSource rewrites the _source option of a search so that it excludes the denied fields
+// and, unless it already asks for specific fields, only includes the allowed ones.
+func (p FieldPolicy) restrictSource(source interface{}) interface{} {
+	var includes, excludes []interface{}
+	switch v := source.(type) {
+	case bool:
+		if !v {
+			return false
+		}
+	case string:
+		includes = []interface{}{v}
+	case []interface{}:
+		includes = v
+	case map[string]interface{}:
+		for _, key := range []string{"includes", "include"} {
+			includes = append(includes, fieldList(v[key])...)
+		}
+		for _, key := range []string{"excludes", "exclude"} {
+			excludes = append(excludes, fieldList(v[key])...)
+		}
+	}
+
+	if len(includes) == 0 {
+		for _, field := range p.Allow {
+			includes = append(includes, field)
+		}
+	}
+
+	for _, field := range p.Deny {
+		excludes = append(excludes, field)
+	}
+
+	restricted := map[string]interface{}{}
+	if len(includes) > 0 {
+		restricted["includes"] = includes
+	}
+	if len(excludes) > 0 {
+		restricted["excludes"] = excludes
+	}
+
+	return restricted
+}
+
+func fieldList(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case string:
+		return []interface{}{v}
+	case []interface{}:
+		return v
+	}
+
+	return nil
+}
+
+// visibleFields returns the visible fields among fields. Wildcard patterns are dropped, as
+// they may match denied fields.
+func (ff FieldFilter) visibleFields(fields []string) (visible []string) {
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field == "_none_" || !strings.Contains(field, "*") && ff.Visible(field) {
+			visible = append(visible, field)
+		}
+	}
+
+	return
+}
+
+// visibleFieldEntries is like visibleFields, for list entries which are either field names
+// or objects with a "field" key.
+func (ff FieldFilter) visibleFieldEntries(entries []interface{}) (visible []interface{}) {
+	visible = []interface{}{}
+	for _, entry := range entries {
+		field, _ := entry.(string)
+		if m, ok := entry.(map[string]interface{}); ok {
+			field, _ = m["field"].(string)
+		}
+
+		if len(ff.visibleFields([]string{field})) > 0 {
+			visible = append(visible, entry)
+		}
+	}
+
+	return
+}
+
+// deniedFieldIn looks for "field" references to fields which are not visible (i.e. in the
+// aggregations of a search) and returns the first one found.
+func (ff FieldFilter) deniedFieldIn(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if field, ok := value.(string); ok && (key == "field" || key == "path") && !ff.Visible(field) {
+				return field, true
+			} else if key == "fields" {
+				// highlight fields, keyed by field name
+				if fields, ok := value.(map[string]interface{}); ok {
+					for field := range fields {
+						if !ff.Visible(field) || strings.Contains(field, "*") {
+							return field, true
+						}
+					}
+				}
+			}
+
+			if field, ok := ff.deniedFieldIn(value); ok {
+				return field, true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if field, ok := ff.deniedFieldIn(value); ok {
+				return field, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// deniedSortField looks for sorts on fields which are not visible and returns the first
+// one found. Sorts are given as field names or as objects keyed by field names; script
+// sorts (_script) are reported as well, as scripts can read any field.
+func (ff FieldFilter) deniedSortField(sort interface{}) (string, bool) {
+	switch v := sort.(type) {
+	case string:
+		if v != "_score" && v != "_doc" && !ff.Visible(v) {
+			return v, true
+		}
+	case map[string]interface{}:
+		for field := range v {
+			if field == "_script" || !strings.HasPrefix(field, "_") && !ff.Visible(field) {
+				return field, true
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if field, ok := ff.deniedSortField(s); ok {
+				return field, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// FilterResponse strips the fields which are not visible according to ff from the JSON
+// response body of a request to path: from the documents of the hits (including those in
+// aggregations and inner hits), of the get and multi get APIs, and of the _source API.
+func (ff FieldFilter) FilterResponse(path string, body []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if api, _ := API(path); api == "_source" {
+		if source, ok := v.(map[string]interface{}); ok {
+			v = ff.filterSource(source, "")
+		}
+	} else {
+		ff.filterDocuments(v)
+	}
+
+	return json.Marshal(v)
+}
+
+// filterDocuments looks for documents (objects with a _source, fields or highlight along
+// with an _id) anywhere within v and strips their fields.
+func (ff FieldFilter) filterDocuments(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v["_id"]; ok {
+			if source, ok := v["_source"].(map[string]interface{}); ok {
+				v["_source"] = ff.filterSource(source, "")
+			}
+
+			for _, key := range []string{"fields", "highlight"} {
+				if fields, ok := v[key].(map[string]interface{}); ok {
+					for field := range fields {
+						if !ff.Visible(field) {
+							delete(fields, field)
+						}
+					}
+				}
+			}
+		}
+
+		for key, value := range v {
+			if key != "_source" {
+				ff.filterDocuments(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			ff.filterDocuments(value)
+		}
+	}
+}
+
+// filterSource strips the fields which are not visible from source, whose fields are
+// prefixed by prefix.
+func (ff FieldFilter) filterSource(source map[string]interface{}, prefix string) map[string]interface{} {
+	for key, value := range source {
+		field := prefix + key
+		if kept, ok := ff.filterValue(value, field); ok {
+			source[key] = kept
+		} else {
+			delete(source, key)
+		}
+	}
+
+	return source
+}
+
+// filterValue filters the value of field, reporting whether anything is left of it.
+func (ff FieldFilter) filterValue(value interface{}, field string) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		empty := len(v) == 0
+		kept := ff.filterSource(v, field+".")
+		return kept, len(kept) > 0 || empty && ff.Visible(field)
+	case []interface{}:
+		var kept []interface{}
+		for _, item := range v {
+			if k, ok := ff.filterValue(item, field); ok {
+				kept = append(kept, k)
+			}
+		}
+
+		return kept, len(kept) > 0 || len(v) == 0 && ff.Visible(field)
+	}
+
+	return value, ff.Visible(field)
+}
@@ -0,0 +1,154 @@
+package elasticsearch
+
+import (
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const fieldRulesTestData = `{
+	"@support":  {"deny": ["email", "ssn", "customer.*"]},
+	"@analysts": {"allow": ["@timestamp", "message", "geo"]}
+}`
+
+var support, analyst = FieldFilter{{Deny: []string{"email", "ssn", "customer.*"}}}, FieldFilter{{Allow: []string{"@timestamp", "message", "geo"}}}
+
+func TestReadFieldRules(t *testing.T) {
+	for _, bogus := range []string{"[]", `{"foo": {}}`, `{"foo": {"allow": ["["]}}`, `{"foo": {"bogus": ["a"]}}`} {
+		if _, err := ReadFieldRules(strings.NewReader(bogus)); err == nil {
+			t.Errorf("Rules %s should be rejected", bogus)
+		}
+	}
+
+	if LoadFieldRules(42) == nil || LoadFieldRules("bogus.json") == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestFieldFilterFor(t *testing.T) {
+	if err := LoadFieldRules(strings.NewReader(fieldRulesTestData)); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadFieldRules(FieldRules(nil))
+
+	if ff := FieldFilterFor(aa.Identity{User: "foo", Groups: []string{"readers"}}); ff != nil {
+		t.Error("Users without rules should not be restricted, got", ff)
+	}
+
+	ff := FieldFilterFor(aa.Identity{User: "foo", Groups: []string{"support", "analysts"}})
+	if len(ff) != 2 || ff.Visible("email") || ff.Visible("customer.name") || !ff.Visible("customer") {
+		t.Error("Unexpected filter", ff)
+	}
+}
+
+func TestVisible(t *testing.T) {
+	for field, expected := range map[string]bool{
+		"message": true, "email": false, "customer": true, "customer.name": false, "ssn.last4": false,
+	} {
+		if support.Visible(field) != expected {
+			t.Errorf("Expected %v for %s", expected, field)
+		}
+	}
+
+	for field, expected := range map[string]bool{"message": true, "geo.lat": true, "email": false} {
+		if analyst.Visible(field) != expected {
+			t.Errorf("Expected %v for %s", expected, field)
+		}
+	}
+}
+
+func TestFieldFilterRestrictRequest(t *testing.T) {
+	cases := map[string]struct {
+		ff            FieldFilter
+		method, url   string
+		body          string
+		expectedQuery string
+		expectedBody  string
+	}{
+		"search deny": {support, "POST", "/_search?stored_fields=email,message,*", `{"_source":["a*"],"docvalue_fields":["ssn",{"field":"message"}]}`,
+			"_source_excludes=email%2Cssn%2Ccustomer.%2A&stored_fields=message",
+			`{"_source":{"excludes":["email","ssn","customer.*"],"includes":["a*"]},"docvalue_fields":[{"field":"message"}]}`},
+		"search allow": {analyst, "POST", "/_search", `{}`, "_source_includes=%40timestamp%2Cmessage%2Cgeo",
+			`{"_source":{"includes":["@timestamp","message","geo"]}}`},
+		"get":   {support, "GET", "/logs/_doc/1", "", "_source_excludes=email%2Cssn%2Ccustomer.%2A", ""},
+		"index": {support, "PUT", "/logs/_doc/1", `{"email":"x"}`, "", `{"email":"x"}`},
+		"count": {support, "POST", "/_count", `{"query":{}}`, "", `{"query":{}}`},
+	}
+
+	for name, c := range cases {
+		req := searchReq(c.method, c.url, c.body)
+		if err := c.ff.RestrictRequest(req); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.RawQuery != c.expectedQuery || string(body) != c.expectedBody {
+			t.Errorf("%s: expected %s %s got %s %s", name, c.expectedQuery, c.expectedBody, req.URL.RawQuery, body)
+		}
+	}
+
+	for name, body := range map[string]string{
+		"agg":           `{"aggs":{"a":{"terms":{"field":"email","order":{"_count":"asc"}}}}}`,
+		"nested agg":    `{"aggs":{"a":{"terms":{"field":"message"},"aggs":{"b":{"max":{"field":"customer.age"}}}}}}`,
+		"sort":          `{"sort":["message",{"ssn":"asc"}]}`,
+		"highlight":     `{"highlight":{"fields":{"email":{}}}}`,
+		"script fields": `{"script_fields":{}}`,
+		"suggest":       `{"suggest":{"s":{"text":"x","term":{"field":"message"}}}}`,
+		"query":         `{"query":{"bool":{"filter":[{"prefix":{"ssn":"12"}}]}}}`,
+		"match all":     `{"query":{"multi_match":{"query":"x"}}}`,
+		"query string":  `{"query":{"query_string":{"query":"ssn:12*"}}}`,
+		"post filter":   `{"post_filter":{"range":{"customer.age":{"gte":18}}}}`,
+		"rescore":       `{"rescore":{"query":{"rescore_query":{"match":{"email":"x"}}}}}`,
+		"agg filter":    `{"aggs":{"a":{"filter":{"term":{"ssn":"1"}}}}}`,
+		"agg script":    `{"aggs":{"a":{"terms":{"script":"doc['ssn'].value"}}}}`,
+		"script sort":   `{"sort":{"_script":{"script":"doc['ssn'].value"}}}`,
+	} {
+		if err := support.RestrictRequest(searchReq("POST", "/_search", body)); !errors.Is(err, ErrUnsafeRequest) {
+			t.Errorf("%s: expected ErrUnsafeRequest got %v", name, err)
+		}
+	}
+
+	for name, req := range map[string]*http.Request{
+		"all agg":     searchReq("POST", "/_all/_search", `{"aggs":{"a":{"terms":{"field":"email"}}}}`),
+		"explain":     searchReq("GET", "/logs/_explain/1", `{"query":{}}`),
+		"termvectors": searchReq("GET", "/logs/_termvectors/1", ""),
+		"unknown api": searchReq("POST", "/_query", `{"query":"FROM logs"}`),
+		"count":       searchReq("POST", "/_count", `{"query":{"term":{"ssn":"1"}}}`),
+	} {
+		if err := support.RestrictRequest(req); !errors.Is(err, ErrUnsafeRequest) {
+			t.Errorf("%s: expected ErrUnsafeRequest got %v", name, err)
+		}
+	}
+
+	if err := support.RestrictRequest(searchReq("POST", "/_search", `{"aggs":{"prefix":{"date_histogram":{"field":"@timestamp","calendar_interval":"day"}}},"sort":"message"}`)); err != nil {
+		t.Error("Aggregations and sorts on visible fields should be allowed, got", err)
+	}
+
+	if err := support.RestrictRequest(searchReq("POST", "/_search", `{"query":{"bool":{"must":{"match":{"message":{"query":"x","boost":2}}},"filter":{"multi_match":{"query":"x","fields":["message^2"]}}}}}`)); err != nil {
+		t.Error("Queries on visible fields should be allowed, got", err)
+	}
+}
+
+func TestFieldFilterFilterResponse(t *testing.T) {
+	search := `{"hits":{"hits":[{"_id":"1","_source":{"message":"m","email":"e","customer":{"name":"n"},"tags":[{"ssn":1}]},` +
+		`"fields":{"email":["e"],"message":["m"]},"highlight":{"ssn":["x"]}}]},` +
+		`"aggregations":{"top":{"hits":{"hits":[{"_id":"2","_source":{"email":"e","n":1}}]}},"count":{"value":12345678901234567890}}}`
+	expected := `{"aggregations":{"count":{"value":12345678901234567890},"top":{"hits":{"hits":[{"_id":"2","_source":{"n":1}}]}}},` +
+		`"hits":{"hits":[{"_id":"1","_source":{"message":"m","tags":[{"ssn":1}]},"fields":{"message":["m"]},"highlight":{}}]}}`
+
+	if actual, err := support.FilterResponse("/_search", []byte(search)); err != nil || string(actual) != expected {
+		t.Errorf("Expected %s got %s (%v)", expected, actual, err)
+	}
+
+	if actual, _ := analyst.FilterResponse("/logs/_source/1", []byte(`{"message":"m","geo":{"lat":1},"email":"e"}`)); string(actual) != `{"geo":{"lat":1},"message":"m"}` {
+		t.Error("Unexpected _source response", string(actual))
+	}
+
+	if _, err := support.FilterResponse("/_search", []byte("not json")); err == nil {
+		t.Error("Invalid responses should be reported")
+	}
+}
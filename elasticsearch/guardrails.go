@@ -0,0 +1,112 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DangerousSettings lists the (prefixes of the) cluster settings which may only be changed
+// by the users having the guardrails capability.
+var DangerousSettings = []string{
+	"action.destructive_requires_name",
+	"cluster.blocks.",
+	"cluster.max_shards_per_node",
+	"cluster.routing.",
+	"discovery.",
+	"gateway.",
+	"indices.breaker.",
+	"network.",
+	"script.",
+	"xpack.",
+}
+
+// Guardrail checks r against the built-in guardrails, which prevent the operations that
+// can wreck a cluster, and returns an error describing the one it trips, if any:
+//
+// 	deleting indices by wildcard or _all, closing indices by wildcard or _all,
+// 	shutting down nodes and changing dangerous cluster settings (see DangerousSettings).
+func Guardrail(r *http.Request) error {
+	segments := Segments(r.URL.Path)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	for i, s := range segments {
+		if s == "_shutdown" || s == "shutdown" && i > 0 && segments[0] == "_nodes" {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				return fmt.Errorf("shutting down nodes is not allowed")
+			}
+		}
+	}
+
+	expr, api := segments[0], ""
+	if len(segments) > 1 {
+		api = segments[1]
+	}
+
+	switch {
+	case r.Method == "DELETE" && len(segments) == 1 && isWideIndexExpression(expr):
+		return fmt.Errorf("deleting indices by wildcard or _all (%s) is not allowed", expr)
+	case r.Method == "POST" && api == "_close" && isWideIndexExpression(expr):
+		return fmt.Errorf("closing indices by wildcard or _all (%s) is not allowed", expr)
+	case (r.Method == "PUT" || r.Method == "POST") && expr == "_cluster" && api == "settings":
+		return dangerousSettings(r)
+	}
+
+	return nil
+}
+
+// isWideIndexExpression determines if expr may target many (or all) indices.
+func isWideIndexExpression(expr string) bool {
+	if expr == "_all" {
+		return true
+	}
+
+	for _, index := range strings.Split(expr, ",") {
+		if strings.ContainsAny(index, "*?") || index == "_all" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dangerousSettings checks the cluster settings update r for dangerous settings.
+func dangerousSettings(r *http.Request) error {
+	body, err := ReadBody(r)
+	if err != nil {
+		return err
+	}
+
+	var update map[string]map[string]interface{}
+	if err = json.Unmarshal(body, &update); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+	}
+
+	for _, settings := range update {
+		for _, name := range settingNames("", settings) {
+			for _, dangerous := range DangerousSettings {
+				if strings.HasPrefix(name, dangerous) {
+					return fmt.Errorf("changing the %s cluster setting is not allowed", name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// settingNames returns the full (dotted) names of the settings, which may be nested.
+func settingNames(prefix string, settings map[string]interface{}) (names []string) {
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			names = append(names, settingNames(prefix+key+".", nested)...)
+		} else {
+			names = append(names, prefix+key)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,43 @@
+package elasticsearch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGuardrail(t *testing.T) {
+	for _, c := range []struct{ method, url, body string }{
+		{"DELETE", "/*", ""},
+		{"DELETE", "/_all", ""},
+		{"DELETE", "/logs-*,metrics", ""},
+		{"POST", "/_all/_close", ""},
+		{"POST", "/logs-*/_close", ""},
+		{"POST", "/_shutdown", ""},
+		{"POST", "/_cluster/nodes/_local/_shutdown", ""},
+		{"PUT", "/_nodes/abc/shutdown", `{"type":"restart"}`},
+		{"PUT", "/_cluster/settings", `{"persistent":{"cluster.routing.allocation.enable":"none"}}`},
+		{"PUT", "/_cluster/settings", `{"transient":{"action":{"destructive_requires_name":false}}}`},
+	} {
+		if err := Guardrail(searchReq(c.method, c.url, c.body)); err == nil {
+			t.Errorf("%s %s %s should have been stopped", c.method, c.url, c.body)
+		}
+	}
+
+	for _, c := range []struct{ method, url, body string }{
+		{"DELETE", "/logs-2016", ""},
+		{"DELETE", "/logs-*/_doc/1", ""},
+		{"POST", "/logs-2016/_close", ""},
+		{"GET", "/_nodes/shutdown", ""},
+		{"GET", "/_cluster/settings", ""},
+		{"PUT", "/_cluster/settings", `{"persistent":{"indices.recovery.max_bytes_per_sec":"50mb"}}`},
+		{"GET", "/", ""},
+	} {
+		if err := Guardrail(searchReq(c.method, c.url, c.body)); err != nil {
+			t.Errorf("%s %s %s should have been let through, got %v", c.method, c.url, c.body, err)
+		}
+	}
+
+	if err := Guardrail(searchReq("PUT", "/_cluster/settings", "bogus")); !errors.Is(err, ErrUnsafeRequest) {
+		t.Error("Expected ErrUnsafeRequest got", err)
+	}
+}
@@ -0,0 +1,136 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// catIndexColumns holds, for the _cat APIs listing indices, the position of the index
+// column in their default output.
+var catIndexColumns = map[string]int{"indices": 2, "shards": 0, "segments": 0, "aliases": 1, "recovery": 0}
+
+// catIndexNames lists the names of the index column of the _cat APIs (full and aliases).
+var catIndexNames = []string{"index", "i", "idx"}
+
+// indexKeyedAPIs lists the APIs whose JSON responses are objects keyed by index name.
+var indexKeyedAPIs = map[string]bool{"_alias": true, "_aliases": true, "_mapping": true, "_settings": true}
+
+// IsListing determines if a request to path gets a response listing indices, which can be
+// filtered by FilterListing().
+func IsListing(path string) bool {
+	api, rest := API(path)
+	if api == "_cat" {
+		_, ok := catIndexColumns[strings.SplitN(rest, "/", 2)[0]]
+		return ok
+	}
+
+	return indexKeyedAPIs[api] || api == "_stats"
+}
+
+// FilterListing drops the entries of the indices which are not permitted from the response
+// body of a request to path (with query), which lists indices (see IsListing()). JSON
+// responses and _cat text (text/plain) ones are supported, any other format (e.g. YAML,
+// CBOR) is refused.
+func FilterListing(path string, query url.Values, body []byte, contentType string, permitted func(index string) bool) ([]byte, error) {
+	api, rest := API(path)
+	if api == "_cat" && strings.HasPrefix(contentType, "text/plain") {
+		return filterCatText(catIndexColumns[strings.SplitN(rest, "/", 2)[0]], query, body, permitted)
+	} else if !strings.Contains(contentType, "json") {
+		return nil, errors.New("can not filter " + contentType + " responses")
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case []interface{}: // _cat, with format=json
+		kept := []interface{}{}
+		for _, row := range v {
+			index, ok := catRowIndex(row)
+			if !ok {
+				return nil, errors.New("can not filter _cat output without the index column")
+			} else if permitted(index) {
+				kept = append(kept, row)
+			}
+		}
+
+		return json.Marshal(kept)
+	case map[string]interface{}:
+		if api == "_stats" {
+			if indices, ok := v["indices"].(map[string]interface{}); ok {
+				filterIndexKeys(indices, permitted)
+			}
+		} else if _, failed := v["error"]; !failed {
+			filterIndexKeys(v, permitted)
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// catRowIndex returns the index of a row of a JSON _cat response, if it has the index column.
+func catRowIndex(row interface{}) (string, bool) {
+	if r, ok := row.(map[string]interface{}); ok {
+		for _, name := range catIndexNames {
+			if index, ok := r[name].(string); ok {
+				return index, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func filterIndexKeys(m map[string]interface{}, permitted func(string) bool) {
+	for index := range m {
+		if !permitted(index) {
+			delete(m, index)
+		}
+	}
+}
+
+// filterCatText filters the lines of a _cat text response, whose index column is found
+// in its header (with ?v), or in the h parameter, or else at the default position.
+func filterCatText(column int, query url.Values, body []byte, permitted func(string) bool) ([]byte, error) {
+	lines := strings.SplitAfter(string(body), "\n")
+	_, header := query["v"]
+	header = header && query.Get("v") != "false"
+
+	columns := []string(nil)
+	if header && len(lines) > 0 {
+		columns = strings.Fields(lines[0])
+	} else if h := query.Get("h"); h != "" {
+		columns = strings.Split(h, ",")
+	}
+
+	if columns != nil {
+		column = -1
+		for i, name := range columns {
+			for _, index := range catIndexNames {
+				if strings.TrimSpace(name) == index {
+					column = i
+				}
+			}
+		}
+
+		if column < 0 {
+			return nil, errors.New("can not filter _cat output without the index column")
+		}
+	}
+
+	var out strings.Builder
+	for i, line := range lines {
+		if fields := strings.Fields(line); i == 0 && header || len(fields) <= column || permitted(fields[column]) {
+			out.WriteString(line)
+		}
+	}
+
+	return []byte(out.String()), nil
+}
@@ -0,0 +1,82 @@
+package elasticsearch
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func permitLogs(index string) bool {
+	return strings.HasPrefix(index, "logs")
+}
+
+func TestIsListing(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/_cat/indices": true, "/_cat/shards/logs": true, "/_cat/nodes": false, "/_aliases": true,
+		"/logs/_mapping": true, "/_stats": true, "/_search": false, "/logs/_settings": true,
+	} {
+		if IsListing(path) != expected {
+			t.Errorf("Expected %v for %s", expected, path)
+		}
+	}
+}
+
+func TestFilterListingJSON(t *testing.T) {
+	cases := map[string][2]string{
+		"/_aliases":         {`{"logs-1":{"aliases":{}},"secret":{"aliases":{}}}`, `{"logs-1":{"aliases":{}}}`},
+		"/_mapping":         {`{"logs-1":{"mappings":{}},"secret":{"mappings":{}}}`, `{"logs-1":{"mappings":{}}}`},
+		"/_stats":           {`{"_all":{"n":1},"indices":{"logs-1":{},"secret":{}}}`, `{"_all":{"n":1},"indices":{"logs-1":{}}}`},
+		"/_cat/indices":     {`[{"index":"logs-1","health":"green"},{"index":"secret"}]`, `[{"health":"green","index":"logs-1"}]`},
+		"/missing/_mapping": {`{"error":{"type":"index_not_found_exception"},"status":404}`, `{"error":{"type":"index_not_found_exception"},"status":404}`},
+	}
+
+	for path, c := range cases {
+		actual, err := FilterListing(path, url.Values{}, []byte(c[0]), "application/json", permitLogs)
+		if err != nil || string(actual) != c[1] {
+			t.Errorf("%s: expected %s got %s (%v)", path, c[1], actual, err)
+		}
+	}
+
+	query, _ := url.ParseQuery("format=json&h=i")
+	if actual, err := FilterListing("/_cat/indices", query, []byte(`[{"i":"logs-1"},{"i":"secret"}]`), "application/json", permitLogs); err != nil || string(actual) != `[{"i":"logs-1"}]` {
+		t.Errorf("Expected the rows to be filtered by the i column, got %s (%v)", actual, err)
+	}
+
+	if _, err := FilterListing("/_cat/indices", query, []byte(`[{"health":"green"}]`), "application/json", permitLogs); err == nil {
+		t.Error("Output without the index column can not be filtered")
+	}
+
+	if _, err := FilterListing("/_aliases", url.Values{}, []byte("x"), "application/yaml", permitLogs); err == nil {
+		t.Error("Non JSON responses can not be filtered")
+	}
+}
+
+func TestFilterListingText(t *testing.T) {
+	cases := []struct {
+		path, query, body, expected string
+	}{
+		{"/_cat/indices", "", "green open logs-1 u1 1 1\ngreen open secret u2 1 1\n", "green open logs-1 u1 1 1\n"},
+		{"/_cat/indices", "v", "health status index uuid\ngreen open secret u2\ngreen open logs-1 u1\n", "health status index uuid\ngreen open logs-1 u1\n"},
+		{"/_cat/indices", "h=health,i", "green secret\ngreen logs-1\n", "green logs-1\n"},
+		{"/_cat/shards", "", "secret 0 p STARTED\nlogs-1 0 p STARTED\n", "logs-1 0 p STARTED\n"},
+		{"/_cat/aliases", "", "a1 secret - -\na2 logs-1 - -\n", "a2 logs-1 - -\n"},
+	}
+
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		actual, err := FilterListing(c.path, query, []byte(c.body), "text/plain; charset=UTF-8", permitLogs)
+		if err != nil || string(actual) != c.expected {
+			t.Errorf("%s?%s: expected %q got %q (%v)", c.path, c.query, c.expected, actual, err)
+		}
+	}
+
+	query, _ := url.ParseQuery("h=health,status")
+	if _, err := FilterListing("/_cat/indices", query, []byte("green open\n"), "text/plain", permitLogs); err == nil {
+		t.Error("Output without the index column can not be filtered")
+	}
+
+	query, _ = url.ParseQuery("format=yaml")
+	if _, err := FilterListing("/_cat/indices", query, []byte("- index: \"secret\"\n"), "application/yaml", permitLogs); err == nil {
+		t.Error("Non text _cat output can not be filtered")
+	}
+}
@@ -0,0 +1,95 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// nodesAddressKeys are the keys of the nodes APIs responses holding addresses (host:port).
+var nodesAddressKeys = map[string]bool{"publish_address": true, "bound_address": true, "transport_address": true}
+
+// nodesHostKeys are the keys of the nodes APIs responses holding hosts (or IPs).
+var nodesHostKeys = map[string]bool{"host": true, "ip": true, "publish_host": true, "bind_host": true}
+
+// nodesOtherAPIs are the nodes APIs other than the nodes info API (which clients use for
+// sniffing).
+var nodesOtherAPIs = map[string]bool{"stats": true, "hot_threads": true, "usage": true, "reload_secure_settings": true, "shutdown": true}
+
+// IsNodes determines if path is to one of the nodes APIs.
+func IsNodes(path string) bool {
+	segments := Segments(path)
+	return len(segments) > 0 && segments[0] == "_nodes"
+}
+
+// IsNodesInfo determines if path is to the nodes info API, which reveals the addresses of
+// the nodes (i.e. /_nodes/http).
+func IsNodesInfo(path string) bool {
+	if !IsNodes(path) {
+		return false
+	}
+
+	for _, s := range Segments(path)[1:] {
+		if nodesOtherAPIs[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RewriteNodes replaces the addresses of the nodes (publish_address, bound_address and the
+// like, anywhere in the body of a nodes API response) with address and their hosts and IPs
+// with its host.
+func RewriteNodes(body []byte, address string) ([]byte, error) {
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	if nodes, ok := resp["nodes"].(map[string]interface{}); ok {
+		for _, node := range nodes {
+			rewriteNodeAddresses(node, address, host)
+		}
+	}
+
+	return json.Marshal(resp)
+}
+
+// rewriteNodeAddresses replaces the addresses and hosts found anywhere within v.
+func rewriteNodeAddresses(v interface{}, address, host string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			replacement := ""
+			if nodesAddressKeys[key] {
+				replacement = address
+			} else if nodesHostKeys[key] {
+				replacement = host
+			}
+
+			switch value.(type) {
+			case string:
+				if replacement != "" {
+					v[key] = replacement
+				}
+			case []interface{}:
+				if replacement != "" {
+					v[key] = []interface{}{replacement}
+					continue
+				}
+				rewriteNodeAddresses(value, address, host)
+			default:
+				rewriteNodeAddresses(value, address, host)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			rewriteNodeAddresses(value, address, host)
+		}
+	}
+}
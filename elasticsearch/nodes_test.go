@@ -0,0 +1,30 @@
+package elasticsearch
+
+import "testing"
+
+func TestIsNodesInfo(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/_nodes": true, "/_nodes/http": true, "/_nodes/_all/http": true, "/_nodes/stats": false,
+		"/_nodes/n1/hot_threads": false, "/_cluster/health": false,
+	} {
+		if IsNodesInfo(path) != expected {
+			t.Errorf("Expected %v for %s", expected, path)
+		}
+	}
+}
+
+func TestRewriteNodes(t *testing.T) {
+	body := `{"cluster_name":"c","nodes":{"n1":{"name":"es1","host":"10.0.0.1","ip":"10.0.0.1","transport_address":"10.0.0.1:9300",` +
+		`"http":{"publish_address":"es1/10.0.0.1:9200","bound_address":["10.0.0.1:9200","[::1]:9200"]},` +
+		`"settings":{"network":{"host":"10.0.0.1"}}}}}`
+	expected := `{"cluster_name":"c","nodes":{"n1":{"host":"guardian","http":{"bound_address":["guardian:9600"],"publish_address":"guardian:9600"},` +
+		`"ip":"guardian","name":"es1","settings":{"network":{"host":"guardian"}},"transport_address":"guardian:9600"}}}`
+
+	if actual, err := RewriteNodes([]byte(body), "guardian:9600"); err != nil || string(actual) != expected {
+		t.Errorf("Expected %s got %s (%v)", expected, actual, err)
+	}
+
+	if _, err := RewriteNodes([]byte("bogus"), "guardian:9600"); err == nil {
+		t.Error("Invalid responses should be reported")
+	}
+}
@@ -0,0 +1,160 @@
+package elasticsearch
+
+// compoundQueries lists, for the compound queries, the keys holding their sub queries
+// (either one query or a list of queries).
+var compoundQueries = map[string][]string{
+	"bool":               {"must", "filter", "should", "must_not"},
+	"boosting":           {"positive", "negative"},
+	"constant_score":     {"filter"},
+	"dis_max":            {"queries"},
+	"function_score":     {"query"},
+	"script_score":       {"query"},
+	"nested":             {"query"},
+	"has_child":          {"query"},
+	"has_parent":         {"query"},
+	"pinned":             {"organic"},
+	"span_near":          {"clauses"},
+	"span_or":            {"clauses"},
+	"span_not":           {"include", "exclude"},
+	"span_containing":    {"big", "little"},
+	"span_within":        {"big", "little"},
+	"span_first":         {"match"},
+	"span_multi":         {"match"},
+	"field_masking_span": {"query"},
+}
+
+// walkSearch calls visitQuery with the type and body of each query clause of the search
+// body search (the ones of its query, post_filter, rescore and knn sections, and of the
+// filter aggregations), down the compound queries, and visitAgg with the type and the
+// parameters of each of its (other) aggregations. Functions of the function_score queries
+// are visited as query clauses, as is the knn section itself. The first error returned by
+// either stops the walk.
+func walkSearch(search map[string]interface{}, visitQuery, visitAgg func(kind string, body interface{}) error) error {
+	for _, key := range []string{"query", "post_filter"} {
+		if err := walkQuery(search[key], visitQuery); err != nil {
+			return err
+		}
+	}
+
+	for _, rescore := range asList(search["rescore"]) {
+		r, _ := rescore.(map[string]interface{})
+		q, _ := r["query"].(map[string]interface{})
+		if err := walkQuery(q["rescore_query"], visitQuery); err != nil {
+			return err
+		}
+	}
+
+	for _, knn := range asList(search["knn"]) {
+		if err := walkQuery(map[string]interface{}{"knn": knn}, visitQuery); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{"aggs", "aggregations"} {
+		if err := walkAggs(search[key], visitQuery, visitAgg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkQuery calls visit for the query clause q and its sub queries (see walkSearch).
+func walkQuery(q interface{}, visit func(kind string, body interface{}) error) error {
+	for _, clause := range asList(q) {
+		c, _ := clause.(map[string]interface{})
+		for kind, body := range c {
+			if err := visit(kind, body); err != nil {
+				return err
+			}
+
+			b, _ := body.(map[string]interface{})
+			for _, key := range compoundQueries[kind] {
+				if err := walkQuery(b[key], visit); err != nil {
+					return err
+				}
+			}
+
+			switch kind {
+			case "function_score":
+				for _, function := range asList(b["functions"]) {
+					f, _ := function.(map[string]interface{})
+					for name, value := range f {
+						var err error
+						if name == "filter" {
+							err = walkQuery(value, visit)
+						} else if name != "weight" {
+							err = visit(name, value)
+						}
+						if err != nil {
+							return err
+						}
+					}
+				}
+			case "knn":
+				if err := walkQuery(b["filter"], visit); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// walkAggs calls visitQuery for the queries of the filter aggregations among aggs and
+// visitAgg for the others (see walkSearch), down their sub aggregations.
+func walkAggs(aggs interface{}, visitQuery, visitAgg func(kind string, body interface{}) error) (err error) {
+	a, _ := aggs.(map[string]interface{})
+	for _, agg := range a {
+		def, _ := agg.(map[string]interface{})
+		for kind, params := range def {
+			switch kind {
+			case "aggs", "aggregations":
+				err = walkAggs(params, visitQuery, visitAgg)
+			case "meta":
+			case "filter":
+				err = walkQuery(params, visitQuery)
+			case "filters", "adjacency_matrix":
+				p, _ := params.(map[string]interface{})
+				filters := p["filters"]
+				if named, ok := filters.(map[string]interface{}); ok {
+					filters = mapValues(named)
+				}
+				for _, filter := range asList(filters) {
+					if err = walkQuery(filter, visitQuery); err != nil {
+						return
+					}
+				}
+			default:
+				err = visitAgg(kind, params)
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// asList returns v if it is a list, or else a list holding v (if any).
+func asList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	} else if v == nil {
+		return nil
+	}
+
+	return []interface{}{v}
+}
+
+// mapValues returns the values of m (in no particular order).
+func mapValues(m map[string]interface{}) (values []interface{}) {
+	for _, value := range m {
+		values = append(values, value)
+	}
+
+	return
+}
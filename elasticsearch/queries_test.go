@@ -0,0 +1,40 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkSearch(t *testing.T) {
+	search := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"query": {"bool": {"must": [{"match": {"script": "x"}}], "filter": {"nested": {"path": "p", "query": {"term": {"p.a": 1}}}}}},
+		"post_filter": {"function_score": {"query": {"exists": {"field": "f"}}, "functions": [{"filter": {"prefix": {"g": "a"}}, "gauss": {}, "weight": 2}]}},
+		"rescore": [{"query": {"rescore_query": {"wildcard": {"h": "*"}}}}],
+		"knn": {"field": "v", "filter": {"range": {"i": {}}}},
+		"aggs": {"prefix": {"terms": {"field": "j"}, "aggs": {"k": {"filters": {"filters": {"x": {"regexp": {"l": "."}}}}}}}}
+	}`), &search)
+
+	var queries, aggs []string
+	err := walkSearch(search, func(kind string, _ interface{}) error {
+		queries = append(queries, kind)
+		return nil
+	}, func(kind string, _ interface{}) error {
+		aggs = append(aggs, kind)
+		return nil
+	})
+
+	sort.Strings(queries)
+	expected := []string{"bool", "exists", "function_score", "gauss", "knn", "match", "nested", "prefix", "range", "regexp", "term", "wildcard"}
+	if err != nil || !reflect.DeepEqual(queries, expected) || !reflect.DeepEqual(aggs, []string{"terms"}) {
+		t.Errorf("Expected %v %v got %v %v (%v)", expected, []string{"terms"}, queries, aggs, err)
+	}
+
+	stop := errors.New("stop")
+	if err = walkSearch(search, func(string, interface{}) error { return stop }, nil); err != stop {
+		t.Error("Expected the walk to stop on the first error, got", err)
+	}
+}
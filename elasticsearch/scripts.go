@@ -0,0 +1,112 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Script describes a script found in a request: either a stored one (with its ID) or an
+// inline one.
+type Script struct {
+	ID string
+}
+
+// Inline determines if s is an inline script.
+func (s Script) Inline() bool {
+	return s.ID == ""
+}
+
+// ScriptAPI determines if the request r manages or runs scripts directly (stored scripts
+// changes and the painless execute API).
+func ScriptAPI(r *http.Request) bool {
+	api, rest := API(r.URL.Path)
+	if api != "_scripts" {
+		return false
+	}
+
+	return rest == "painless/_execute" || r.Method != "GET" && r.Method != "HEAD"
+}
+
+// Scripts returns the scripts found in the body of the request r. Documents (the bodies of
+// the index APIs and the sources in bulk requests) are not looked into.
+func Scripts(r *http.Request) (scripts []Script, err error) {
+	api, rest := API(r.URL.Path)
+	if api == "_doc" || api == "_create" || r.Method == "GET" && r.ContentLength == 0 {
+		return
+	}
+
+	body, err := ReadBody(r)
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+
+	if api == "_scripts" && rest == "painless/_execute" {
+		return []Script{{}}, nil
+	}
+
+	if api != "_bulk" && api != "_msearch" {
+		var v interface{}
+		if err = json.Unmarshal(body, &v); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+
+		if api == "_update" {
+			// only the script of the update itself, not the upserted document
+			m, _ := v.(map[string]interface{})
+			v = map[string]interface{}{"script": m["script"]}
+		}
+
+		return findScripts(v, scripts), nil
+	}
+
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		var v map[string]interface{}
+		if err = json.Unmarshal(lines[i], &v); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+		scripts = findScripts(v, scripts)
+
+		if api == "_msearch" || v["update"] != nil {
+			continue // the next line is checked as well
+		} else if v["index"] != nil || v["create"] != nil {
+			i++ // skip the document
+		}
+	}
+
+	return
+}
+
+// findScripts appends the scripts found anywhere within v to scripts.
+func findScripts(v interface{}, scripts []Script) []Script {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == "script" {
+				switch s := value.(type) {
+				case string:
+					scripts = append(scripts, Script{})
+					continue
+				case map[string]interface{}:
+					if id, ok := s["id"].(string); ok {
+						scripts = append(scripts, Script{ID: id})
+						continue
+					} else if s["source"] != nil || s["inline"] != nil {
+						scripts = append(scripts, Script{})
+						continue
+					}
+				}
+			}
+
+			scripts = findScripts(value, scripts)
+		}
+	case []interface{}:
+		for _, value := range v {
+			scripts = findScripts(value, scripts)
+		}
+	}
+
+	return scripts
+}
@@ -0,0 +1,52 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScripts(t *testing.T) {
+	cases := map[string]struct {
+		method, url, body string
+		expected          []Script
+	}{
+		"none":          {"POST", "/_search", `{"query":{"match_all":{}}}`, nil},
+		"script query":  {"POST", "/_search", `{"query":{"bool":{"filter":{"script":{"script":{"source":"1"}}}}}}`, []Script{{}}},
+		"script field":  {"POST", "/_search", `{"script_fields":{"a":{"script":"doc['x']"}}}`, []Script{{}}},
+		"stored":        {"POST", "/logs/_update_by_query", `{"script":{"id":"fix","params":{}}}`, []Script{{ID: "fix"}}},
+		"mapping field": {"PUT", "/logs/_mapping", `{"properties":{"script":{"type":"keyword"}}}`, nil},
+		"document":      {"PUT", "/logs/_doc/1", `{"script":"not really"}`, nil},
+		"update upsert": {"POST", "/logs/_update/1", `{"doc":{"script":"x"}}`, nil},
+		"update":        {"POST", "/logs/_update/1", `{"script":{"source":"ctx._source.n++"}}`, []Script{{}}},
+		"bulk": {"POST", "/_bulk", "{\"index\":{}}\n{\"script\":\"doc\"}\n{\"delete\":{}}\n{\"update\":{}}\n{\"script\":{\"id\":\"s\"}}\n",
+			[]Script{{ID: "s"}}},
+		"msearch": {"POST", "/_msearch", "{}\n{\"sort\":{\"_script\":{\"script\":\"1\"}}}\n", []Script{{}}},
+		"execute": {"POST", "/_scripts/painless/_execute", `{"script":{"id":"x"}}`, []Script{{}}},
+		"get":     {"GET", "/_search", "", nil},
+	}
+
+	for name, c := range cases {
+		scripts, err := Scripts(searchReq(c.method, c.url, c.body))
+		if err != nil || !reflect.DeepEqual(scripts, c.expected) {
+			t.Errorf("%s: expected %v got %v (%v)", name, c.expected, scripts, err)
+		}
+	}
+
+	if _, err := Scripts(searchReq("POST", "/_search", "bogus")); err == nil {
+		t.Error("Invalid bodies should be reported")
+	}
+}
+
+func TestScriptAPI(t *testing.T) {
+	for _, c := range []struct {
+		method, url string
+		expected    bool
+	}{
+		{"PUT", "/_scripts/fix", true}, {"DELETE", "/_scripts/fix", true}, {"GET", "/_scripts/fix", false},
+		{"POST", "/_scripts/painless/_execute", true}, {"GET", "/_search", false},
+	} {
+		if ScriptAPI(searchReq(c.method, c.url, "")) != c.expected {
+			t.Errorf("Expected %v for %s %s", c.expected, c.method, c.url)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Tenancy maps the index names seen by a tenant to the physical ones: Prefix + name + Suffix.
+type Tenancy struct {
+	Prefix string
+	Suffix string
+}
+
+// Tenancies holds the tenancies of the users and of the roles (under "@role" keys).
+type Tenancies map[string]Tenancy
+
+// tenancies holds the loaded tenancies.
+var tenancies Tenancies
+
+// tenancyMu guards tenancies.
+var tenancyMu sync.RWMutex
+
+// tenancyRE validates the tenancy prefixes and suffixes (which must be valid in index names).
+var tenancyRE = regexp.MustCompile(`^[a-z0-9_.+-]*$`)
+
+// tenantWideAPIs lists the APIs which, when called without indices, get the tenant's
+// indices (all of them) added to their path, so that they do not reach other indices.
+var tenantWideAPIs = map[string]bool{
+	"_search": true, "_count": true, "_async_search": true, "_msearch": true, "_field_caps": true,
+	"_validate": true, "_refresh": true, "_flush": true, "_forcemerge": true, "_stats": true,
+	"_mapping": true, "_settings": true, "_alias": true, "_segments": true, "_recovery": true,
+	"_cache": true,
+}
+
+// untenantedAPIs lists the APIs which, when called without indices, do not reach any index
+// (or get the indices in their bodies rewritten), and are thus available to tenants (only
+// for reads, when false). The other APIs called without indices are refused to tenants.
+var untenantedAPIs = map[string]bool{
+	"_bulk": true, "_mget": true, "_pit": true, "_nodes": false, "_tasks": false, "_cluster": false,
+	"_cat": false,
+}
+
+// LoadTenancies loads the given tenancies (a Tenancies variable, an io.Reader or a filename
+// with the format described by ReadTenancies()) into the library.
+func LoadTenancies(backend interface{}) (err error) {
+	var ts Tenancies
+	switch v := backend.(type) {
+	case Tenancies:
+		ts = v
+	case io.Reader:
+		ts, err = ReadTenancies(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		ts, err = ReadTenancies(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		tenancyMu.Lock()
+		tenancies = ts
+		tenancyMu.Unlock()
+	}
+
+	return
+}
+
+// ReadTenancies reads the tenancies from the given r io.Reader, which must have the format
+// (with @role in place of the user name for the tenancies of roles):
+//
+// 		username:prefix[:suffix]
+func ReadTenancies(r io.Reader) (ts Tenancies, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	ts = Tenancies{}
+	for _, line := range strings.Split(string(rawData), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.Split(line, ":")
+		if len(tokens) < 2 || len(tokens) > 3 || tokens[0] == "" {
+			return nil, errors.New("Invalid tenancy line: " + line)
+		}
+
+		t := Tenancy{Prefix: tokens[1]}
+		if len(tokens) == 3 {
+			t.Suffix = tokens[2]
+		}
+
+		if t.Prefix == "" && t.Suffix == "" || !tenancyRE.MatchString(t.Prefix+t.Suffix) {
+			return nil, errors.New("Invalid tenancy line: " + line)
+		}
+
+		ts[tokens[0]] = t
+	}
+
+	return
+}
+
+// TenancyFor returns the tenancy of id: their own or else that of their first role having
+// one. It returns nil when id is not a tenant.
+func TenancyFor(id aa.Identity) *Tenancy {
+	tenancyMu.RLock()
+	ts := tenancies
+	tenancyMu.RUnlock()
+
+	if t, ok := ts[id.User]; ok {
+		return &t
+	}
+
+	for _, group := range id.Groups {
+		if t, ok := ts["@"+group]; ok {
+			return &t
+		}
+	}
+
+	return nil
+}
+
+// Index returns the physical name of the index (or index expression) the tenant calls name.
+func (t Tenancy) Index(name string) string {
+	switch {
+	case name == "" || name == "_all":
+		return t.Prefix + "*" + t.Suffix
+	case strings.HasPrefix(name, "-"):
+		return "-" + t.Index(name[1:])
+	case strings.HasPrefix(name, "<") && strings.HasSuffix(name, ">"):
+		return "<" + t.Index(name[1:len(name)-1]) + ">"
+	}
+
+	return t.Prefix + name + t.Suffix
+}
+
+// indices rewrites a comma separated list of index expressions.
+func (t Tenancy) indices(expr string) string {
+	names := strings.Split(expr, ",")
+	for i, name := range names {
+		names[i] = t.Index(name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// RewriteRequest rewrites the index names of the request r (in its path and, for the bulk,
+// multi search and multi get APIs, in its body) to the physical ones, or fails with
+// ErrUnsafeRequest for the requests it can not rewrite.
+func (t Tenancy) RewriteRequest(r *http.Request) (err error) {
+	segments := Segments(r.URL.Path)
+	api, rest := API(r.URL.Path)
+
+	switch {
+	case len(segments) == 0:
+	case !strings.HasPrefix(segments[0], "_") || IndexExpression(segments[0]):
+		segments[0] = t.indices(segments[0])
+	case api == "_search" && rest == "scroll", api == "_async_search" && rest != "":
+		// continuations of searches which were already rewritten
+	default:
+		rewritten := false
+		for prefix, pos := range indexedAPIs {
+			if !hasPrefix(segments, strings.Split(prefix, "/")) {
+				continue
+			} else if len(segments) < pos {
+				return fmt.Errorf("%w: %s requires its indices", ErrUnsafeRequest, prefix)
+			}
+
+			if len(segments) == pos {
+				segments = append(segments, t.Index(""))
+			} else {
+				segments[pos] = t.indices(segments[pos])
+			}
+			rewritten = true
+		}
+
+		if !rewritten && tenantWideAPIs[api] && r.Method != "DELETE" {
+			segments, rewritten = append([]string{t.Index("")}, segments...), true
+		}
+
+		if anyMethod, ok := untenantedAPIs[api]; !rewritten && (!ok || !anyMethod && r.Method != "GET" && r.Method != "HEAD") {
+			return fmt.Errorf("%w: %s is not available", ErrUnsafeRequest, api)
+		}
+	}
+
+	r.URL.Path, r.URL.RawPath = "/"+strings.Join(segments, "/"), ""
+
+	switch api {
+	case "_bulk", "_msearch", "_mget":
+		body, err := ReadBody(r)
+		if err != nil {
+			return err
+		}
+
+		if body, err = t.rewriteBody(api, body); err != nil {
+			return err
+		}
+		SetBody(r, body)
+	}
+
+	return
+}
+
+// rewriteBody rewrites the index names in the body of a bulk, multi search or multi get request.
+func (t Tenancy) rewriteBody(api string, body []byte) ([]byte, error) {
+	if api == "_mget" {
+		var mget map[string]interface{}
+		if err := json.Unmarshal(body, &mget); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+
+		docs, _ := mget["docs"].([]interface{})
+		for _, doc := range docs {
+			if d, ok := doc.(map[string]interface{}); ok {
+				if index, ok := d["_index"].(string); ok {
+					d["_index"] = t.Index(index)
+				}
+			}
+		}
+
+		return json.Marshal(mget)
+	}
+
+	var out bytes.Buffer
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		var header map[string]interface{}
+		if err := json.Unmarshal(lines[i], &header); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeRequest, err)
+		}
+
+		hasBody := true
+		if api == "_msearch" {
+			t.rewriteIndexField(header, "index")
+			t.rewriteIndexField(header, "indices")
+		} else {
+			for action, meta := range header {
+				if m, ok := meta.(map[string]interface{}); ok {
+					t.rewriteIndexField(m, "_index")
+				}
+				hasBody = action != "delete"
+			}
+		}
+
+		line, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+
+		if hasBody && i+1 < len(lines) {
+			i++
+			out.Write(lines[i])
+			out.WriteByte('\n')
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// rewriteIndexField rewrites the index names held by m[key] (a string or a list).
+func (t Tenancy) rewriteIndexField(m map[string]interface{}, key string) {
+	switch v := m[key].(type) {
+	case string:
+		m[key] = t.indices(v)
+	case []interface{}:
+		for i, index := range v {
+			if s, ok := index.(string); ok {
+				v[i] = t.Index(s)
+			}
+		}
+	}
+}
+
+// indexNamingKeys lists the keys of the JSON responses whose values (strings or lists of
+// strings) name indices.
+var indexNamingKeys = map[string]bool{
+	"_index": true, "index": true, "indices": true, "i": true, "idx": true, "resource.id": true, "reason": true,
+}
+
+// nameRE matches the words of a response which may be index names.
+var nameRE = regexp.MustCompile(`[A-Za-z0-9_.+*-]+`)
+
+// name returns the name seen by the tenant for the physical index name (or any other word).
+func (t Tenancy) name(word string) string {
+	if len(word) > len(t.Prefix)+len(t.Suffix) && strings.HasPrefix(word, t.Prefix) && strings.HasSuffix(word, t.Suffix) {
+		return word[len(t.Prefix) : len(word)-len(t.Suffix)]
+	}
+
+	return word
+}
+
+// names rewrites all the physical index names in s.
+func (t Tenancy) names(s string) string {
+	return nameRE.ReplaceAllStringFunc(s, t.name)
+}
+
+// RewriteResponse rewrites the physical index names in the response body of a request,
+// back to the names seen by the tenant. In JSON responses, only the values of the keys
+// naming indices (see indexNamingKeys) and the keys of the objects keyed by index name (the
+// top level ones and indices) are rewritten, never the values coming from the documents.
+// Other text responses (i.e. _cat ones) are rewritten everywhere.
+func (t Tenancy) RewriteResponse(body []byte, contentType string) ([]byte, error) {
+	if !strings.Contains(contentType, "json") {
+		if !strings.HasPrefix(contentType, "text/") && !strings.Contains(contentType, "yaml") {
+			return nil, errors.New("can not rewrite " + contentType + " responses")
+		}
+
+		return []byte(t.names(string(body))), nil
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(t.rewriteNames(v, true))
+}
+
+// rewriteNames rewrites the index names in the JSON value v (see RewriteResponse), whose
+// keys are index names when keyedByIndex.
+func (t Tenancy) rewriteNames(v interface{}, keyedByIndex bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		rewritten := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			switch value := value.(type) {
+			case string:
+				if indexNamingKeys[key] {
+					v[key] = t.names(value)
+				}
+			case []interface{}:
+				if indexNamingKeys[key] {
+					for i, name := range value {
+						if s, ok := name.(string); ok {
+							value[i] = t.names(s)
+						}
+					}
+				} else if key != "sort" {
+					t.rewriteNames(value, false)
+				}
+			case map[string]interface{}:
+				if key != "_source" && key != "fields" && key != "highlight" {
+					v[key] = t.rewriteNames(value, key == "indices")
+				}
+			}
+
+			if keyedByIndex {
+				rewritten[t.name(key)] = v[key]
+			} else {
+				rewritten[key] = v[key]
+			}
+		}
+
+		return rewritten
+	case []interface{}:
+		for i, value := range v {
+			v[i] = t.rewriteNames(value, false)
+		}
+	}
+
+	return v
+}
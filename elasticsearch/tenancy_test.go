@@ -0,0 +1,120 @@
+package elasticsearch
+
+import (
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var teamA = Tenancy{Prefix: "teama-"}
+
+func TestReadTenancies(t *testing.T) {
+	ts, err := ReadTenancies(strings.NewReader("foo:teama-\n@teamb:teamb-:-prod\n"))
+	if err != nil || ts["foo"] != teamA || ts["@teamb"] != (Tenancy{"teamb-", "-prod"}) {
+		t.Error("Unexpected tenancies", ts, err)
+	}
+
+	for _, bogus := range []string{"foo\n", "foo:\n", "foo:TeamA-\n", "foo:a:b:c\n", ":a\n"} {
+		if _, err := ReadTenancies(strings.NewReader(bogus)); err == nil {
+			t.Errorf("Line %q should be rejected", bogus)
+		}
+	}
+}
+
+func TestTenancyFor(t *testing.T) {
+	LoadTenancies(Tenancies{"foo": teamA, "@teamb": {Prefix: "teamb-"}})
+	defer LoadTenancies(Tenancies(nil))
+
+	if tn := TenancyFor(aa.Identity{User: "foo", Groups: []string{"teamb"}}); tn == nil || *tn != teamA {
+		t.Error("Unexpected tenancy", tn)
+	}
+
+	if tn := TenancyFor(aa.Identity{User: "bar", Groups: []string{"readers", "teamb"}}); tn == nil || tn.Prefix != "teamb-" {
+		t.Error("Unexpected tenancy", tn)
+	}
+
+	if tn := TenancyFor(aa.Identity{User: "bar"}); tn != nil {
+		t.Error("Expected no tenancy, got", tn)
+	}
+}
+
+func TestTenancyIndex(t *testing.T) {
+	tn := Tenancy{"a-", "-x"}
+	for name, expected := range map[string]string{
+		"events": "a-events-x", "_all": "a-*-x", "ev*": "a-ev*-x", "-old": "-a-old-x", "<logs-{now/d}>": "<a-logs-{now/d}-x>",
+	} {
+		if actual := tn.Index(name); actual != expected {
+			t.Errorf("Expected %s for %s got %s", expected, name, actual)
+		}
+	}
+}
+
+func TestTenancyRewriteRequest(t *testing.T) {
+	cases := map[string]struct {
+		method, url, body      string
+		expectedPath, expected string
+	}{
+		"index path":   {"GET", "/events,metrics/_search", "", "/teama-events,teama-metrics/_search", ""},
+		"root search":  {"POST", "/_search", "{}", "/teama-*/_search", "{}"},
+		"cat":          {"GET", "/_cat/indices", "", "/_cat/indices/teama-*", ""},
+		"cat index":    {"GET", "/_cat/indices/ev*", "", "/_cat/indices/teama-ev*", ""},
+		"cluster wide": {"GET", "/_nodes/stats", "", "/_nodes/stats", ""},
+		"all":          {"GET", "/_all", "", "/teama-*", ""},
+		"all search":   {"POST", "/_all/_search", "{}", "/teama-*/_search", "{}"},
+		"all doc":      {"GET", "/_all/_doc/1", "", "/teama-*/_doc/1", ""},
+		"scroll":       {"POST", "/_search/scroll", "{}", "/_search/scroll", "{}"},
+		"bulk": {"POST", "/_bulk", "{\"index\":{\"_index\":\"events\"}}\n{\"a\":1}\n{\"delete\":{\"_index\":\"events\",\"_id\":\"1\"}}\n{\"update\":{\"_index\":\"events\",\"_id\":\"2\"}}\n{\"doc\":{}}\n",
+			"/_bulk", "{\"index\":{\"_index\":\"teama-events\"}}\n{\"a\":1}\n{\"delete\":{\"_id\":\"1\",\"_index\":\"teama-events\"}}\n{\"update\":{\"_id\":\"2\",\"_index\":\"teama-events\"}}\n{\"doc\":{}}\n"},
+		"msearch": {"POST", "/_msearch", "{\"index\":[\"events\"]}\n{}\n{\"indices\":[\"other-*\"]}\n{}\n", "/teama-*/_msearch", "{\"index\":[\"teama-events\"]}\n{}\n{\"indices\":[\"teama-other-*\"]}\n{}\n"},
+		"mget":    {"POST", "/_mget", `{"docs":[{"_index":"events","_id":"1"}]}`, "/_mget", `{"docs":[{"_id":"1","_index":"teama-events"}]}`},
+	}
+
+	for name, c := range cases {
+		req := searchReq(c.method, c.url, c.body)
+		if err := teamA.RewriteRequest(req); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.Path != c.expectedPath || string(body) != c.expected {
+			t.Errorf("%s: expected %s %q got %s %q", name, c.expectedPath, c.expected, req.URL.Path, body)
+		}
+	}
+
+	for _, req := range []struct{ method, url string }{
+		{"POST", "/_reindex"}, {"POST", "/_aliases"}, {"GET", "/_aliases"}, {"GET", "/_resolve/index/*"},
+		{"GET", "/_data_stream"}, {"PUT", "/_index_template/logs"}, {"POST", "/_sql"}, {"DELETE", "/_nodes/x"},
+		{"GET", "/_cluster/state"},
+	} {
+		if err := teamA.RewriteRequest(searchReq(req.method, req.url, "{}")); !errors.Is(err, ErrUnsafeRequest) {
+			t.Errorf("%s %s: expected ErrUnsafeRequest got %v", req.method, req.url, err)
+		}
+	}
+}
+
+func TestTenancyRewriteResponse(t *testing.T) {
+	json := `{"_index":"teama-events","_source":{"note":"teama-events"},"error":{"reason":"no such index [teama-metrics]"},"teama-logs":{"n":12345678901234567890}}`
+	expected := `{"_index":"events","_source":{"note":"teama-events"},"error":{"reason":"no such index [metrics]"},"logs":{"n":12345678901234567890}}`
+	if actual, err := teamA.RewriteResponse([]byte(json), "application/json"); err != nil || string(actual) != expected {
+		t.Errorf("Expected %s got %s (%v)", expected, actual, err)
+	}
+
+	// The values coming from the documents are left alone.
+	json = `{"hits":{"hits":[{"_id":"teama-1","_index":"teama-a","highlight":{"m":["teama-x"]},"sort":["teama-y"]}]},"aggregations":{"a":{"buckets":[{"key":"teama-z"}]}},"indices":{"teama-b":{}}}`
+	expected = `{"aggregations":{"a":{"buckets":[{"key":"teama-z"}]}},"hits":{"hits":[{"_id":"teama-1","_index":"a","highlight":{"m":["teama-x"]},"sort":["teama-y"]}]},"indices":{"b":{}}}`
+	if actual, err := teamA.RewriteResponse([]byte(json), "application/json"); err != nil || string(actual) != expected {
+		t.Errorf("Expected %s got %s (%v)", expected, actual, err)
+	}
+
+	cat := "green open teama-events uuid 1 1\ngreen open teama- x 1 1\n"
+	if actual, _ := teamA.RewriteResponse([]byte(cat), "text/plain; charset=UTF-8"); string(actual) != "green open events uuid 1 1\ngreen open teama- x 1 1\n" {
+		t.Error("Unexpected _cat response", string(actual))
+	}
+
+	if _, err := teamA.RewriteResponse([]byte("x"), "application/smile"); err == nil {
+		t.Error("Binary responses can not be rewritten")
+	}
+}
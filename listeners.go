@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+Requests are authenticated by a chain of authentication providers (see aa.Authenticator),
+tried in order until one of them passes the request. The chain is given as a comma
+separated list of provider names:
+
+	static    the credentials and roles (see -cpath, -rpath and -store)
+	ldap      the LDAP directory (see -ldap-url)
+	htpasswd  an Apache htpasswd file (see -htpasswd)
+	apikey    Elasticsearch style API keys (see -apikeys)
+	jwt       JSON Web Tokens (see -jwt-secret and -jwt-key)
+	cert      TLS client certificates (https listeners only, see -tls-client-ca)
+	header    an authenticating proxy passing the user in a header (see -trusted-proxies)
+
+The -frontend listener uses the -auth-chain chain. Additional listeners, each with its
+own chain, can be given via (repeated) -listen flags:
+
+	-listen [https://]address[=provider1,provider2,...,providerN]
+
+https listeners use the -tls-cert and -tls-key certificate. The identity established by
+the chain (user, groups and attributes) is what authorization and logging work with.
+*/
+
+// defaultAuthChain is the authentication chain used when none is given.
+const defaultAuthChain = "static,ldap"
+
+// listener is a (frontend) address the proxy accepts requests on, together with the
+// authentication chain for those requests.
+type listener struct {
+	Addr  string
+	TLS   bool
+	Chain string
+	auth  aa.Authenticator
+}
+
+// listenersFlag collects the listeners given via -listen.
+type listenersFlag []listener
+
+// AuthChain holds the authentication chain of the -frontend listener.
+var AuthChain string
+
+// Listeners holds the additional listeners.
+var Listeners listenersFlag
+
+// TLSCertPath and TLSKeyPath hold the paths to the certificate and key of the https listeners.
+var TLSCertPath, TLSKeyPath string
+
+// TLSClientCAPath holds the path to the PEM file with the CA certificates client certificates
+// are verified against (client certificates are not requested when empty).
+var TLSClientCAPath string
+
+// HtpasswdPath holds the path to the htpasswd file of the htpasswd provider.
+var HtpasswdPath string
+
+// APIKeysPath holds the path to the API keys file of the apikey provider.
+var APIKeysPath string
+
+// JWT holds the settings of the jwt provider (the key is given via JWTSecret or JWTKeyPath).
+var JWT aa.JWTAuthenticator
+
+// JWTSecret holds the HMAC secret JWTs are verified with.
+var JWTSecret string
+
+// JWTKeyPath holds the path to the PEM encoded public key (or certificate) JWTs are verified with.
+var JWTKeyPath string
+
+// TrustedHeaders holds the settings of the header provider (the proxies are given via TrustedProxies).
+var TrustedHeaders aa.TrustedHeaderAuthenticator
+
+// TrustedProxies holds the comma separated list of CIDRs the authenticating proxies connect from.
+var TrustedProxies string
+
+// authChain is the authentication chain of the -frontend listener.
+var authChain aa.Authenticator = aa.Chain{aa.StaticAuthenticator{}, aa.LDAPAuthenticator{}}
+
+func (l *listenersFlag) String() string {
+	if l == nil {
+		return ""
+	}
+
+	var list []string
+	for _, ln := range *l {
+		list = append(list, ln.String())
+	}
+
+	return strings.Join(list, " ")
+}
+
+func (l *listenersFlag) Set(value string) (err error) {
+	ln, err := parseListener(value)
+	if err == nil {
+		*l = append(*l, ln)
+	}
+
+	return
+}
+
+func (l listener) String() (s string) {
+	if s = l.Addr; l.TLS {
+		s = "https://" + s
+	}
+
+	return s + "=" + l.Chain
+}
+
+// parseListener parses a listener given as [https://]address[=provider1,...,providerN].
+func parseListener(value string) (l listener, err error) {
+	tokens := strings.SplitN(value, "=", 2)
+	l.Addr, l.Chain = tokens[0], defaultAuthChain
+	if len(tokens) == 2 {
+		l.Chain = tokens[1]
+	}
+
+	if strings.HasPrefix(l.Addr, "https://") {
+		l.Addr, l.TLS = strings.TrimPrefix(l.Addr, "https://"), true
+	} else {
+		l.Addr = strings.TrimPrefix(l.Addr, "http://")
+	}
+
+	if l.Addr == "" || l.Chain == "" {
+		err = errors.New("Invalid listener " + value)
+	}
+
+	return
+}
+
+// initAuthenticators builds the authentication chains of all the listeners.
+func initAuthenticators() (err error) {
+	chain := AuthChain
+	if chain == "" {
+		chain = defaultAuthChain
+	}
+
+	providers := map[string]aa.Authenticator{}
+	if authChain, err = newAuthChain(chain, providers); err != nil {
+		return
+	}
+
+	for i := range Listeners {
+		if Listeners[i].auth, err = newAuthChain(Listeners[i].Chain, providers); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// newAuthChain builds the authentication chain for the comma separated list of provider
+// names, reusing (and adding to) the already built providers.
+func newAuthChain(names string, providers map[string]aa.Authenticator) (chain aa.Chain, err error) {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		p, ok := providers[name]
+		if !ok {
+			if p, err = newAuthenticator(name); err != nil {
+				return
+			}
+			providers[name] = p
+		}
+
+		chain = append(chain, p)
+	}
+
+	return
+}
+
+func newAuthenticator(name string) (a aa.Authenticator, err error) {
+	switch name {
+	case "static":
+		return aa.StaticAuthenticator{}, nil
+	case "ldap":
+		return aa.LDAPAuthenticator{}, nil
+	case "cert":
+		return aa.ClientCertAuthenticator{}, nil
+	case "htpasswd":
+		if HtpasswdPath == "" {
+			return nil, errors.New("The htpasswd authenticator requires -htpasswd")
+		}
+
+		return aa.LoadHtpasswd(HtpasswdPath)
+	case "apikey":
+		if APIKeysPath == "" {
+			return nil, errors.New("The apikey authenticator requires -apikeys")
+		}
+
+		return aa.LoadAPIKeys(APIKeysPath)
+	case "jwt":
+		j := JWT
+		j.Secret = []byte(JWTSecret)
+		if JWTKeyPath != "" {
+			if j.PublicKey, err = aa.LoadJWTPublicKey(JWTKeyPath); err != nil {
+				return
+			}
+			j.Secret = nil
+		} else if JWTSecret == "" {
+			return nil, errors.New("The jwt authenticator requires -jwt-secret or -jwt-key")
+		}
+
+		return &j, nil
+	case "header":
+		t := TrustedHeaders
+		if t.Proxies, err = aa.ParseCIDRs(TrustedProxies); err != nil {
+			return
+		} else if len(t.Proxies) == 0 {
+			return nil, errors.New("The header authenticator requires -trusted-proxies")
+		}
+
+		return &t, nil
+	}
+
+	return nil, errors.New("Unknown authenticator " + name)
+}
+
+// tlsConfig builds the TLS configuration of the https listeners.
+func tlsConfig() (cfg *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(TLSCertPath, TLSKeyPath)
+	if err != nil {
+		return
+	}
+
+	cfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if TLSClientCAPath != "" {
+		pem, err := ioutil.ReadFile(TLSClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs, cfg.ClientAuth = x509.NewCertPool(), tls.VerifyClientCertIfGiven
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + TLSClientCAPath)
+		}
+	}
+
+	return
+}
+
+// serveListener serves the reverse proxy to uri on l, authenticating requests with l's chain.
+func serveListener(l listener, uri *url.URL) error {
+	srv := &http.Server{
+		Addr:              l.Addr,
+		Handler:           initReverseProxy(uri, wrapCache, wrapSniffing, wrapListing, wrapTenancy, wrapFieldSecurity, wrapDocumentSecurity, wrapCostControls, wrapCursorOwnership, wrapScripts, wrapGuardrails, wrapBodyLimits, wrapQuotas, wrapAuthorization, authenticateWith(l.auth), wrapMethodOverride, wrapNormalization),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if !l.TLS {
+		return srv.ListenAndServe()
+	}
+
+	cfg, err := tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = cfg
+
+	return srv.ListenAndServeTLS("", "")
+}
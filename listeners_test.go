@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseListener(t *testing.T) {
+	for value, expected := range map[string]listener{
+		":9700":                     {Addr: ":9700", Chain: "static,ldap"},
+		"http://:9700=jwt":          {Addr: ":9700", Chain: "jwt"},
+		"https://:9743=cert,apikey": {Addr: ":9743", TLS: true, Chain: "cert,apikey"},
+	} {
+		if actual, err := parseListener(value); err != nil || actual.Addr != expected.Addr || actual.TLS != expected.TLS || actual.Chain != expected.Chain {
+			t.Errorf("Expected %v for %q got %v (%v)", expected, value, actual, err)
+		}
+	}
+
+	for _, value := range []string{"", "=jwt", ":9700="} {
+		if _, err := parseListener(value); err == nil {
+			t.Errorf("Listener %q should be rejected", value)
+		}
+	}
+
+	var l listenersFlag
+	if l.Set("https://:9743=cert") != nil || l.String() != "https://:9743=cert" {
+		t.Error("Unexpected listeners", l.String())
+	}
+}
+
+func TestInitAuthenticators(t *testing.T) {
+	defer func() { AuthChain, Listeners, APIKeysPath = "", nil, "" }()
+
+	AuthChain = "static,bogus"
+	if err := initAuthenticators(); err == nil {
+		t.Error("Unknown authenticators should be rejected")
+	}
+
+	for _, chain := range []string{"htpasswd", "apikey", "jwt", "header"} {
+		if AuthChain = chain; initAuthenticators() == nil {
+			t.Errorf("The %s authenticator should require its settings", chain)
+		}
+	}
+
+	f, _ := ioutil.TempFile("", "apikeys")
+	defer os.Remove(f.Name())
+	f.WriteString("k1:" + aa.Hash("secret") + ":shipper:writers\n")
+	f.Close()
+
+	AuthChain, APIKeysPath, Listeners = "", f.Name(), listenersFlag{{Addr: ":9700", Chain: "apikey,static"}}
+	if err := initAuthenticators(); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain, ok := authChain.(aa.Chain); !ok || len(chain) != 2 {
+		t.Error("The default chain should have been used, got", authChain)
+	}
+
+	loadCredentials()
+	loadAuthorizations()
+	req, _ := http.NewRequest("GET", "/_cluster/health", nil)
+	req.Header.Set("Authorization", "ApiKey "+base64.StdEncoding.EncodeToString([]byte("k1:secret")))
+
+	var id aa.Identity
+	handler := authenticateWith(Listeners[0].auth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ = aa.FromContext(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if id.User != "shipper" || !id.HasGroup("writers") || req.Header.Get("X-Authenticated-User") != "shipper" {
+		t.Error("Unexpected identity", id)
+	}
+}
+
+func TestLogPrintWithIPv6(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[::1]:1234"
+	logPrint(req.WithContext(aa.NewContext(req.Context(), aa.Identity{User: "foo"})), "test")
+}
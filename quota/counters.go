@@ -0,0 +1,222 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexaandru/elastic_guardian/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Counters holds the usage of the users (and of the roles, under "@role" keys) over the
+// current day and month. The usage of the previous periods is dropped as soon as a new one
+// starts.
+type Counters struct {
+	path  string
+	mu    sync.Mutex
+	data  countersData
+	dirty bool
+}
+
+// countersData is what Counters persist.
+type countersData struct {
+	Day   string                `json:"day"`
+	Month string                `json:"month"`
+	Users map[string]*userUsage `json:"users"`
+}
+
+// userUsage holds the usage of one user (or role) over the current day and month.
+type userUsage struct {
+	Day   Usage `json:"day"`
+	Month Usage `json:"month"`
+}
+
+// ExhaustedError is returned by Counters.Check() for the users who exhausted a quota.
+type ExhaustedError struct {
+	// Period is "daily" or "monthly".
+	Period string
+	// Limit names the exhausted limit, i.e. "requests quota of 1000".
+	Limit string
+	// Until is when the quota is replenished.
+	Until time.Time
+}
+
+// now returns the current time (replaceable in tests).
+var now = time.Now
+
+// Open opens the counters persisted at path (see Save()), if any, or new ones otherwise.
+func Open(path string) (c *Counters, err error) {
+	c = &Counters{path: path}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(raw, &c.data); err != nil {
+		return nil, fmt.Errorf("Invalid quota counters %s: %v", path, err)
+	}
+
+	return
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("%s %s exhausted", e.Period, e.Limit)
+}
+
+// Check determines if user may make one more request, with ingest bytes of body (-1 when
+// unknown), under the quotas qs (see QuotaFor(), nil standing for no quota). The request is
+// charged to the first (by name) of qs which has room for it, whose name is returned. It is
+// counted right away, so that concurrent requests can not overrun the quotas, while the
+// rest of its usage is to be added by Add(), once known.
+func (c *Counters) Check(user string, qs Quotas, ingest int64) (owner string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollover()
+	owners := []string{}
+	for name := range qs {
+		owners = append(owners, name)
+	}
+	sort.Strings(owners)
+
+	for _, owner = range owners {
+		if err = c.exhausted(owner, qs[owner], ingest); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+	c.add(user, owner, Usage{Requests: 1})
+
+	return
+}
+
+// exhausted returns the ExhaustedError of the quota q of owner, if their usage reached it
+// (c.mu must be held).
+func (c *Counters) exhausted(owner string, q Quota, ingest int64) error {
+	var day, month Usage
+	if uu := c.data.Users[owner]; uu != nil {
+		day, month = uu.Day, uu.Month
+	}
+
+	t := now().UTC()
+	if limit := q.Daily.exceeded(day, ingest); limit != "" {
+		return &ExhaustedError{"daily", limit, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)}
+	} else if limit = q.Monthly.exceeded(month, ingest); limit != "" {
+		return &ExhaustedError{"monthly", limit, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+
+	return nil
+}
+
+// Add adds u to the usage of user and of the owner of the quota their request was charged
+// to (see Check()), if any.
+func (c *Counters) Add(user, owner string, u Usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollover()
+	c.add(user, owner, u)
+}
+
+// add adds u to the usage of user and owner (c.mu must be held).
+func (c *Counters) add(user, owner string, u Usage) {
+	names := []string{user}
+	if owner != "" && owner != user {
+		names = append(names, owner)
+	}
+
+	for _, name := range names {
+		uu := c.data.Users[name]
+		if uu == nil {
+			uu = &userUsage{}
+			c.data.Users[name] = uu
+		}
+
+		uu.Day, uu.Month = uu.Day.add(u), uu.Month.add(u)
+	}
+	c.dirty = true
+}
+
+// Usage returns the usage of user over the current day and month.
+func (c *Counters) Usage(user string) (day, month Usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollover()
+	if uu := c.data.Users[user]; uu != nil {
+		day, month = uu.Day, uu.Month
+	}
+
+	return
+}
+
+// Save persists the counters (atomically), if they changed since they were last saved.
+func (c *Counters) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	err := store.WriteFileAtomically(c.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(c.data)
+	})
+	if err == nil {
+		c.dirty = false
+	}
+
+	return err
+}
+
+// Report writes the usage of all the users (and roles) over the current day and month to w, as a table.
+func (c *Counters) Report(w io.Writer) error {
+	c.mu.Lock()
+	c.rollover()
+	users := []string{}
+	for user := range c.data.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPERIOD\tREQUESTS\tINGESTED\tRETURNED")
+	for _, user := range users {
+		uu := c.data.Users[user]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", user, c.data.Day, uu.Day.Requests, uu.Day.Ingested, uu.Day.Returned)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", user, c.data.Month, uu.Month.Requests, uu.Month.Ingested, uu.Month.Returned)
+	}
+	c.mu.Unlock()
+
+	return tw.Flush()
+}
+
+// rollover drops the usage of the past day and month (c.mu must be held).
+func (c *Counters) rollover() {
+	t := now().UTC()
+	day, month := t.Format("2006-01-02"), t.Format("2006-01")
+	if c.data.Users == nil {
+		c.data.Users = map[string]*userUsage{}
+	}
+
+	if c.data.Month != month {
+		c.data.Month, c.data.Users, c.dirty = month, map[string]*userUsage{}, true
+	}
+
+	if c.data.Day != day {
+		c.data.Day, c.dirty = day, true
+		for _, uu := range c.data.Users {
+			uu.Day = Usage{}
+		}
+	}
+}
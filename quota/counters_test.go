@@ -0,0 +1,112 @@
+package quota
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at makes now return the (RFC 3339) time t, until the test ends.
+func at(t *testing.T, rfc3339 string) {
+	ts, err := time.Parse(time.RFC3339, rfc3339)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = func() time.Time { return ts }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "usage.json")
+	c, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at(t, "2026-10-18T10:00:00Z")
+	q := Quota{Daily: Usage{Requests: 2}, Monthly: Usage{Returned: 1000}}
+	for i := 0; i < 2; i++ {
+		if owner, err := c.Check("foo", Quotas{"foo": q}, 0); err != nil || owner != "foo" {
+			t.Fatal(owner, err)
+		}
+		c.Add("foo", "foo", Usage{Ingested: 10, Returned: 300})
+	}
+
+	_, err = c.Check("foo", Quotas{"foo": q}, 0)
+	if e, ok := err.(*ExhaustedError); !ok || e.Error() != "daily requests quota of 2 exhausted" || !e.Until.Equal(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("Expected the daily quota to be exhausted, got", err)
+	}
+
+	if _, err = c.Check("bar", Quotas{"bar": q}, 0); err != nil {
+		t.Error("Only foo's quota should be exhausted, got", err)
+	}
+
+	if err = c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters survive restarts, and the days (then the months) roll over.
+	if c, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	at(t, "2026-10-19T10:00:00Z")
+	if day, month := c.Usage("foo"); day != (Usage{}) || month != (Usage{2, 20, 600}) {
+		t.Fatal("Unexpected usage", day, month)
+	}
+
+	c.Add("foo", "", Usage{Requests: 1, Returned: 400})
+	_, err = c.Check("foo", Quotas{"foo": q}, 0)
+	if e, ok := err.(*ExhaustedError); !ok || e.Period != "monthly" || !e.Until.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("Expected the monthly quota to be exhausted, got", err)
+	}
+
+	var report bytes.Buffer
+	if err = c.Report(&report); err != nil || !strings.Contains(report.String(), "foo   2026-10     3         20        1000") {
+		t.Error("Unexpected report", report.String(), err)
+	}
+
+	at(t, "2026-11-01T00:00:00Z")
+	if _, err = c.Check("foo", Quotas{"foo": q}, 0); err != nil {
+		t.Error("The quota should be replenished, got", err)
+	}
+
+	ioutil.WriteFile(path, []byte("bogus"), 0600)
+	if _, err = Open(path); err == nil {
+		t.Error("Bogus counters should be rejected")
+	}
+}
+
+func TestCountersRoleQuotas(t *testing.T) {
+	c := &Counters{}
+	at(t, "2026-10-18T10:00:00Z")
+
+	// The requests are counted as soon as they are checked, against the first role with room.
+	quotas := Quotas{"@analysts": {Daily: Usage{Requests: 2}}, "@ops": {Daily: Usage{Requests: 1}}}
+	for i, expected := range []string{"@analysts", "@analysts", "@ops"} {
+		if owner, err := c.Check("foo", quotas, 0); err != nil || owner != expected {
+			t.Fatalf("Expected request #%d to be charged to %s, got %s (%v)", i, expected, owner, err)
+		}
+	}
+
+	if _, err := c.Check("bar", quotas, 0); err == nil {
+		t.Error("The role quotas should be shared by all their members")
+	}
+
+	if day, _ := c.Usage("@analysts"); day != (Usage{Requests: 2}) {
+		t.Error("Unexpected role usage", day)
+	} else if day, _ = c.Usage("foo"); day != (Usage{Requests: 3}) {
+		t.Error("Unexpected user usage", day)
+	}
+}
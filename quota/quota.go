@@ -0,0 +1,195 @@
+/*
+Package quota implements the usage quotas of the guardian: how many requests, ingested
+(request body) bytes and returned (response body) bytes each user may send through it per
+day and per month.
+
+The quotas are defined per user or per role (see ReadQuotas()). The usage is counted per
+user and, for the users limited by the quotas of their roles, per role as well: a role
+quota caps the usage of all the members of the role together. The counters are persisted
+to a file, so that they survive restarts. The days and months are the UTC ones.
+*/
+package quota
+
+import (
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Usage holds the usage of a user over a period or, as a limit, the most that is allowed
+// over it (0 standing for no limit).
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Ingested int64 `json:"ingested"`
+	Returned int64 `json:"returned"`
+}
+
+// Quota holds the daily and monthly limits of one user or role.
+type Quota struct {
+	Daily, Monthly Usage
+}
+
+// Quotas holds the quotas, by user or by role (under "@role" keys).
+type Quotas map[string]Quota
+
+// quotas holds the loaded quotas.
+var quotas Quotas
+
+// quotasMu guards quotas.
+var quotasMu sync.RWMutex
+
+// LoadQuotas loads the quotas from backend: a Quotas variable, an io.Reader or a file name
+// (see ReadQuotas() for the format).
+func LoadQuotas(backend interface{}) (err error) {
+	var q Quotas
+	switch v := backend.(type) {
+	case Quotas:
+		q = v
+	case io.Reader:
+		q, err = ReadQuotas(v)
+	case string: // assume filename
+		f, e := os.Open(v)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		q, err = ReadQuotas(f)
+	default:
+		err = errors.New("don't know how to handle backend")
+	}
+
+	if err == nil {
+		quotasMu.Lock()
+		quotas = q
+		quotasMu.Unlock()
+	}
+
+	return
+}
+
+// ReadQuotas reads the quotas from r. The file must have the format:
+//
+// 		name:day|month:limit1=value1,...,limitN=valueN
+//
+// where name is a user or a role (as "@role") and the limits are requests (a number),
+// ingested and returned (sizes, see es.ParseSize), i.e.:
+//
+// 		@analysts:day:requests=10000,returned=5gb
+// 		@analysts:month:requests=200000,returned=100gb
+// 		shipper:month:ingested=500gb
+func ReadQuotas(r io.Reader) (q Quotas, err error) {
+	rawData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	q = Quotas{}
+	for _, line := range strings.Split(strings.Trim(string(rawData), "\n"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 3)
+		if len(tokens) != 3 || tokens[0] == "" {
+			return nil, errors.New("Invalid quota line: " + line)
+		}
+
+		quota := q[tokens[0]]
+		limits := &quota.Daily
+		if tokens[1] == "month" {
+			limits = &quota.Monthly
+		} else if tokens[1] != "day" {
+			return nil, errors.New("Unknown quota period " + tokens[1])
+		}
+
+		if err = parseLimits(tokens[2], limits); err != nil {
+			return nil, fmt.Errorf("Invalid quota for %s: %v", tokens[0], err)
+		}
+		q[tokens[0]] = quota
+	}
+
+	return
+}
+
+func parseLimits(s string, limits *Usage) (err error) {
+	for _, limit := range strings.Split(s, ",") {
+		tokens := strings.SplitN(strings.TrimSpace(limit), "=", 2)
+		if len(tokens) != 2 {
+			return errors.New("invalid limit " + limit)
+		}
+
+		switch tokens[0] {
+		case "requests":
+			if limits.Requests, err = strconv.ParseInt(tokens[1], 10, 64); err == nil && limits.Requests < 0 {
+				err = errors.New("invalid number of requests " + tokens[1])
+			}
+		case "ingested":
+			limits.Ingested, err = es.ParseSize(tokens[1])
+		case "returned":
+			limits.Returned, err = es.ParseSize(tokens[1])
+		default:
+			err = errors.New("unknown limit " + tokens[0])
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// QuotaFor returns the quotas applying to id, keyed by the counter their usage is charged
+// to, or nil if id is not restricted: the user's own quota, if they have one (charged to
+// them), or otherwise the quotas of their roles which have one (charged to the roles).
+func QuotaFor(id aa.Identity) Quotas {
+	quotasMu.RLock()
+	q := quotas
+	quotasMu.RUnlock()
+
+	if quota, ok := q[id.User]; ok {
+		return Quotas{id.User: quota}
+	}
+
+	var qs Quotas
+	for _, group := range id.Groups {
+		if quota, ok := q["@"+group]; ok {
+			if qs == nil {
+				qs = Quotas{}
+			}
+			qs["@"+group] = quota
+		}
+	}
+
+	return qs
+}
+
+// exceeded returns the name of the first of the limits u which usage reached, if any. The
+// ingested bytes limit only applies to the requests with a body, of ingest bytes (-1 when
+// unknown), which it must accommodate.
+func (u Usage) exceeded(usage Usage, ingest int64) string {
+	switch {
+	case u.Requests > 0 && usage.Requests >= u.Requests:
+		return fmt.Sprintf("requests quota of %d", u.Requests)
+	case u.Ingested > 0 && ingest > 0 && usage.Ingested+ingest > u.Ingested,
+		u.Ingested > 0 && ingest < 0 && usage.Ingested >= u.Ingested:
+		return fmt.Sprintf("ingested bytes quota of %d", u.Ingested)
+	case u.Returned > 0 && usage.Returned >= u.Returned:
+		return fmt.Sprintf("returned bytes quota of %d", u.Returned)
+	}
+
+	return ""
+}
+
+// add returns the sum of u and other.
+func (u Usage) add(other Usage) Usage {
+	return Usage{u.Requests + other.Requests, u.Ingested + other.Ingested, u.Returned + other.Returned}
+}
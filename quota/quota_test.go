@@ -0,0 +1,71 @@
+package quota
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"strings"
+	"testing"
+)
+
+const quotasTestData = `
+@analysts:day:requests=100,returned=1mb
+@analysts:month:requests=2000
+@ops:day:requests=500,returned=10mb,ingested=1kb
+shipper:month:ingested=1gb
+`
+
+func TestReadQuotas(t *testing.T) {
+	q, err := ReadQuotas(strings.NewReader(quotasTestData))
+	if err != nil || len(q) != 3 || q["@analysts"].Daily.Returned != 1<<20 || q["@analysts"].Monthly.Requests != 2000 || q["shipper"].Monthly.Ingested != 1<<30 {
+		t.Fatal("Unexpected quotas", q, err)
+	}
+
+	for _, bogus := range []string{"foo:day", ":day:requests=1", "foo:week:requests=1", "foo:day:requests", "foo:day:requests=-1", "foo:day:returned=lots", "foo:day:bogus=1"} {
+		if _, err = ReadQuotas(strings.NewReader(bogus)); err == nil {
+			t.Errorf("%q should be rejected", bogus)
+		}
+	}
+
+	if LoadQuotas(42) == nil || LoadQuotas("bogus.txt") == nil {
+		t.Error("Bogus backends should be rejected")
+	}
+}
+
+func TestQuotaFor(t *testing.T) {
+	if err := LoadQuotas(strings.NewReader(quotasTestData)); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadQuotas(Quotas(nil))
+
+	if q := QuotaFor(aa.Identity{User: "foo", Groups: []string{"readers"}}); q != nil {
+		t.Error("Expected no quota, got", q)
+	}
+
+	if q := QuotaFor(aa.Identity{User: "shipper", Groups: []string{"ops"}}); len(q) != 1 || q["shipper"].Monthly.Ingested != 1<<30 || q["shipper"].Daily.Requests != 0 {
+		t.Error("Expected the user's own quota, got", q)
+	}
+
+	if q := QuotaFor(aa.Identity{User: "foo", Groups: []string{"analysts", "ops"}}); len(q) != 2 || q["@analysts"].Daily.Requests != 100 || q["@ops"].Daily.Requests != 500 {
+		t.Error("Expected the quotas of both roles, got", q)
+	}
+}
+
+func TestExceeded(t *testing.T) {
+	limits := Usage{Requests: 10, Ingested: 100, Returned: 1000}
+	for _, c := range []struct {
+		usage    Usage
+		ingest   int64
+		expected string
+	}{
+		{Usage{9, 50, 999}, 50, ""},
+		{Usage{10, 0, 0}, 0, "requests quota of 10"},
+		{Usage{0, 50, 0}, 51, "ingested bytes quota of 100"},
+		{Usage{0, 100, 0}, 0, ""},
+		{Usage{0, 100, 0}, -1, "ingested bytes quota of 100"},
+		{Usage{0, 99, 0}, -1, ""},
+		{Usage{0, 0, 1000}, 0, "returned bytes quota of 1000"},
+	} {
+		if actual := limits.exceeded(c.usage, c.ingest); actual != c.expected {
+			t.Errorf("Expected %q for %v (ingesting %d), got %q", c.expected, c.usage, c.ingest, actual)
+		}
+	}
+}
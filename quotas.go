@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"github.com/alexaandru/elastic_guardian/quota"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The usage of all the users (requests, ingested and returned bytes) is counted when
+-quota-usage is given, in counters which are saved to that file every -quota-flush (and
+loaded back from it on start). The requests of the users who exhausted one of their quotas
+(see -quotas and the quota package) are refused with 429 Too Many Requests, until the quota
+is replenished (as given by the Retry-After header). The quotas of the roles are shared by
+all their members.
+
+The current usage is printed, per user and per role, by:
+
+	elastic_guardian -quota-usage usage.json -quota-report
+
+As the counters are only saved periodically, the report can lag behind by -quota-flush.
+*/
+
+// QuotasPath holds the path to the quotas file (see quota.ReadQuotas for its format).
+var QuotasPath string
+
+// QuotaUsagePath holds the path to the file the usage counters are saved to (usage is not
+// counted if empty).
+var QuotaUsagePath string
+
+// QuotaFlushInterval holds how often the usage counters are saved.
+var QuotaFlushInterval time.Duration
+
+// QuotaReport controls whether the usage report is printed, instead of serving requests.
+var QuotaReport bool
+
+// quotaCounters holds the usage counters (nil when usage is not counted).
+var quotaCounters *quota.Counters
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// countingWriter counts the bytes of a response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	// The reverse proxy may still be reading the body after having served the response.
+	n, err = cr.ReadCloser.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+
+	return
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+
+	return
+}
+
+// Unwrap gives access to the wrapped http.ResponseWriter (see http.ResponseController).
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// initQuotas opens the usage counters, if usage is to be counted.
+func initQuotas() (err error) {
+	if quotaCounters = nil; QuotaUsagePath == "" {
+		if QuotasPath != "" {
+			err = errors.New("-quotas requires -quota-usage")
+		}
+
+		return
+	} else if QuotaFlushInterval <= 0 {
+		return errors.New("-quota-flush must be positive")
+	}
+
+	quotaCounters, err = quota.Open(QuotaUsagePath)
+
+	return
+}
+
+// saveQuotaUsage saves the usage counters every interval, forever.
+func saveQuotaUsage(c *quota.Counters, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.Save(); err != nil {
+			log.Println("Failed to save the quota usage:", err)
+		}
+	}
+}
+
+// printQuotaReport writes the usage report of the counters saved to QuotaUsagePath to w.
+func printQuotaReport(w io.Writer) error {
+	if QuotaUsagePath == "" {
+		return errors.New("-quota-report requires -quota-usage")
+	}
+
+	c, err := quota.Open(QuotaUsagePath)
+	if err != nil {
+		return err
+	}
+
+	return c.Report(w)
+}
+
+// wrapQuotas counts the usage of the users and refuses the requests of those who exhausted
+// one of their quotas (see quota.QuotaFor).
+func wrapQuotas(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := quotaCounters
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id, _ := aa.FromContext(r.Context())
+		owner, err := c.Check(id.User, quota.QuotaFor(id), r.ContentLength)
+		if err != nil {
+			if e, ok := err.(*quota.ExhaustedError); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(e.Until).Seconds())+1))
+			}
+
+			msg := fmt.Sprintf("429 Too Many Requests (quota): %v", err)
+			go logPrint(r, msg)
+			http.Error(w, msg, http.StatusTooManyRequests)
+			return
+		}
+
+		cr, cw := &countingReader{}, &countingWriter{ResponseWriter: w}
+		if r.Body != nil {
+			cr.ReadCloser, r.Body = r.Body, cr
+		}
+
+		h.ServeHTTP(cw, r)
+		c.Add(id.User, owner, quota.Usage{Ingested: atomic.LoadInt64(&cr.n), Returned: cw.n})
+	})
+}
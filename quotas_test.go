@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"github.com/alexaandru/elastic_guardian/quota"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	QuotaUsagePath, QuotaFlushInterval = filepath.Join(dir, "usage.json"), 1
+	defer func() { QuotaUsagePath, quotaCounters = "", nil }()
+	if err = initQuotas(); err != nil {
+		t.Fatal(err)
+	}
+
+	loadRoleTestData()
+	quota.LoadQuotas(quota.Quotas{"@readers": {Daily: quota.Usage{Requests: 2}}})
+	defer quota.LoadQuotas(quota.Quotas(nil))
+
+	uri, _ := url.Parse(backend.URL)
+	handler := initReverseProxy(uri, wrapQuotas, wrapAuthentication)
+	for i, c := range []struct {
+		header string
+		code   int
+	}{
+		{quxquux, http.StatusOK},
+		{quxquux, http.StatusOK},
+		{quxquux, http.StatusTooManyRequests},
+		{foobar, http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/logs/_search", strings.NewReader(`{"size":1}`))
+		req.Header.Set("Authorization", "Basic "+c.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != c.code {
+			t.Errorf("Expected %d for request #%d, got %d", c.code, i, recorder.Code)
+		} else if c.code == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header")
+		}
+	}
+
+	if day, _ := quotaCounters.Usage("qux"); day != (quota.Usage{Requests: 2, Ingested: 20, Returned: 10}) {
+		t.Error("Unexpected usage", day)
+	} else if day, _ = quotaCounters.Usage("@readers"); day.Requests != 2 {
+		t.Error("The role quota should be charged to the role, got", day)
+	}
+
+	if err = quotaCounters.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var report bytes.Buffer
+	if err = printQuotaReport(&report); err != nil || strings.Count(report.String(), "\nqux ") != 2 || strings.Count(report.String(), "\nfoo ") != 2 {
+		t.Error("Unexpected report", report.String(), err)
+	}
+
+	QuotasPath, QuotaUsagePath = "quotas.txt", ""
+	defer func() { QuotasPath = "" }()
+	if initQuotas() == nil {
+		t.Error("-quotas should require -quota-usage")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"github.com/alexaandru/elastic_guardian/quota"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+The Elasticsearch specific protections (see the elasticsearch package) are applied by
+the wrappers below, to the requests which passed authorization, before they are proxied.
+Those which also need to rewrite the responses leave what they need for it in the request
+context, for modifyResponse.
+*/
+
+// securityKey is the context key for the response rewriting needs of the protections.
+type securityKey int
+
+const (
+	fieldFilterKey securityKey = iota
+	tenancyKey
+	listingKey
+	cursorsKey
+	nodesKey
+)
+
+// ownedCursors holds the scrolls, PITs and async searches handling of a request and the user making it.
+type ownedCursors struct {
+	es.Cursors
+	user string
+}
+
+// Guardrails controls whether the built-in guardrails (see es.Guardrail) are enforced.
+var Guardrails bool
+
+// GuardrailsRole holds the role (capability) which lifts the guardrails.
+var GuardrailsRole string
+
+// RestrictScripts controls whether scripts are allowed only to the users with the
+// ScriptRole capability.
+var RestrictScripts bool
+
+// ScriptRole holds the role (capability) which allows using scripts.
+var ScriptRole string
+
+// StoredScripts holds the comma separated IDs of the stored scripts which the users with
+// the ScriptRole capability may use. When given, inline scripts are refused to them too.
+var StoredScripts string
+
+// CursorOwnership controls whether the scrolls, PITs and async searches may only be
+// continued (or fetched) or deleted by the users who created them.
+var CursorOwnership bool
+
+// Sniffing holds how the nodes APIs, which clients use for sniffing the nodes addresses, are
+// handled: "rewrite" (the addresses in their responses with AdvertisedAddress), "block"
+// (the nodes info API) or "pass" (as is).
+var Sniffing string
+
+// AdvertisedAddress holds the address (host:port) which replaces the nodes addresses; when
+// empty, the one the client used (its Host header) is used.
+var AdvertisedAddress string
+
+// FilterListings controls whether the index listings (i.e. _cat/indices) are filtered down
+// to the indices the user may search.
+var FilterListings bool
+
+// DocumentFiltersPath holds the path to the document level security filters file (see
+// es.DocumentFilters for its format).
+var DocumentFiltersPath string
+
+// FieldRulesPath holds the path to the field level security rules file (see es.FieldRules
+// for its format).
+var FieldRulesPath string
+
+// TenanciesPath holds the path to the tenancies file (see es.ReadTenancies for its format).
+var TenanciesPath string
+
+// MaxBodySize holds the maximum request body size of the users without a body limit (see
+// es.ParseSize for its format, no limit when empty).
+var MaxBodySize string
+
+// maxBodySize holds the parsed MaxBodySize.
+var maxBodySize int64
+
+// BodyLimitsPath holds the path to the body size limits file (see es.ReadBodyLimits for its
+// format).
+var BodyLimitsPath string
+
+// bodyLimitStats counts the requests refused for their body size. It is published via expvar.
+var bodyLimitStats = expvar.NewMap("body_limits")
+
+// CostLimitsPath holds the path to the query cost limits file (see es.CostLimits for its format).
+var CostLimitsPath string
+
+// initSniffing validates Sniffing.
+func initSniffing() error {
+	switch Sniffing {
+	case "", "rewrite", "block", "pass":
+		return nil
+	}
+
+	return fmt.Errorf("unknown sniffing mode %q", Sniffing)
+}
+
+// initBodyLimits parses MaxBodySize.
+func initBodyLimits() (err error) {
+	if maxBodySize = 0; MaxBodySize != "" {
+		maxBodySize, err = es.ParseSize(MaxBodySize)
+	}
+
+	return
+}
+
+// loadSecurityRules loads the DLS filters, FLS rules, tenancies, cost limits, body limits,
+// quotas, client IP rules and schedules, for those which were given.
+func loadSecurityRules() error {
+	for _, rules := range []struct {
+		path string
+		load func(interface{}) error
+		none interface{}
+	}{
+		{DocumentFiltersPath, es.LoadDocumentFilters, es.DocumentFilters(nil)},
+		{FieldRulesPath, es.LoadFieldRules, es.FieldRules(nil)},
+		{TenanciesPath, es.LoadTenancies, es.Tenancies(nil)},
+		{CostLimitsPath, es.LoadCostLimits, es.CostLimits(nil)},
+		{BodyLimitsPath, es.LoadBodyLimits, es.BodyLimits(nil)},
+		{QuotasPath, quota.LoadQuotas, quota.Quotas(nil)},
+		{IPRulesPath, az.LoadIPRules, az.IPRules(nil)},
+		{SchedulesPath, az.LoadSchedules, az.Schedules(nil)},
+	} {
+		backend := rules.none
+		if AllowAuthFromFiles && rules.path != "" {
+			backend = rules.path
+		}
+
+		if err := rules.load(backend); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wrapGuardrails stops the dangerous operations (see es.Guardrail), unless the user has
+// the GuardrailsRole capability.
+func wrapGuardrails(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		if Guardrails && !az.HasCapability(id, GuardrailsRole) {
+			if err := es.Guardrail(r); err != nil {
+				if !errors.Is(err, es.ErrUnsafeRequest) {
+					err = fmt.Errorf("%v without the %s capability", err, GuardrailsRole)
+				}
+
+				rejectRequest(w, r, "guardrail", err)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrapScripts allows the scripts (see es.Scripts) and the changes to the stored scripts
+// only to the users with the ScriptRole capability, if RestrictScripts is set.
+func wrapScripts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		capable := az.HasCapability(id, ScriptRole)
+		if RestrictScripts && (!capable || StoredScripts != "") {
+			if err := checkScripts(r, capable); err != nil {
+				rejectRequest(w, r, "scripts", err)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkScripts checks the scripts of r, made by a user with (capable) or without the
+// ScriptRole capability.
+func checkScripts(r *http.Request, capable bool) error {
+	if !capable && es.ScriptAPI(r) {
+		return fmt.Errorf("%s %s requires the %s capability", r.Method, r.URL.Path, ScriptRole)
+	}
+
+	scripts, err := es.Scripts(r)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range scripts {
+		switch {
+		case !capable:
+			return fmt.Errorf("scripts require the %s capability", ScriptRole)
+		case s.Inline():
+			return errors.New("only the allowed stored scripts may be used")
+		case !isStoredScriptAllowed(s.ID):
+			return fmt.Errorf("stored script %q is not allowed", s.ID)
+		}
+	}
+
+	return nil
+}
+
+// isStoredScriptAllowed determines if the stored script id is listed in StoredScripts.
+func isStoredScriptAllowed(id string) bool {
+	for _, allowed := range strings.Split(StoredScripts, ",") {
+		if strings.TrimSpace(allowed) == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wrapCursorOwnership allows continuing or deleting the scrolls, PITs and async searches
+// only to the users who created them and arranges for the new ones to be recorded, if
+// CursorOwnership is set.
+func wrapCursorOwnership(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !CursorOwnership {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id, _ := aa.FromContext(r.Context())
+		c, err := es.CursorsOf(r)
+		if err == nil && c != nil {
+			err = c.Check(id.User)
+		}
+
+		if err != nil {
+			rejectRequest(w, r, "cursors", err)
+			return
+		} else if c == nil || !c.Opens {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r.Header.Del("Accept-Encoding")
+		oc := ownedCursors{Cursors: *c, user: id.User}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cursorsKey, oc)))
+	})
+}
+
+// wrapSniffing keeps the nodes addresses from the clients, as set by Sniffing.
+func wrapSniffing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !es.IsNodes(r.URL.Path) || Sniffing == "" || Sniffing == "pass":
+			h.ServeHTTP(w, r)
+		case Sniffing == "block" && es.IsNodesInfo(r.URL.Path):
+			rejectRequest(w, r, "sniffing", errors.New("the nodes info API is disabled"))
+		case Sniffing == "block":
+			h.ServeHTTP(w, r)
+		default:
+			address := AdvertisedAddress
+			if address == "" {
+				address = r.Host
+			}
+
+			r.Header.Del("Accept-Encoding")
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nodesKey, address)))
+		}
+	})
+}
+
+// wrapCostControls enforces the query cost limits of the user (see es.CostLimits).
+func wrapCostControls(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		if l := es.CostLimitFor(id); l != nil {
+			if err := l.Enforce(r); err != nil {
+				rejectRequest(w, r, "cost", err)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrapBodyLimits refuses the requests whose body exceeds the body limit of the user (see
+// es.BodyLimitFor, with maxBodySize as default). The bodies of unknown length (i.e. chunked
+// uploads) are cut off as soon as they exceed it, whoever reads them (see rejectRequest and
+// proxyError).
+func wrapBodyLimits(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		max, ok := es.BodyLimitFor(id, r.URL.Path)
+		if !ok {
+			max = maxBodySize
+		}
+
+		if max > 0 && r.Body != nil {
+			if r.ContentLength > max {
+				rejectTooLarge(w, r, max)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrapDocumentSecurity restricts the searches of the users having a DLS filter to the
+// documents matching it, refusing the requests which can not be restricted.
+func wrapDocumentSecurity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		filter, err := es.DocumentFilter(id)
+		if err == nil && filter != nil {
+			err = es.RestrictSearch(r, filter)
+		}
+
+		if err != nil {
+			rejectRequest(w, r, "document security", err)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rejectRequest refuses r, which the protection named what could not handle: with 400 when
+// the request itself is at fault, with 413 when its body exceeds its limit (see
+// wrapBodyLimits), or with 403 otherwise.
+func rejectRequest(w http.ResponseWriter, r *http.Request, what string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+
+	status, msg := http.StatusForbidden, "403 Forbidden"
+	if errors.Is(err, es.ErrUnsafeRequest) {
+		status, msg = http.StatusBadRequest, "400 Bad Request"
+	}
+
+	msg = fmt.Sprintf("%s (%s): %v", msg, what, err)
+	go logPrint(r, msg)
+	http.Error(w, msg, status)
+}
+
+// rejectTooLarge refuses r, whose body exceeds max bytes, with 413.
+func rejectTooLarge(w http.ResponseWriter, r *http.Request, max int64) {
+	bodyLimitStats.Add("rejected", 1)
+	if r.ContentLength < 0 {
+		bodyLimitStats.Add("rejected_chunked", 1)
+	}
+
+	msg := fmt.Sprintf("413 Request Entity Too Large (body size): the body exceeds %d bytes", max)
+	go logPrint(r, msg)
+	http.Error(w, msg, http.StatusRequestEntityTooLarge)
+}
+
+// proxyError handles the failures to proxy r: with 413 when its body turned out to exceed
+// its limit while being streamed to the backend, or with 502 otherwise (as the default
+// handler of httputil.ReverseProxy).
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// wrapFieldSecurity restricts the searches and gets of the users having FLS rules to the
+// fields visible to them. The denied fields are also stripped from the responses.
+func wrapFieldSecurity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		ff := es.FieldFilterFor(id)
+		if ff == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if err := ff.RestrictRequest(r); err != nil {
+			rejectRequest(w, r, "field security", err)
+			return
+		}
+
+		// The responses must come back as plain JSON, in order to be filtered.
+		r.Header.Del("Accept-Encoding")
+		r.Header.Set("Accept", "application/json")
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), fieldFilterKey, ff)))
+	})
+}
+
+// wrapTenancy rewrites the index names of the requests of tenants to the physical ones
+// (and back, in the responses).
+func wrapTenancy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := aa.FromContext(r.Context())
+		t := es.TenancyFor(id)
+		if t == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if err := t.RewriteRequest(r); err != nil {
+			rejectRequest(w, r, "tenancy", err)
+			return
+		}
+
+		r.Header.Del("Accept-Encoding")
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenancyKey, *t)))
+	})
+}
+
+// wrapListing arranges for the index listings to be filtered down to the indices the user
+// may search (GET /{index}/_search, according to authorizer).
+func wrapListing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !FilterListings || !es.IsListing(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id, _ := aa.FromContext(r.Context())
+		req := az.NewRequest(r, id)
+		permitted := func(index string) bool {
+			probe := *req
+			probe.Method, probe.Path, probe.Query, probe.Indices = "GET", "/"+index+"/_search", nil, []string{index}
+			allowed, _ := authorizer.Authorize(&probe)
+			return allowed
+		}
+
+		r.Header.Del("Accept-Encoding")
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listingKey, permitted)))
+	})
+}
+
+// modifyResponse applies the response rewriting of the protections to resp. Failing
+// to rewrite it fails the request (with 502 Bad Gateway).
+func modifyResponse(resp *http.Response) error {
+	ctx, path := resp.Request.Context(), resp.Request.URL.Path
+	if oc, ok := ctx.Value(cursorsKey).(ownedCursors); ok && resp.StatusCode == http.StatusOK {
+		err := rewriteResponseBody(resp, "cursors", func(body []byte, contentType string) ([]byte, error) {
+			if !strings.Contains(contentType, "json") {
+				return nil, errors.New("can not record the scrolls of " + contentType + " responses")
+			}
+
+			return body, oc.Record(oc.user, body)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if address, ok := ctx.Value(nodesKey).(string); ok {
+		err := rewriteResponseBody(resp, "sniffing", func(body []byte, contentType string) ([]byte, error) {
+			if !strings.Contains(contentType, "json") {
+				return nil, errors.New("can not rewrite " + contentType + " responses")
+			}
+
+			return es.RewriteNodes(body, address)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if t, ok := ctx.Value(tenancyKey).(es.Tenancy); ok {
+		if err := rewriteResponseBody(resp, "tenancy", t.RewriteResponse); err != nil {
+			return err
+		}
+	}
+
+	if permitted, ok := ctx.Value(listingKey).(func(string) bool); ok {
+		query := resp.Request.URL.Query()
+		err := rewriteResponseBody(resp, "listing", func(body []byte, contentType string) ([]byte, error) {
+			return es.FilterListing(path, query, body, contentType, permitted)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ff, ok := ctx.Value(fieldFilterKey).(es.FieldFilter); ok {
+		err := rewriteResponseBody(resp, "field security", func(body []byte, contentType string) ([]byte, error) {
+			if !strings.Contains(contentType, "json") {
+				return nil, errors.New("can not filter " + contentType + " responses")
+			}
+
+			return ff.FilterResponse(path, body)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteResponseBody replaces the body of resp with what rewrite makes of it (given its
+// content type). Failures are logged as the failures of the protection named what.
+func rewriteResponseBody(resp *http.Response, what string, rewrite func([]byte, string) ([]byte, error)) (err error) {
+	defer func() {
+		if err != nil {
+			go logPrint(resp.Request, fmt.Sprintf("502 Bad Gateway (%s): %v", what, err))
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) > 0 {
+		if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+			return errors.New("can not rewrite " + ce + " encoded responses")
+		}
+
+		if body, err = rewrite(body, resp.Header.Get("Content-Type")); err != nil {
+			return
+		}
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+
+	return nil
+}
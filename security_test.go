@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	es "github.com/alexaandru/elastic_guardian/elasticsearch"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// protectedRequest passes a request made by id through wrapper, to a handler which captures
+// the body it receives.
+func protectedRequest(wrapper handlerWrapper, id aa.Identity, method, url, body string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req = req.WithContext(aa.NewContext(req.Context(), id))
+
+	var received string
+	handler := wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		received = string(raw)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	return recorder, received
+}
+
+func TestDocumentSecurity(t *testing.T) {
+	es.LoadDocumentFilters(es.DocumentFilters{"@tenants": json.RawMessage(`{"term":{"tenant_id":"{{attributes.tenant}}"}}`)})
+	defer es.LoadDocumentFilters(es.DocumentFilters(nil))
+
+	tenant := aa.Identity{User: "foo", Groups: []string{"tenants"}, Attributes: map[string]string{"tenant": "acme"}}
+	_, body := protectedRequest(wrapDocumentSecurity, tenant, "POST", "/logs/_search", `{}`)
+	if expected := `{"query":{"bool":{"filter":{"term":{"tenant_id":"acme"}},"must":{"match_all":{}}}}}`; body != expected {
+		t.Error("Expected", expected, "got", body)
+	}
+
+	if _, body = protectedRequest(wrapDocumentSecurity, aa.Identity{User: "bar"}, "POST", "/logs/_search", `{}`); body != `{}` {
+		t.Error("Unrestricted users searches should be left alone, got", body)
+	}
+
+	if recorder, _ := protectedRequest(wrapDocumentSecurity, tenant, "GET", "/logs/_doc/1", ""); recorder.Code != http.StatusBadRequest {
+		t.Error("Expected 400 got", recorder.Code)
+	}
+
+	tenant.Attributes = nil
+	if recorder, _ := protectedRequest(wrapDocumentSecurity, tenant, "POST", "/logs/_search", `{}`); recorder.Code != http.StatusForbidden {
+		t.Error("Expected 403 got", recorder.Code)
+	}
+}
+
+func TestFieldSecurity(t *testing.T) {
+	var query string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_id":"1","_source":{"message":"m","email":"e"}}`))
+	}))
+	defer backend.Close()
+
+	loadRoleTestData()
+	az.LoadAuthorizations(az.AuthorizationStore{
+		"foo":      az.AuthorizationRules{DefaultRule: az.Allow, Rules: []string{}},
+		"@readers": az.AuthorizationRules{DefaultRule: az.Allow, Rules: []string{}},
+	})
+	es.LoadFieldRules(es.FieldRules{"@readers": {Deny: []string{"email"}}})
+	defer es.LoadFieldRules(es.FieldRules(nil))
+
+	uri, _ := url.Parse(backend.URL)
+	handler := initReverseProxy(uri, wrapFieldSecurity, wrapDocumentSecurity, wrapAuthorization, wrapAuthentication)
+	for _, c := range []struct{ header, query, body string }{
+		{"Basic " + quxquux, "_source_excludes=email", `{"_id":"1","_source":{"message":"m"}}`},
+		{"Basic " + foobar, "", `{"_id":"1","_source":{"message":"m","email":"e"}}`},
+	} {
+		req, _ := http.NewRequest("GET", "/logs/_doc/1", nil)
+		req.Header.Set("Authorization", c.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if query != c.query || recorder.Body.String() != c.body {
+			t.Errorf("Expected %s %s got %s %s", c.query, c.body, query, recorder.Body.String())
+		}
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	var path string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte("green open teama-events\n"))
+	}))
+	defer backend.Close()
+
+	es.LoadTenancies(es.Tenancies{"@readers": {Prefix: "teama-"}})
+	defer es.LoadTenancies(es.Tenancies(nil))
+
+	uri, _ := url.Parse(backend.URL)
+	recorder, _ := protectedRequest(func(h http.Handler) http.Handler {
+		return wrapTenancy(initReverseProxy(uri))
+	}, aa.Identity{User: "qux", Groups: []string{"readers"}}, "GET", "/_cat/indices", "")
+
+	if path != "/_cat/indices/teama-*" || recorder.Body.String() != "green open events\n" {
+		t.Error("Unexpected rewriting", path, recorder.Body.String())
+	}
+
+	if recorder, _ = protectedRequest(wrapTenancy, aa.Identity{User: "qux", Groups: []string{"readers"}}, "POST", "/_reindex", "{}"); recorder.Code != http.StatusBadRequest {
+		t.Error("Expected 400 got", recorder.Code)
+	}
+}
+
+func TestListingFiltering(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte("green open logs-1 u1\ngreen open secret u2\n"))
+	}))
+	defer backend.Close()
+
+	az.LoadAuthorizations(az.AuthorizationStore{
+		"@readers": az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{"GET /_cat/", "GET /logs-"}},
+	})
+	FilterListings = true
+	defer func() { FilterListings = false }()
+
+	uri, _ := url.Parse(backend.URL)
+	recorder, _ := protectedRequest(func(h http.Handler) http.Handler {
+		return wrapListing(initReverseProxy(uri))
+	}, aa.Identity{User: "qux", Groups: []string{"readers"}}, "GET", "/_cat/indices", "")
+
+	if recorder.Body.String() != "green open logs-1 u1\n" {
+		t.Error("Unexpected listing", recorder.Body.String())
+	}
+}
+
+func TestGuardrails(t *testing.T) {
+	Guardrails, GuardrailsRole = true, "admin"
+	defer func() { Guardrails = false }()
+
+	recorder, _ := protectedRequest(wrapGuardrails, aa.Identity{User: "foo"}, "DELETE", "/_all", "")
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "without the admin capability") {
+		t.Error("Expected 403 got", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder, _ = protectedRequest(wrapGuardrails, aa.Identity{User: "foo", Groups: []string{"admin"}}, "DELETE", "/_all", ""); recorder.Code != http.StatusOK {
+		t.Error("Expected 200 got", recorder.Code)
+	}
+}
+
+func TestCostControls(t *testing.T) {
+	es.LoadCostLimits(es.CostLimits{"@readers": {MaxSize: 10}})
+	defer es.LoadCostLimits(es.CostLimits(nil))
+
+	recorder, _ := protectedRequest(wrapCostControls, aa.Identity{User: "qux", Groups: []string{"readers"}}, "POST", "/_search", `{"size":100}`)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "size 100 exceeds the maximum of 10") {
+		t.Error("Expected 400 got", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder, _ = protectedRequest(wrapCostControls, aa.Identity{User: "foo"}, "POST", "/_search", `{"size":100}`); recorder.Code != http.StatusOK {
+		t.Error("Expected 200 got", recorder.Code)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	RestrictScripts, ScriptRole = true, "script"
+	defer func() { RestrictScripts, StoredScripts = false, "" }()
+
+	update := `{"script":{"source":"ctx._source.n++"}}`
+	recorder, _ := protectedRequest(wrapScripts, aa.Identity{User: "foo"}, "POST", "/logs/_update_by_query", update)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "scripts require the script capability") {
+		t.Error("Expected 403 got", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder, _ = protectedRequest(wrapScripts, aa.Identity{User: "foo"}, "PUT", "/_scripts/fix", update); recorder.Code != http.StatusForbidden {
+		t.Error("Expected 403 got", recorder.Code)
+	}
+
+	scripter := aa.Identity{User: "foo", Groups: []string{"script"}}
+	if recorder, _ = protectedRequest(wrapScripts, scripter, "POST", "/logs/_update_by_query", update); recorder.Code != http.StatusOK {
+		t.Error("Expected 200 got", recorder.Code)
+	}
+
+	StoredScripts = "fix, bump"
+	if recorder, _ = protectedRequest(wrapScripts, scripter, "POST", "/logs/_update_by_query", update); recorder.Code != http.StatusForbidden {
+		t.Error("Expected 403 for inline scripts got", recorder.Code)
+	}
+
+	stored := `{"script":{"id":"bump"}}`
+	if recorder, _ = protectedRequest(wrapScripts, scripter, "POST", "/logs/_update_by_query", stored); recorder.Code != http.StatusOK {
+		t.Error("Expected 200 got", recorder.Code)
+	}
+
+	if recorder, _ = protectedRequest(wrapScripts, scripter, "POST", "/logs/_update_by_query", `{"script":{"id":"drop"}}`); recorder.Code != http.StatusForbidden {
+		t.Error("Expected 403 for stored scripts not allowed got", recorder.Code)
+	}
+}
+
+func TestCursorOwnership(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_scroll_id":"owned-by-foo","hits":{"hits":[]}}`))
+	}))
+	defer backend.Close()
+
+	CursorOwnership = true
+	defer func() { CursorOwnership = false }()
+
+	uri, _ := url.Parse(backend.URL)
+	for _, c := range []struct {
+		user, method, url, body string
+		code                    int
+	}{
+		{"foo", "POST", "/logs/_search?scroll=1m", `{}`, http.StatusOK},
+		{"baz", "POST", "/_search/scroll", `{"scroll_id":"owned-by-foo"}`, http.StatusForbidden},
+		{"foo", "POST", "/_search/scroll", `{"scroll_id":"owned-by-foo"}`, http.StatusOK},
+		{"baz", "DELETE", "/_search/scroll/owned-by-foo", "", http.StatusForbidden},
+		{"foo", "DELETE", "/_search/scroll/_all", "", http.StatusForbidden},
+	} {
+		recorder, _ := protectedRequest(func(h http.Handler) http.Handler {
+			return wrapCursorOwnership(initReverseProxy(uri))
+		}, aa.Identity{User: c.user}, c.method, c.url, c.body)
+
+		if recorder.Code != c.code {
+			t.Errorf("Expected %d for %s %s %s, got %d %s", c.code, c.user, c.method, c.url, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestSniffing(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"nodes":{"n1":{"http":{"publish_address":"10.0.0.1:9200"}}}}`))
+	}))
+	defer backend.Close()
+
+	Sniffing = "rewrite"
+	defer func() { Sniffing = "" }()
+
+	uri, _ := url.Parse(backend.URL)
+	recorder, _ := protectedRequest(func(h http.Handler) http.Handler {
+		return wrapSniffing(initReverseProxy(uri))
+	}, aa.Identity{User: "foo"}, "GET", "http://guardian:9600/_nodes/http", "")
+	if expected := `{"nodes":{"n1":{"http":{"publish_address":"guardian:9600"}}}}`; recorder.Body.String() != expected {
+		t.Errorf("Expected %s got %s", expected, recorder.Body.String())
+	}
+
+	Sniffing = "block"
+	if recorder, _ = protectedRequest(wrapSniffing, aa.Identity{User: "foo"}, "GET", "/_nodes/http", ""); recorder.Code != http.StatusForbidden {
+		t.Error("Expected 403 got", recorder.Code)
+	}
+
+	if recorder, _ = protectedRequest(wrapSniffing, aa.Identity{User: "foo"}, "GET", "/_nodes/stats", ""); recorder.Code != http.StatusOK {
+		t.Error("Expected 200 got", recorder.Code)
+	}
+
+	if Sniffing = "bogus"; initSniffing() == nil {
+		t.Error("Unknown sniffing modes should be rejected")
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer backend.Close()
+
+	loadRoleTestData()
+	es.LoadBodyLimits(es.BodyLimits{{Name: "*", Max: 16}, {Name: "@readers", Max: 1024, Path: "/_bulk$"}})
+	defer es.LoadBodyLimits(es.BodyLimits(nil))
+	es.LoadCostLimits(es.CostLimits{"foo": {MaxSize: 10}})
+	defer es.LoadCostLimits(es.CostLimits(nil))
+
+	uri, _ := url.Parse(backend.URL)
+	front := httptest.NewServer(initReverseProxy(uri, wrapCostControls, wrapBodyLimits, wrapAuthentication))
+	defer front.Close()
+
+	rejected := func() (n int64) {
+		if v, ok := bodyLimitStats.Get("rejected").(*expvar.Int); ok {
+			n = v.Value()
+		}
+		return
+	}
+	before := rejected()
+	for _, c := range []struct {
+		header, path string
+		size         int
+		chunked      bool
+		code         int
+	}{
+		{foobar, "/logs/_doc/1", 8, false, http.StatusOK},
+		{foobar, "/logs/_doc/1", 32, false, http.StatusRequestEntityTooLarge},
+		{foobar, "/logs/_doc/1", 8, true, http.StatusOK},
+		{foobar, "/logs/_doc/1", 32, true, http.StatusRequestEntityTooLarge},
+		{foobar, "/_search", 32, true, http.StatusRequestEntityTooLarge},
+		{foobar, "/_bulk", 32, true, http.StatusRequestEntityTooLarge},
+		{quxquux, "/_bulk", 32, true, http.StatusOK},
+	} {
+		body := io.Reader(strings.NewReader(`{"a":"` + strings.Repeat("x", c.size-8) + `"}`))
+		if c.chunked {
+			body = io.MultiReader(body)
+		}
+
+		req, _ := http.NewRequest("POST", front.URL+c.path, body)
+		req.Header.Set("Authorization", "Basic "+c.header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.code {
+			t.Errorf("Expected %d for %d bytes to %s (chunked: %v), got %d", c.code, c.size, c.path, c.chunked, resp.StatusCode)
+		}
+	}
+
+	if n := rejected() - before; n != 4 {
+		t.Error("Expected 4 rejections, got", n)
+	}
+}
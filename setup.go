@@ -10,6 +10,10 @@ var inlineCredentials = aa.CredentialsStore{
 // "baz": aa.Hash("boo"), //  ~~  baz             ~~           boo
 }
 
+var inlineRoles = aa.RolesStore{
+// "foo": []string{"admin"}, // user foo can access the admin API
+}
+
 var inlineAuthorizations = az.AuthorizationStore{
 // Blacklisting example: user foo can access EVERYTHING except GET /secret
 // "foo": az.AuthorizationRules{az.Allow, []string{"GET /secret"}},
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DB is an embedded key-value Store, kept in a single (JSON encoded) file.
+//
+// Every Update() runs under an exclusive lock on a companion lock file and replaces
+// the data file atomically, incrementing its version, so several processes on the
+// same host can safely share (and watch, see Watch()) the same DB.
+type DB struct {
+	path string
+	mu   sync.Mutex
+}
+
+// ErrConflict is returned by UpdateVersion() when the DB changed in the meantime.
+var ErrConflict = errors.New("store: data changed since it was loaded")
+
+// Open opens the DB at path, creating it (empty, at version 0) if it does not exist.
+func Open(path string) (db *DB, err error) {
+	db = &DB{path: path}
+
+	err = db.withLock(true, func() error {
+		if _, e := os.Stat(path); !os.IsNotExist(e) {
+			return e
+		}
+
+		return db.write(&Data{})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Load(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Path returns the path of the DB file.
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Load implements Store.
+func (db *DB) Load() (d *Data, err error) {
+	err = db.withLock(false, func() (e error) {
+		d, e = db.read()
+		return
+	})
+
+	return
+}
+
+// Update implements Store.
+func (db *DB) Update(fn func(*Data) error) error {
+	return db.update(nil, fn)
+}
+
+// UpdateVersion works like Update(), except that it fails with ErrConflict unless the
+// DB is still at version (i.e. it implements optimistic concurrency control).
+func (db *DB) UpdateVersion(version uint64, fn func(*Data) error) error {
+	return db.update(&version, fn)
+}
+
+// ReadCredentials implements authentication.CredentialsBackend.
+func (db *DB) ReadCredentials() (aa.CredentialsStore, error) {
+	d, err := db.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Credentials, nil
+}
+
+// ReadRoles implements authentication.RolesBackend.
+func (db *DB) ReadRoles() (aa.RolesStore, error) {
+	d, err := db.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Roles, nil
+}
+
+// ReadAuthorizations implements authorization.AuthorizationsBackend.
+func (db *DB) ReadAuthorizations() (az.AuthorizationStore, error) {
+	d, err := db.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Authorizations, nil
+}
+
+func (db *DB) update(version *uint64, fn func(*Data) error) error {
+	return db.withLock(true, func() error {
+		d, err := db.read()
+		if err != nil {
+			return err
+		}
+
+		if version != nil && *version != d.Version {
+			return ErrConflict
+		}
+
+		if err = fn(d); err != nil {
+			return err
+		}
+
+		for user, ar := range d.Authorizations {
+			if err = az.ValidateRules(ar); err != nil {
+				return errors.New("store: invalid rules for " + user + ": " + err.Error())
+			}
+		}
+
+		d.Version++
+
+		return db.write(d)
+	})
+}
+
+func (db *DB) read() (d *Data, err error) {
+	raw, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return
+	}
+
+	d = &Data{}
+	if err = json.Unmarshal(raw, d); err != nil {
+		return nil, err
+	}
+
+	return d.Clone(), nil
+}
+
+func (db *DB) write(d *Data) error {
+	return WriteFileAtomically(db.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(d)
+	})
+}
+
+// withLock runs fn holding the in-process lock and the (shared or exclusive)
+// inter-process lock on the DB.
+func (db *DB) withLock(exclusive bool, fn func() error) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, err := os.OpenFile(db.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = lockFile(f, exclusive); err != nil {
+		return
+	}
+	defer unlockFile(f)
+
+	return fn()
+}
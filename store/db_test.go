@@ -0,0 +1,157 @@
+package store
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenCreatesEmptyDB(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "guardian.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Version != 0 || len(d.Credentials) != 0 {
+		t.Error("A new DB should be empty, got", d)
+	}
+
+	if _, err = Open(filepath.Join(dir, "bogus", "guardian.db")); err == nil {
+		t.Error("Opening a DB in a missing directory should error out")
+	}
+}
+
+func TestDBUpdate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, _ := Open(filepath.Join(dir, "guardian.db"))
+	err := db.Update(func(d *Data) error {
+		*d = *testData()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening (i.e. from another process) sees the same data.
+	other, _ := Open(db.Path())
+	d, err := other.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Version != 1 || d.Credentials["foo"] != aa.Hash("bar") || d.Roles["foo"][0] != "admin" || !d.Authorizations["foo"].DefaultRule {
+		t.Error("Unexpected data", d)
+	}
+
+	err = db.Update(func(d *Data) error {
+		d.Authorizations["foo"] = az.AuthorizationRules{DefaultRule: az.Deny, Rules: []string{"GET /(bogus"}}
+		return nil
+	})
+	if err == nil {
+		t.Error("Invalid rules should not be stored")
+	}
+
+	if d, _ = db.Load(); d.Version != 1 {
+		t.Error("A failed Update() should change nothing")
+	}
+}
+
+func TestDBUpdateVersion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, _ := Open(filepath.Join(dir, "guardian.db"))
+	noop := func(d *Data) error { return nil }
+
+	if err := db.UpdateVersion(0, noop); err != nil {
+		t.Error(err)
+	}
+
+	if err := db.UpdateVersion(0, noop); err != ErrConflict {
+		t.Error("Expected ErrConflict, got", err)
+	}
+}
+
+func TestDBConcurrentUpdates(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "guardian.db")
+	Open(path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			db, err := Open(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			db.Update(func(d *Data) error { return nil })
+		}()
+	}
+	wg.Wait()
+
+	db, _ := Open(path)
+	if d, _ := db.Load(); d.Version != 10 {
+		t.Error("Expected version 10, got", d.Version)
+	}
+}
+
+func TestDBIsABackend(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, _ := Open(filepath.Join(dir, "guardian.db"))
+	db.Update(func(d *Data) error {
+		*d = *testData()
+		return nil
+	})
+
+	if err := aa.LoadCredentials(db); err != nil || aa.Credentials()["baz"] != aa.Hash("boo") {
+		t.Error("DB should be usable as a credentials backend", err)
+	}
+
+	if err := az.LoadAuthorizations(db); err != nil || !az.AuthorizationPassed("foo", "GET", "/") {
+		t.Error("DB should be usable as an authorizations backend", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, _ := Open(filepath.Join(dir, "guardian.db"))
+	stop, changes := make(chan struct{}), make(chan uint64, 10)
+	defer close(stop)
+
+	go Watch(db, 0, 5*time.Millisecond, func(d *Data) { changes <- d.Version }, stop)
+	db.Update(func(d *Data) error { return nil })
+
+	select {
+	case v := <-changes:
+		if v != 1 {
+			t.Error("Expected version 1, got", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("Watch() should have noticed the change")
+	}
+}
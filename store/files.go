@@ -0,0 +1,171 @@
+package store
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Files is a Store backed by the plain text credentials, roles and authorizations
+// files (see the authentication and authorization packages for their formats).
+//
+// Data for which no path is set is taken from (and changes to it are kept in)
+// Defaults, which is how the inline variables are supported.
+type Files struct {
+	CredentialsPath    string
+	RolesPath          string
+	AuthorizationsPath string
+	Defaults           Data
+
+	mu sync.Mutex
+}
+
+// Load implements Store.
+func (fs *Files) Load() (d *Data, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.load()
+}
+
+// Update implements Store. Each file is replaced atomically, but since there are
+// up to three of them, a failure may leave some of them updated and some not.
+func (fs *Files) Update(fn func(*Data) error) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.load()
+	if err != nil {
+		return
+	}
+
+	if err = fn(d); err != nil {
+		return
+	}
+
+	if fs.CredentialsPath == "" {
+		fs.Defaults.Credentials = d.Credentials
+	} else if err = WriteFileAtomically(fs.CredentialsPath, func(w io.Writer) error { return aa.WriteCredentials(w, d.Credentials) }); err != nil {
+		return
+	}
+
+	if fs.RolesPath == "" {
+		fs.Defaults.Roles = d.Roles
+	} else if err = WriteFileAtomically(fs.RolesPath, func(w io.Writer) error { return aa.WriteRoles(w, d.Roles) }); err != nil {
+		return
+	}
+
+	if fs.AuthorizationsPath == "" {
+		fs.Defaults.Authorizations = d.Authorizations
+	} else {
+		err = WriteFileAtomically(fs.AuthorizationsPath, func(w io.Writer) error { return az.WriteAuthorizations(w, d.Authorizations) })
+	}
+
+	return
+}
+
+// ReadCredentials implements authentication.CredentialsBackend.
+func (fs *Files) ReadCredentials() (aa.CredentialsStore, error) {
+	d, err := fs.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Credentials, nil
+}
+
+// ReadRoles implements authentication.RolesBackend.
+func (fs *Files) ReadRoles() (aa.RolesStore, error) {
+	d, err := fs.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Roles, nil
+}
+
+// ReadAuthorizations implements authorization.AuthorizationsBackend.
+func (fs *Files) ReadAuthorizations() (az.AuthorizationStore, error) {
+	d, err := fs.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Authorizations, nil
+}
+
+func (fs *Files) load() (d *Data, err error) {
+	d = fs.Defaults.Clone()
+
+	if fs.CredentialsPath != "" {
+		if err = readFile(fs.CredentialsPath, func(r io.Reader) (e error) { d.Credentials, e = aa.ReadCredentials(r); return }); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.AuthorizationsPath != "" {
+		if err = readFile(fs.AuthorizationsPath, func(r io.Reader) (e error) { d.Authorizations, e = az.ReadAuthorizations(r); return }); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.RolesPath != "" {
+		if err = readFile(fs.RolesPath, func(r io.Reader) (e error) { d.Roles, e = aa.ReadRoles(r); return }); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func readFile(path string, read func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return read(f)
+}
+
+// WriteFileAtomically writes path via a temporary file which is then renamed over path,
+// so that readers never observe a partially written file.
+func WriteFileAtomically(path string, write func(io.Writer) error) (err error) {
+	mode := os.FileMode(0600)
+	if fi, e := os.Stat(path); e == nil {
+		mode = fi.Mode()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = write(f); err != nil {
+		return
+	}
+
+	if err = f.Chmod(mode); err != nil {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), path)
+}
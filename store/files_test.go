@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestFilesLoad(t *testing.T) {
+	fs := &Files{
+		CredentialsPath:    "../authentication/authentication_test.txt",
+		RolesPath:          "../authentication/roles_test.txt",
+		AuthorizationsPath: "../authorization/authorization_test.txt",
+	}
+
+	d, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Credentials["foo"] == "" || d.Roles["baz"][1] != "readers" || !d.Authorizations["foo"].DefaultRule {
+		t.Error("Data should have been loaded from the files, got", d)
+	}
+
+	fs.RolesPath = "bogus"
+	if _, err = fs.Load(); err == nil {
+		t.Error("Loading from a missing file should error out")
+	}
+}
+
+func TestFilesDefaults(t *testing.T) {
+	fs := &Files{Defaults: *testData()}
+
+	err := fs.Update(func(d *Data) error {
+		d.Credentials["qux"] = "hash"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, _ := fs.Load(); d.Credentials["qux"] != "hash" || d.Credentials["foo"] == "" {
+		t.Error("Changes should have been kept in Defaults, got", d)
+	}
+}
+
+func TestFilesUpdate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := &Files{CredentialsPath: filepath.Join(dir, "credentials"), Defaults: *testData()}
+	ioutil.WriteFile(fs.CredentialsPath, []byte("foo:hash\n"), 0640)
+
+	err := fs.Update(func(d *Data) error {
+		d.Credentials["qux"] = "hash2"
+		d.Roles["qux"] = []string{"ops"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw, _ := ioutil.ReadFile(fs.CredentialsPath); string(raw) != "foo:hash\nqux:hash2\n" {
+		t.Errorf("Unexpected credentials file contents %q", raw)
+	}
+
+	if fi, _ := os.Stat(fs.CredentialsPath); fi.Mode() != 0640 {
+		t.Error("File mode should have been preserved, got", fi.Mode())
+	}
+
+	if fs.Defaults.Roles["qux"] == nil {
+		t.Error("Roles should have been kept in Defaults")
+	}
+
+	err = fs.Update(func(d *Data) error {
+		d.Credentials["bogus"] = "hash3"
+		return errors.New("nope")
+	})
+	if err == nil || err.Error() != "nope" {
+		t.Error("Update() should return the error of fn, got", err)
+	}
+
+	if cs, _ := fs.ReadCredentials(); cs["bogus"] != "" {
+		t.Error("A failed Update() should change nothing")
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("old"), 0600)
+
+	err := WriteFileAtomically(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Error("Errors should be reported")
+	}
+
+	if raw, _ := ioutil.ReadFile(path); string(raw) != "old" {
+		t.Error("A failed write should leave the file untouched")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("A failed write should leave no temporary files behind")
+	}
+
+	if err = WriteFileAtomically(path, func(w io.Writer) error { return aa.WriteCredentials(w, aa.CredentialsStore{"a": "b"}) }); err != nil {
+		t.Error(err)
+	}
+
+	if raw, _ := ioutil.ReadFile(path); string(raw) != "a:b\n" {
+		t.Errorf("Unexpected file contents %q", raw)
+	}
+}
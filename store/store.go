@@ -0,0 +1,86 @@
+/*
+Package store implements pluggable storage backends for the data Elastic Guardian
+needs in order to authenticate and authorize requests: users with their password
+hashes and roles, and authorization rules.
+
+All backends implement the Store interface, which offers consistent snapshots via
+Load() and transactional changes via Update(). Currently available backends:
+
+	Files, the plain text files (as well as the inline variables) used so far;
+	DB, an embedded, versioned key-value store kept in a single file, which can
+	be safely shared by several processes on the same host.
+
+Both of them can also be passed directly to authentication.LoadCredentials(),
+authentication.LoadRoles() and authorization.LoadAuthorizations().
+*/
+package store
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+)
+
+// Data holds a snapshot of all the stored data.
+type Data struct {
+	// Version is incremented by every successful Update(), for backends which track
+	// versions (it is always 0 otherwise).
+	Version        uint64                `json:"version"`
+	Credentials    aa.CredentialsStore   `json:"credentials"`
+	Roles          aa.RolesStore         `json:"roles"`
+	Authorizations az.AuthorizationStore `json:"authorizations"`
+}
+
+// Store defines the interface all storage backends implement.
+type Store interface {
+	// Load returns a snapshot of the currently stored data.
+	Load() (*Data, error)
+	// Update applies fn to the currently stored data and persists the result,
+	// in one transaction: if fn (or persisting) fails, nothing is changed.
+	Update(fn func(*Data) error) error
+}
+
+// Clone returns a deep copy of d.
+func (d *Data) Clone() *Data {
+	c := &Data{
+		Version:        d.Version,
+		Credentials:    aa.CredentialsStore{},
+		Roles:          aa.RolesStore{},
+		Authorizations: az.AuthorizationStore{},
+	}
+
+	for user, hash := range d.Credentials {
+		c.Credentials[user] = hash
+	}
+
+	for user, roles := range d.Roles {
+		c.Roles[user] = append([]string(nil), roles...)
+	}
+
+	for user, ar := range d.Authorizations {
+		c.Authorizations[user] = az.AuthorizationRules{DefaultRule: ar.DefaultRule, Rules: append([]string(nil), ar.Rules...)}
+	}
+
+	return c
+}
+
+// Apply loads d into the authentication and authorization libraries.
+func (d *Data) Apply() {
+	aa.LoadCredentials(d.Credentials)
+	aa.LoadRoles(d.Roles)
+	az.LoadAuthorizations(d.Authorizations)
+}
+
+// ReadCredentials implements authentication.CredentialsBackend.
+func (d *Data) ReadCredentials() (aa.CredentialsStore, error) {
+	return d.Credentials, nil
+}
+
+// ReadRoles implements authentication.RolesBackend.
+func (d *Data) ReadRoles() (aa.RolesStore, error) {
+	return d.Roles, nil
+}
+
+// ReadAuthorizations implements authorization.AuthorizationsBackend.
+func (d *Data) ReadAuthorizations() (az.AuthorizationStore, error) {
+	return d.Authorizations, nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	aa "github.com/alexaandru/elastic_guardian/authentication"
+	az "github.com/alexaandru/elastic_guardian/authorization"
+	"testing"
+)
+
+func testData() *Data {
+	return &Data{
+		Credentials:    aa.CredentialsStore{"foo": aa.Hash("bar"), "baz": aa.Hash("boo")},
+		Roles:          aa.RolesStore{"foo": {"admin"}},
+		Authorizations: az.AuthorizationStore{"foo": az.AuthorizationRules{DefaultRule: az.Allow, Rules: []string{"GET /_cluster/health"}}},
+	}
+}
+
+func TestClone(t *testing.T) {
+	d := testData()
+	c := d.Clone()
+
+	c.Credentials["foo"] = "changed"
+	c.Roles["foo"][0] = "changed"
+	c.Authorizations["foo"].Rules[0] = "changed"
+
+	if d.Credentials["foo"] == "changed" || d.Roles["foo"][0] == "changed" || d.Authorizations["foo"].Rules[0] == "changed" {
+		t.Error("Clone() should return a deep copy")
+	}
+
+	if c = (&Data{}).Clone(); c.Credentials == nil || c.Roles == nil || c.Authorizations == nil {
+		t.Error("Clone() should never return nil stores")
+	}
+}
+
+func TestApply(t *testing.T) {
+	testData().Apply()
+
+	if aa.Credentials()["foo"] != aa.Hash("bar") || !aa.HasRole("foo", "admin") || !az.AuthorizationPassed("foo", "GET", "/") {
+		t.Error("Apply() should have loaded the data")
+	}
+}
+
+func TestDataIsABackend(t *testing.T) {
+	d := testData()
+	aa.LoadCredentials(aa.CredentialsStore{})
+	aa.LoadRoles(aa.RolesStore{})
+	az.LoadAuthorizations(az.AuthorizationStore{})
+
+	if err := aa.LoadCredentials(d); err != nil || aa.Credentials()["baz"] != aa.Hash("boo") {
+		t.Error("Data should be usable as a credentials backend", err)
+	}
+
+	if err := aa.LoadRoles(d); err != nil || !aa.HasRole("foo", "admin") {
+		t.Error("Data should be usable as a roles backend", err)
+	}
+
+	if err := az.LoadAuthorizations(d); err != nil || !az.AuthorizationPassed("foo", "GET", "/") {
+		t.Error("Data should be usable as an authorizations backend", err)
+	}
+}
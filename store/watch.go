@@ -0,0 +1,29 @@
+package store
+
+import (
+	"log"
+	"time"
+)
+
+// Watch polls s every interval and calls fn with the new data whenever its version
+// changes (starting from version), until stop is closed. It is meant for keeping
+// several processes sharing the same DB in sync.
+func Watch(s Store, version uint64, interval time.Duration, fn func(*Data), stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d, err := s.Load()
+			if err != nil {
+				log.Println("store: watch failed:", err)
+			} else if d.Version != version {
+				version = d.Version
+				fn(d)
+			}
+		}
+	}
+}